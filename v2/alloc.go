@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+// SetAllocateNestedPointers sets whether the server allocates the nil
+// pointer fields of args structs, and of the structs they point to, before
+// decoding the args, so that methods can access nested fields missing from
+// the request without nil checks.
+//
+// For recursive types, such as a tree node pointing to its children, a
+// pointer to a struct type being allocated is left nil: decoding then
+// allocates only the nesting present in the request.
+func (s *Server) SetAllocateNestedPointers(enabled bool) {
+	s.allocatePointers = enabled
+}
+
+// allocateNestedPointers allocates the nil pointer fields of the struct v
+// and of its nested structs, skipping the struct types in visiting, which
+// are being allocated.
+func allocateNestedPointers(v reflect.Value, visiting map[reflect.Type]bool) {
+	if v.Kind() != reflect.Struct || visiting[v.Type()] {
+		return
+	}
+	visiting[v.Type()] = true
+	defer delete(visiting, v.Type())
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Struct:
+			allocateNestedPointers(field, visiting)
+		case reflect.Ptr:
+			elem := field.Type().Elem()
+			if !field.IsNil() || visiting[elem] {
+				continue
+			}
+			field.Set(reflect.New(elem))
+			allocateNestedPointers(field.Elem(), visiting)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// SetMethodArgsPool sets the server to take the args of the calls to method
+// from a pool, reusing them once the call is served instead of allocating
+// them for each call. It is meant for hot methods with large args: the
+// methods, and the validate, args preprocessor and call middleware
+// functions, must not keep references to the args past the call.
+//
+// Methods reading the body have no args to pool.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodArgsPool(method string) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.readsBody {
+		return fmt.Errorf("rpc: method %q reads the request body, it has no args to pool", method)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	if methodSpec.argsPool == nil {
+		argsType := methodSpec.argsType
+		methodSpec.argsPool = &sync.Pool{New: func() interface{} {
+			return reflect.New(argsType).Interface()
+		}}
+	}
+	return nil
+}
+
+// newArgs returns a pointer to zero args for a call to the method, taken
+// from its pool if it has one.
+func (m *serviceMethod) newArgs() reflect.Value {
+	if m.argsPool == nil {
+		return reflect.New(m.argsType)
+	}
+	return reflect.ValueOf(m.argsPool.Get())
+}
+
+// releaseArgs returns args, created by newArgs, to the pool of the method
+// once the call is served.
+func (m *serviceMethod) releaseArgs(args reflect.Value) {
+	if m.argsPool == nil {
+		return
+	}
+	args.Elem().SetZero()
+	m.argsPool.Put(args.Interface())
+}
@@ -0,0 +1,62 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// RegisterableError reports the exported methods of a receiver that
+// RegisterService would skip.
+type RegisterableError struct {
+	Type    string            // type of the receiver
+	Methods map[string]string // reason each method is skipped, by method name
+}
+
+func (e *RegisterableError) Error() string {
+	reasons := make([]string, 0, len(e.Methods))
+	for _, name := range sortedKeys(e.Methods) {
+		reasons = append(reasons, name+" "+e.Methods[name])
+	}
+	return fmt.Sprintf("rpc: methods of %s won't be registered: %s", e.Type, strings.Join(reasons, "; "))
+}
+
+// AssertRegisterable checks the signatures of the exported methods of rcvr
+// as RegisterService does, without registering anything, so that signature
+// mistakes can be caught in an init function or a test. It returns a
+// *RegisterableError listing the methods that wouldn't be registered and
+// why, or nil if all of them would be. The Init and Close methods of
+// Initializer and io.Closer receivers aren't listed.
+//
+// Server settings affecting the registration, e.g. SetMethodFilter, are not
+// taken into account.
+func AssertRegisterable(rcvr interface{}) error {
+	t := reflect.TypeOf(rcvr)
+	if t == nil {
+		return fmt.Errorf("rpc: nil receiver")
+	}
+	var e *RegisterableError
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if isLifecycleMethod(method) {
+			continue
+		}
+		if _, reason := newServiceMethod(method); reason != "" {
+			if e == nil {
+				e = &RegisterableError{Type: t.String(), Methods: make(map[string]string)}
+			}
+			e.Methods[method.Name] = reason
+		}
+	}
+	if e != nil {
+		return e
+	}
+	if t.NumMethod() == 0 {
+		return fmt.Errorf("rpc: %v has no exported methods", t)
+	}
+	return nil
+}
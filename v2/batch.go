@@ -0,0 +1,82 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// BatchCodecRequest is implemented by codec requests of serialization schemes
+// that can carry several calls in a single request, e.g. JSON-RPC 2.0.
+type BatchCodecRequest interface {
+	CodecRequest
+	// Batch returns a codec request for each call of a batch request. The
+	// boolean result is false if the request is not a batch, in which case
+	// it is served as a single call. If maxSize is greater than zero,
+	// batches with more calls are rejected with an error.
+	Batch(maxSize int) ([]CodecRequest, bool, error)
+	// WriteBatchResponse combines the responses written by the codec
+	// requests of the batch calls and writes them to the ResponseWriter.
+	// Calls that wrote no response, like notifications, are omitted.
+	WriteBatchResponse(w http.ResponseWriter, responses [][]byte)
+}
+
+// RegisterBatchFunc registers the specified function as the function
+// that will be called once for each batch request, with the number of its
+// calls, before they are dispatched, e.g. for batch-level rate accounting.
+// The functions registered for each call, like the before and after
+// functions, are still called for each of them.
+func (s *Server) RegisterBatchFunc(f func(size int, r *http.Request)) {
+	s.batchFunc = f
+}
+
+// serveBatch dispatches each call of a batch request, collecting their
+// responses into a single one.
+func (s *Server) serveBatch(w http.ResponseWriter, r *http.Request, batchReq BatchCodecRequest, calls []CodecRequest) {
+	if s.batchFunc != nil {
+		s.batchFunc(len(calls), r)
+	}
+	responses := make([][]byte, 0, len(calls))
+	for _, call := range calls {
+		buf := newResponseBuffer()
+		s.serveRequest(buf, r, nil, call, false)
+		if buf.body.Len() > 0 {
+			responses = append(responses, buf.body.Bytes())
+		}
+	}
+	// Prevents Internet Explorer from MIME-sniffing a response away
+	// from the declared content-type
+	w.Header().Set("x-content-type-options", "nosniff")
+	batchReq.WriteBatchResponse(w, responses)
+}
+
+// responseBuffer is an http.ResponseWriter keeping the response in memory.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: make(http.Header)}
+}
+
+func (b *responseBuffer) Header() http.Header {
+	return b.header
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// ArgBinder sets args fields from other sources than the decoded params,
+// e.g. headers or cookies. Bind is called once the codec decoded the args,
+// with the pointer to them, so values it sets overlay the decoded ones. An
+// error fails the call as invalid params.
+type ArgBinder interface {
+	Bind(r *http.Request, args reflect.Value) error
+}
+
+// SetArgBinder sets the binder of the args of all the methods without their
+// own binder. See SetMethodArgBinder.
+func (s *Server) SetArgBinder(b ArgBinder) {
+	s.argBinder = b
+}
+
+// SetMethodArgBinder sets the binder of the args of the given method,
+// replacing the one set with SetArgBinder for this method.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodArgBinder(method string, b ArgBinder) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.binder = b
+	return nil
+}
+
+// bindArgs calls the binder of the method, if any.
+func (s *Server) bindArgs(r *http.Request, methodSpec *serviceMethod, args reflect.Value) error {
+	b := methodSpec.binder
+	if b == nil {
+		b = s.argBinder
+	}
+	if b == nil {
+		return nil
+	}
+	return b.Bind(r, args)
+}
+
+// TagBinder is an ArgBinder setting the fields of struct args from the
+// request header or cookie named by their "header" or "cookie" tag, e.g.
+// `header:"X-Tenant"`. Fields of string, bool, integer and floating-point
+// kinds are supported. Fields whose header or cookie is missing keep their
+// decoded value.
+type TagBinder struct{}
+
+// Bind sets the tagged fields of args.
+func (TagBinder) Bind(r *http.Request, args reflect.Value) error {
+	v := reflect.Indirect(args)
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		var value string
+		var ok bool
+		if name := f.Tag.Get("header"); name != "" {
+			if values := r.Header.Values(name); len(values) > 0 {
+				value, ok = values[0], true
+			}
+		} else if name := f.Tag.Get("cookie"); name != "" {
+			if cookie, err := r.Cookie(name); err == nil {
+				value, ok = cookie.Value, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		if err := bindValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("field %q: %v", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// bindValue sets v from the string s.
+func bindValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SetRequestDecompression sets the server to decompress the bodies of
+// requests with a gzip Content-Encoding while codecs read them, so that
+// neither the compressed nor the decompressed body has to be held in memory.
+// Limits set with SetMaxBodyBytes apply to the decompressed body. Requests
+// whose body isn't valid gzip are rejected with a 400 status.
+func (s *Server) SetRequestDecompression(enabled bool) {
+	s.decompress = enabled
+}
+
+// decompressBody replaces the body of r with its decompressed stream if it
+// is gzip encoded.
+func decompressBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody || !strings.EqualFold(r.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return fmt.Errorf("rpc: invalid gzip request body: %v", err)
+	}
+	r.Body = &gzipBody{Reader: zr, body: r.Body}
+	return nil
+}
+
+// gzipBody is the decompressed stream of a request body.
+type gzipBody struct {
+	*gzip.Reader
+	body io.ReadCloser
+}
+
+func (b *gzipBody) Close() error {
+	b.Reader.Close()
+	return b.body.Close()
+}
+
+// SetMaxBodyBytes limits the size of request bodies to n bytes, calls with a
+// larger body being rejected with a 413 status. Zero, the default, means no
+// limit.
+func (s *Server) SetMaxBodyBytes(n int64) {
+	s.maxBodyBytes = n
+}
+
+// SetMethodMaxBodyBytes limits the size of the bodies of calls to method to
+// n bytes, overriding the limit set with SetMaxBodyBytes to make it tighter
+// or looser for that method. Zero restores the server limit.
+//
+// The limit is enforced once the method is resolved, before the args are
+// decoded. When the method is given in the body, the codec reads the body
+// up to the largest limit first.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodMaxBodyBytes(method string, n int64) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if n < 0 {
+		return fmt.Errorf("rpc: invalid body size limit for %q: %d", method, n)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.maxBodyBytes = n
+	if n > s.maxMethodBody {
+		s.maxMethodBody = n
+	}
+	return nil
+}
+
+// bodyLimit returns the body size limit of calls to methodSpec, zero if
+// unlimited.
+func (s *Server) bodyLimit(methodSpec *serviceMethod) int64 {
+	if methodSpec.maxBodyBytes > 0 {
+		return methodSpec.maxBodyBytes
+	}
+	return s.maxBodyBytes
+}
+
+// readLimit returns the number of bytes of the body that can be read for a
+// call to method, or for a call to any method if it isn't known yet. Zero
+// means unlimited.
+func (s *Server) readLimit(method string, known bool) int64 {
+	if known {
+		if _, methodSpec, err := s.services.get(method); err == nil {
+			return s.bodyLimit(methodSpec)
+		}
+	}
+	if s.maxBodyBytes > 0 && s.maxMethodBody > s.maxBodyBytes {
+		return s.maxMethodBody
+	}
+	return s.maxBodyBytes
+}
+
+// limitedBody is a request body limited to a number of bytes, counting the
+// bytes read so that the limit of the method can be checked once the method
+// is resolved.
+type limitedBody struct {
+	io.ReadCloser
+	limit    int64
+	n        int64
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// limitBody returns a shallow copy of r whose body can't be read past limit
+// bytes, unless limit is zero, and is checked by checkBodySize.
+func limitBody(w http.ResponseWriter, r *http.Request, limit int64) *http.Request {
+	body := &limitedBody{ReadCloser: r.Body, limit: limit}
+	if limit > 0 {
+		body.ReadCloser = http.MaxBytesReader(w, r.Body, limit)
+	}
+	r = r.WithContext(context.WithValue(r.Context(), bodyLimitKey, body))
+	r.Body = body
+	return r
+}
+
+// checkBodySize returns an error if the body of r, as limited by limitBody,
+// was read past its limit or if the bytes read exceed limit, unless limit is
+// zero.
+func checkBodySize(r *http.Request, method string, limit int64) error {
+	body, ok := r.Context().Value(bodyLimitKey).(*limitedBody)
+	if !ok {
+		return nil
+	}
+	if body.exceeded {
+		return fmt.Errorf("rpc: request body larger than %d bytes", body.limit)
+	}
+	if limit > 0 && body.n > limit {
+		return fmt.Errorf("rpc: request body of %q larger than %d bytes", method, limit)
+	}
+	return nil
+}
+
+// readsBody returns true if method reads the request body itself, as an
+// io.Reader.
+func (s *Server) readsBody(method string) bool {
+	_, methodSpec, err := s.services.get(method)
+	return err == nil && methodSpec.readsBody
+}
+
+// withoutBody returns a shallow copy of r with an empty body, so that codecs
+// don't read the body left to the method.
+func withoutBody(r *http.Request) *http.Request {
+	r = r.WithContext(r.Context())
+	r.Body = http.NoBody
+	return r
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned for calls to a method whose circuit breaker is
+// open.
+var ErrCircuitOpen = errors.New("rpc: circuit breaker open")
+
+// BreakerConfig configures the circuit breaker of a method.
+type BreakerConfig struct {
+	// FailureRate is the rate of failed calls, between 0 and 1, opening
+	// the breaker.
+	FailureRate float64
+	// MinCalls is the number of calls needed to compute the failure rate.
+	MinCalls int
+	// Cooldown is the time the breaker stays open.
+	Cooldown time.Duration
+}
+
+// SetCircuitBreaker sets a circuit breaker for the given method. Once
+// MinCalls calls were made, if the rate of them that failed reaches
+// FailureRate the breaker opens: calls fail fast with ErrCircuitOpen and a
+// 503 status, without invoking the method, until Cooldown elapses. Calls are
+// then let through again: the first one to succeed closes the breaker and
+// resets the counts, while a failure opens it again.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetCircuitBreaker(method string, cfg BreakerConfig) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if cfg.FailureRate <= 0 || cfg.FailureRate > 1 || cfg.MinCalls < 1 {
+		return fmt.Errorf("rpc: invalid circuit breaker for %q: %+v", method, cfg)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.breaker = &circuitBreaker{config: cfg}
+	return nil
+}
+
+// circuitBreaker tracks the failures of a method.
+type circuitBreaker struct {
+	config BreakerConfig
+
+	mutex     sync.Mutex
+	calls     int
+	failures  int
+	openUntil time.Time // zero while closed
+}
+
+// allow returns true if a call may be made.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.openUntil.IsZero() || !time.Now().Before(b.openUntil)
+}
+
+// record adds the outcome of a call.
+func (b *circuitBreaker) record(failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.openUntil.IsZero() {
+		// Trial call after the cooldown.
+		if failed {
+			b.openUntil = time.Now().Add(b.config.Cooldown)
+		} else {
+			b.openUntil = time.Time{}
+			b.calls, b.failures = 0, 0
+		}
+		return
+	}
+	b.calls++
+	if failed {
+		b.failures++
+	}
+	if b.calls >= b.config.MinCalls && float64(b.failures)/float64(b.calls) >= b.config.FailureRate {
+		b.openUntil = time.Now().Add(b.config.Cooldown)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultTenantHeader is the header identifying the tenant of a request
+// unless set otherwise with SetTenantHeader.
+const DefaultTenantHeader = "X-Tenant"
+
+// ErrBudgetExceeded is returned for calls of a tenant that used up its
+// budget.
+var ErrBudgetExceeded = errors.New("rpc: tenant budget exceeded")
+
+// TenantBudget is the time a tenant may spend in method calls.
+type TenantBudget struct {
+	// Time is the cumulative time of the calls of the tenant.
+	Time time.Duration
+	// Window is the period after which the used time is reset. The used
+	// time is never reset if zero.
+	Window time.Duration
+}
+
+// SetTenantHeader sets the header identifying the tenant of a request for
+// the budgets set with SetTenantBudget, DefaultTenantHeader by default.
+func (s *Server) SetTenantHeader(header string) {
+	s.tenantHeader = header
+}
+
+// SetTenantBudget sets the budget of the given tenant. The time spent in the
+// calls of the tenant is accounted for once they return, and its calls are
+// rejected with ErrBudgetExceeded and a 429 status once it used up the
+// budget, until the window elapses. The accounting is best-effort: calls
+// running at once may all be let through, and only the time spent in the
+// method is accounted for.
+//
+// A zero budget removes the budget of the tenant. Tenants without a budget,
+// or requests without a tenant, are never throttled.
+func (s *Server) SetTenantBudget(tenant string, budget TenantBudget) {
+	if s.budgets == nil {
+		s.budgets = &tenantBudgets{usage: make(map[string]*tenantUsage)}
+	}
+	s.budgets.set(tenant, budget)
+}
+
+// tenant returns the tenant of the request, as identified by its header.
+func (s *Server) tenant(r *http.Request) string {
+	if s.tenantHeader == "" {
+		return r.Header.Get(DefaultTenantHeader)
+	}
+	return r.Header.Get(s.tenantHeader)
+}
+
+// tenantBudgets tracks the time used by the tenants having a budget.
+type tenantBudgets struct {
+	mutex sync.Mutex
+	usage map[string]*tenantUsage
+}
+
+type tenantUsage struct {
+	budget TenantBudget
+	used   time.Duration
+	since  time.Time // start of the current window
+}
+
+func (b *tenantBudgets) set(tenant string, budget TenantBudget) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if budget.Time <= 0 {
+		delete(b.usage, tenant)
+		return
+	}
+	if usage, ok := b.usage[tenant]; ok {
+		usage.budget = budget
+		return
+	}
+	b.usage[tenant] = &tenantUsage{budget: budget, since: time.Now()}
+}
+
+// allow returns false if the tenant used up its budget.
+func (b *tenantBudgets) allow(tenant string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	usage, ok := b.usage[tenant]
+	if !ok {
+		return true
+	}
+	usage.resetExpired(time.Now())
+	return usage.used < usage.budget.Time
+}
+
+// record adds d to the time used by the tenant.
+func (b *tenantBudgets) record(tenant string, d time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if usage, ok := b.usage[tenant]; ok {
+		usage.resetExpired(time.Now())
+		usage.used += d
+	}
+}
+
+// resetExpired resets the used time if the window elapsed at now.
+func (u *tenantUsage) resetExpired(now time.Time) {
+	if u.budget.Window > 0 && now.Sub(u.since) >= u.budget.Window {
+		u.used = 0
+		u.since = now
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// methodCacheSize is the maximum number of replies cached per method.
+const methodCacheSize = 1024
+
+// SetMethodCache sets the server to cache the replies of the successful
+// calls to method for ttl, so that calls with the same args are served from
+// the cache without invoking the method. Args are compared by the hash of
+// their JSON encoding, or of the fields set with SetMethodCacheKeyFields.
+// Up to 1024 replies are cached per method, and cached replies are shared
+// by the calls they serve: methods must not keep references to them, and
+// the response transforms of the method must not modify them in place, see
+// AddResponseTransform.
+//
+// A zero ttl removes the cache. Streaming methods and methods reading the
+// body can't be cached.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodCache(method string, ttl time.Duration) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.streaming {
+		return fmt.Errorf("rpc: can't cache streaming method %q", method)
+	}
+	if methodSpec.readsBody {
+		return fmt.Errorf("rpc: can't cache method %q reading the request body", method)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	if ttl <= 0 {
+		methodSpec.cache = nil
+		return nil
+	}
+	methodSpec.cache = &methodCache{ttl: ttl, entries: make(map[string]cacheEntry)}
+	return nil
+}
+
+// SetMethodCacheKeyFields restricts the cache key of method, set with
+// SetMethodCache, to the given fields of its args, e.g. to ignore a field
+// not affecting the reply such as a request id. The args type must be a
+// struct with these exported fields. Cached replies are dropped.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodCacheKeyFields(method string, fields ...string) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.cache == nil {
+		return fmt.Errorf("rpc: method %q isn't cached, see SetMethodCache", method)
+	}
+	if methodSpec.argsType.Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: args of method %q aren't a struct", method)
+	}
+	keyFields := make([][]int, len(fields))
+	for i, name := range fields {
+		field, ok := methodSpec.argsType.FieldByName(name)
+		if !ok || !field.IsExported() {
+			return fmt.Errorf("rpc: args of method %q have no exported field %q", method, name)
+		}
+		keyFields[i] = field.Index
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.cache = &methodCache{ttl: methodSpec.cache.ttl, keyFields: keyFields, entries: make(map[string]cacheEntry)}
+	return nil
+}
+
+// methodCache holds the cached replies of a method.
+type methodCache struct {
+	ttl       time.Duration
+	keyFields [][]int // indexes of the args fields making the key, all if nil
+	mutex     sync.Mutex
+	entries   map[string]cacheEntry
+}
+
+// cacheEntry is a cached reply.
+type cacheEntry struct {
+	reply   reflect.Value
+	expires time.Time
+}
+
+// key returns the cache key of args, empty if they can't be encoded.
+func (c *methodCache) key(args reflect.Value) string {
+	v := args.Interface()
+	if c.keyFields != nil {
+		values := make([]interface{}, len(c.keyFields))
+		for i, index := range c.keyFields {
+			field, err := args.Elem().FieldByIndexErr(index)
+			if err != nil {
+				// A nil embedded pointer: the field is unset.
+				continue
+			}
+			values[i] = field.Interface()
+		}
+		v = values
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return string(sum[:])
+}
+
+// get copies the reply cached for args into reply, if any. It returns the
+// cache key of args, to store the reply of the call with put otherwise.
+func (c *methodCache) get(args, reply reflect.Value) (string, bool) {
+	key := c.key(args)
+	if key == "" {
+		return "", false
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return key, false
+	}
+	reply.Elem().Set(entry.reply.Elem())
+	return key, true
+}
+
+// put caches reply under key, unless the cache is full of live replies.
+func (c *methodCache) put(key string, reply reflect.Value) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if len(c.entries) >= methodCacheSize {
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		if len(c.entries) >= methodCacheSize {
+			return
+		}
+	}
+	cached := reflect.New(reply.Elem().Type())
+	cached.Elem().Set(reply.Elem())
+	c.entries[key] = cacheEntry{reply: cached, expires: now.Add(c.ttl)}
+}
@@ -0,0 +1,94 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"reflect"
+)
+
+// CanaryHeader is the header routing a call to the canary of a method, see
+// RegisterCanary.
+const CanaryHeader = "X-Canary-Key"
+
+// canaryRoute routes a fraction of the calls of a method to an alternate
+// receiver.
+type canaryRoute struct {
+	rcvr    reflect.Value // alternate receiver
+	fn      reflect.Value // method of the alternate receiver
+	percent int           // percentage of the calls routed to it
+}
+
+// pick returns true if the call r is routed to the canary.
+func (c *canaryRoute) pick(r *http.Request) bool {
+	if key := r.Header.Get(CanaryHeader); key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		return int(h.Sum32()%100) < c.percent
+	}
+	return rand.Intn(100) < c.percent
+}
+
+// RegisterCanary routes the given percentage of the calls to method to the
+// method of the same name of an alternate receiver, e.g. to roll out a new
+// implementation progressively. The alternate method must take the same
+// args and reply types. A zero percentage removes the canary.
+//
+// Calls with a CanaryHeader are routed by a hash of its value, so that
+// calls carrying the same value, e.g. a user id, always reach the same
+// implementation. Other calls are routed at random.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) RegisterCanary(method string, altRcvr interface{}, percent int) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if percent < 0 || percent > 100 {
+		return fmt.Errorf("rpc: invalid canary percentage for %q: %d", method, percent)
+	}
+	if methodSpec.forwarded {
+		return fmt.Errorf("rpc: method %q is forwarded, it can't have a canary", method)
+	}
+	var route *canaryRoute
+	if percent > 0 {
+		rcvr := reflect.ValueOf(altRcvr)
+		var alt reflect.Method
+		ok := rcvr.IsValid()
+		if ok {
+			alt, ok = rcvr.Type().MethodByName(methodSpec.method.Name)
+		}
+		if !ok || !sameParams(alt.Type, methodSpec.method.Type) {
+			return fmt.Errorf("rpc: canary %T of %q has no method %s%v", altRcvr, method, methodSpec.method.Name, methodSpec.method.Type)
+		}
+		route = &canaryRoute{rcvr: rcvr, fn: alt.Func, percent: percent}
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.canary = route
+	return nil
+}
+
+// sameParams returns true if the method types a and b have the same
+// parameters and results, besides their receiver.
+func sameParams(a, b reflect.Type) bool {
+	if a.NumIn() != b.NumIn() || a.NumOut() != b.NumOut() {
+		return false
+	}
+	for i := 1; i < a.NumIn(); i++ {
+		if a.In(i) != b.In(i) {
+			return false
+		}
+	}
+	for i := 0; i < a.NumOut(); i++ {
+		if a.Out(i) != b.Out(i) {
+			return false
+		}
+	}
+	return true
+}
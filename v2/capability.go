@@ -0,0 +1,53 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strings"
+)
+
+// CapabilitiesHeader is the header in which clients advertise their
+// capabilities, as a comma-separated list, see RequireCapability.
+const CapabilitiesHeader = "X-Capabilities"
+
+// RequireCapability exposes method only to the clients advertising the given
+// capability in the CapabilitiesHeader, e.g. for a progressive rollout. The
+// calls of other clients are rejected as calls of unknown methods, so that
+// the method stays hidden from them. Capabilities are compared without
+// case. ListMethods and Snapshot leave the method out, and DocsHandler only
+// describes it to the clients with the capability. An empty capability
+// exposes the method to all clients again.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) RequireCapability(method, capability string) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.capability = strings.TrimSpace(capability)
+	return nil
+}
+
+// exposedTo returns true if the method can be called by the client of r. A
+// nil r stands for a client without capabilities.
+func (m *serviceMethod) exposedTo(r *http.Request) bool {
+	if m.capability == "" {
+		return true
+	}
+	if r == nil {
+		return false
+	}
+	for _, value := range r.Header.Values(CapabilitiesHeader) {
+		for _, capability := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(capability), m.capability) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// ErrClientCertRequired is returned for calls without a client certificate
+// when RequireClientCert is set.
+var ErrClientCertRequired = errors.New("rpc: client certificate required")
+
+// RequireClientCert sets the server to require a TLS client certificate for
+// every call. Once the method is resolved, check is called with the leaf
+// certificate presented by the client and the canonical name of the method,
+// as in "Service.Method", whatever the name in the request; calls for which it
+// returns an error are rejected with that error and a 403 status, so that
+// each method can accept its own client identities. Calls without a client
+// certificate are rejected with ErrClientCertRequired.
+//
+// The certificate is not verified by the server: configure the TLS listener
+// to verify client certificates, e.g. with tls.RequireAndVerifyClientCert.
+func (s *Server) RequireClientCert(check func(cert *x509.Certificate, method string) error) {
+	s.clientCertCheck = check
+}
+
+// checkClientCert returns an error if the client certificate of r isn't
+// accepted for method.
+func (s *Server) checkClientCert(r *http.Request, method string) error {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return ErrClientCertRequired
+	}
+	return s.clientCertCheck(r.TLS.PeerCertificates[0], method)
+}
@@ -0,0 +1,98 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// SetCoalesce sets the server to coalesce concurrent calls to the given
+// method with identical arguments: while a call is running, identical calls
+// wait for it instead of invoking the method, and all of them receive its
+// reply and error. Arguments are compared by the hash of their JSON encoding.
+// If the running call is aborted with http.ErrAbortHandler, one of the
+// waiting calls invokes the method in its place.
+//
+// The waiting calls receive a shallow copy of the reply: the maps, slices
+// and pointers it holds are shared between the responses, so response
+// transforms must not modify them in place, see AddResponseTransform.
+//
+// Only methods without side effects should be coalesced, since a single
+// execution serves requests from different clients. Streaming methods can't
+// be coalesced.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetCoalesce(method string) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.streaming {
+		return fmt.Errorf("rpc: can't coalesce streaming method %q", method)
+	}
+	if methodSpec.readsBody {
+		return fmt.Errorf("rpc: can't coalesce method %q reading the request body", method)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	if methodSpec.coalesce == nil {
+		methodSpec.coalesce = &coalesceGroup{calls: make(map[string]*coalescedCall)}
+	}
+	return nil
+}
+
+// coalesceGroup tracks the running calls of a coalesced method.
+type coalesceGroup struct {
+	mutex sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+// coalescedCall is a running call shared by identical requests.
+type coalescedCall struct {
+	done     chan struct{}
+	reply    reflect.Value
+	errValue []reflect.Value
+}
+
+// do calls fn, which fills reply, unless an identical call is running, in
+// which case it waits for it and copies its reply. If that call is aborted,
+// the waiting calls coalesce again, so that one of them calls its own fn.
+func (g *coalesceGroup) do(args, reply reflect.Value, fn func() []reflect.Value) []reflect.Value {
+	b, err := json.Marshal(args.Interface())
+	if err != nil {
+		return fn()
+	}
+	sum := sha256.Sum256(b)
+	key := string(sum[:])
+
+	g.mutex.Lock()
+	if call, ok := g.calls[key]; ok {
+		g.mutex.Unlock()
+		<-call.done
+		if call.errValue == nil {
+			// The call panicked with http.ErrAbortHandler: its response
+			// is abandoned, but the waiting ones aren't.
+			return g.do(args, reply, fn)
+		}
+		reply.Elem().Set(call.reply.Elem())
+		return call.errValue
+	}
+	call := &coalescedCall{done: make(chan struct{}), reply: reply}
+	g.calls[key] = call
+	g.mutex.Unlock()
+
+	defer func() {
+		g.mutex.Lock()
+		delete(g.calls, key)
+		g.mutex.Unlock()
+		close(call.done)
+	}()
+	call.errValue = fn()
+	return call.errValue
+}
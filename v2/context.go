@@ -0,0 +1,148 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// contextKey is the type of the keys this package stores in a request
+// context, unexported to avoid collisions with other packages.
+type contextKey int
+
+const (
+	methodHolderKey contextKey = iota
+	callStateKey
+	bodyLimitKey
+	replayKey
+)
+
+// methodHolder records the method resolved while serving a request, so that
+// middleware wrapping the server can read it after the server returns.
+type methodHolder struct {
+	method string
+	ok     bool
+}
+
+// callState is the state of a method call, stored in the context of the
+// request passed to the method.
+type callState struct {
+	info   *MethodInfo
+	values map[interface{}]interface{} // set with RequestInfo.SetValue
+	mutex  sync.Mutex
+	header http.Header // set with SetResponseHeader
+}
+
+// Middleware is the standard net/http middleware signature: it receives the
+// next handler in the chain and returns a handler wrapping it.
+type Middleware func(next http.Handler) http.Handler
+
+// Handler returns the server wrapped by the given middleware, the first one
+// being the outermost.
+//
+// The returned handler prepares the request context so that any of the
+// middleware can call MethodFromContext once the inner handler returns.
+func (s *Server) Handler(middleware ...Middleware) http.Handler {
+	var h http.Handler = s
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(methodHolderKey).(*methodHolder); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), methodHolderKey, new(methodHolder)))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// MethodFromContext returns the RPC method resolved by the server for the
+// request carrying ctx.
+//
+// It only reports a method for requests served through Handler, and only
+// after the server has resolved it, so middleware should call it after
+// invoking the next handler.
+func (s *Server) MethodFromContext(ctx context.Context) (string, bool) {
+	holder, ok := ctx.Value(methodHolderKey).(*methodHolder)
+	if !ok || !holder.ok {
+		return "", false
+	}
+	return holder.method, true
+}
+
+// MethodInfoFromContext returns the description of the method being called
+// with ctx, the context of the request passed to methods. Methods can use it
+// to behave based on their own registration, e.g. generic methods
+// registered under several names.
+func MethodInfoFromContext(ctx context.Context) (MethodInfo, bool) {
+	state, ok := ctx.Value(callStateKey).(*callState)
+	if !ok {
+		return MethodInfo{}, false
+	}
+	return *state.info, true
+}
+
+// SetResponseHeader sets a header of the response to the method call made
+// with ctx, the context of the request passed to methods, replacing any
+// value set before. The headers are added to the response before the codec
+// writes the reply or the error, so methods can set them whatever they
+// return. It does nothing outside a method call, and for streaming methods,
+// which set their headers on their http.ResponseWriter, and calls of batch
+// requests.
+func SetResponseHeader(ctx context.Context, key, value string) {
+	state, ok := ctx.Value(callStateKey).(*callState)
+	if !ok {
+		return
+	}
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	if state.header == nil {
+		state.header = make(http.Header)
+	}
+	state.header.Set(key, value)
+}
+
+// SetValue stores val under key for the method call, so that a Before
+// function can pass values it computed, e.g. the authenticated user, to the
+// method, which reads them with Value. It must be called in a Before
+// function, or the validate function, of the call: the values are set
+// once these return. As with context values, keys should be of an
+// unexported type to avoid collisions.
+func (i *RequestInfo) SetValue(key, val interface{}) {
+	if i.values == nil {
+		i.values = make(map[interface{}]interface{})
+	}
+	i.values[key] = val
+}
+
+// Value returns the value stored under key with RequestInfo.SetValue for
+// the method call made with ctx, the context of the request passed to
+// methods, or nil if there is none.
+func Value(ctx context.Context, key interface{}) interface{} {
+	state, ok := ctx.Value(callStateKey).(*callState)
+	if !ok {
+		return nil
+	}
+	return state.values[key]
+}
+
+// applyHeader copies the headers set with SetResponseHeader to h.
+func (c *callState) applyHeader(h http.Header) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, values := range c.header {
+		h[key] = values
+	}
+}
+
+// setResolvedMethod records method as resolved for r, if r was prepared by
+// Handler.
+func setResolvedMethod(r *http.Request, method string) {
+	if holder, ok := r.Context().Value(methodHolderKey).(*methodHolder); ok {
+		holder.method = method
+		holder.ok = true
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DeadlineHeader is the request header clients can set to the number of
+// milliseconds the server may spend serving the call.
+const DeadlineHeader = "X-RPC-Deadline"
+
+// ErrDeadlineExceeded is the error returned when a call doesn't complete
+// within its deadline.
+var ErrDeadlineExceeded = errors.New("rpc: deadline exceeded")
+
+// PartialResult is implemented by replies of methods that can return a
+// best-effort result when their call is cut short.
+//
+// If the request context is done, because the deadline passed or the client
+// canceled the call, and the method returns the context error (or
+// ErrDeadlineExceeded), the server calls PartialResult on the reply. If it
+// returns true, the reply is written as a successful response, with a
+// "Warning" header telling the client the result is partial. Otherwise the
+// error is written as usual.
+type PartialResult interface {
+	PartialResult() bool
+}
+
+// SetMaxDeadline sets the maximum deadline clients can request through the
+// DeadlineHeader. Longer deadlines are clamped to d. A value of zero, the
+// default, means no maximum.
+func (s *Server) SetMaxDeadline(d time.Duration) {
+	s.maxDeadline = d
+}
+
+// SetMethodTimeout sets the maximum execution time of the given method,
+// overriding any timeout set with SetServiceTimeout. The context of the
+// request passed to the method is done once the timeout elapses, and the call
+// fails with ErrDeadlineExceeded.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodTimeout(method string, timeout time.Duration) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.timeout = timeout
+	return nil
+}
+
+// SetServiceTimeout sets the maximum execution time of the methods of the
+// services under the given path of the service tree, e.g. "A.B" for the
+// methods of the services "A.B" and "A.B.C", unless a nearer path or the
+// method itself has a timeout set. See SetMethodTimeout.
+func (s *Server) SetServiceTimeout(path string, timeout time.Duration) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	if s.services.timeouts == nil {
+		s.services.timeouts = make(map[string]time.Duration)
+	}
+	s.services.timeouts[path] = timeout
+}
+
+// requestDeadline returns the deadline requested by the client, clamped to
+// the server maximum. The boolean result is false if there is none.
+func (s *Server) requestDeadline(r *http.Request) (time.Duration, bool, error) {
+	header := r.Header.Get(DeadlineHeader)
+	if header == "" {
+		return 0, false, nil
+	}
+	ms, err := strconv.ParseInt(header, 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, false, fmt.Errorf("rpc: invalid %s header: %q", DeadlineHeader, header)
+	}
+	d := time.Duration(ms) * time.Millisecond
+	if s.maxDeadline > 0 && d > s.maxDeadline {
+		d = s.maxDeadline
+	}
+	return d, true, nil
+}
+
+// isPartialResult returns true if reply holds a partial result to be written
+// despite err, the error of a call whose context is done.
+func isPartialResult(r *http.Request, reply interface{}, err error) bool {
+	ctxErr := r.Context().Err()
+	if ctxErr == nil {
+		return false
+	}
+	if err != ErrDeadlineExceeded && !errors.Is(err, ctxErr) {
+		return false
+	}
+	p, ok := reply.(PartialResult)
+	return ok && p.PartialResult()
+}
+
+// partialResultWarning returns the "Warning" header value sent along with a
+// partial result.
+func partialResultWarning(err error) string {
+	return fmt.Sprintf("199 - %q", "partial result: "+err.Error())
+}
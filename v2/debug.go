@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// echoHiddenHeaders are the request headers left out of the reply of
+// system.echo, as they hold credentials.
+var echoHiddenHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// EchoReply is the reply of the system.echo method.
+type EchoReply struct {
+	Method  string          `json:"method"`  // method resolved by the server, "system.echo"
+	Headers http.Header     `json:"headers"` // headers of the request, without credentials
+	Params  json.RawMessage `json:"params"`  // params as decoded by the codec
+}
+
+// SetDebug enables or disables the debug methods. Once enabled, the
+// "system.echo" method replies with an EchoReply holding the headers of
+// the request, except those holding credentials, the method resolved by the
+// server and the params as the codec decoded them, to diagnose how clients
+// serialize their calls. The params must be valid JSON for the codec to
+// decode them. It is disabled by default, and should stay disabled in
+// production.
+func (s *Server) SetDebug(enabled bool) error {
+	s.removeSystemMethod("echo")
+	if !enabled {
+		return nil
+	}
+	return s.addSystemMethod("echo", "Echo")
+}
+
+// Echo replies with the metadata of the request.
+func (t *systemService) Echo(r *http.Request, args *json.RawMessage, reply *EchoReply) error {
+	reply.Headers = r.Header.Clone()
+	for _, key := range echoHiddenHeaders {
+		reply.Headers.Del(key)
+	}
+	if info, ok := MethodInfoFromContext(r.Context()); ok {
+		reply.Method = info.Name
+	}
+	reply.Params = *args
+	return nil
+}
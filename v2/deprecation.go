@@ -0,0 +1,31 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// Deprecation describes the deprecation of a method, so that clients can
+// plan their migration.
+type Deprecation struct {
+	Since       string `json:"since,omitempty"`       // version deprecating the method
+	Removal     string `json:"removal,omitempty"`     // version removing the method
+	Replacement string `json:"replacement,omitempty"` // method to call instead
+	Message     string `json:"message,omitempty"`     // free form notes
+}
+
+// DeprecateMethod marks a method as deprecated. The deprecation is reported
+// in the MethodInfo of the method, returned by ServiceMethods and
+// MethodInfoFromContext, and in the output of DocsHandler. Deprecated
+// methods are still served.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) DeprecateMethod(method string, deprecation Deprecation) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.info.Deprecation = &deprecation
+	return nil
+}
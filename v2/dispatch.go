@@ -0,0 +1,63 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// Phase is a phase of the dispatch of a call.
+type Phase int
+
+const (
+	// PhaseResolve resolves the method and admits the call, e.g. checking
+	// the body size, the content type and the circuit breaker.
+	PhaseResolve Phase = iota
+	// PhaseDecode decodes and binds the args.
+	PhaseDecode
+	// PhaseValidate validates the params and the args.
+	PhaseValidate
+	// PhaseHandler calls the method, through the call middleware.
+	PhaseHandler
+	// PhaseEncode transforms the reply before it is written.
+	PhaseEncode
+)
+
+var phaseNames = [...]string{"resolve", "decode", "validate", "handler", "encode"}
+
+func (p Phase) String() string {
+	if p < 0 || int(p) >= len(phaseNames) {
+		return "unknown"
+	}
+	return phaseNames[p]
+}
+
+// DispatchError is the error of a call failing in any phase of its
+// dispatch, see SetDispatchErrors.
+type DispatchError struct {
+	Phase  Phase
+	Method string // empty if the method couldn't be read
+	Err    error
+}
+
+// Error returns the message of the underlying error, so that the error
+// responses are the same whether dispatch errors are enabled or not.
+func (e *DispatchError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DispatchError) Unwrap() error {
+	return e.Err
+}
+
+// SetDispatchErrors sets the server to wrap the errors of calls in a
+// *DispatchError recording the phase in which they failed, so that error
+// mappers and After functions can handle, for instance, decode errors
+// differently from the errors returned by methods. The wrapped errors are
+// passed to the codecs, which still write the underlying one, and their
+// error mappers, as well as to the After functions, which are then also
+// called for the calls failing before the method is called.
+//
+// Error mappers and After functions must then use errors.As or errors.Is to
+// test the underlying error.
+func (s *Server) SetDispatchErrors(enabled bool) {
+	s.dispatchErrors = enabled
+}
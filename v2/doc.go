@@ -72,6 +72,11 @@ and make available the ones that follow these rules:
 	- The second and third arguments are exported or local.
 	- The method has return type error.
 
+The first argument can also be a context.Context, receiving the context of
+the request, the second an io.Reader for methods reading the request body
+themselves, and the third an http.ResponseWriter for methods writing their
+response themselves. See Server.RegisterService.
+
 All other methods are ignored.
 
 Gorilla has packages with common RPC codecs. Check out their documentation:
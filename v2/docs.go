@@ -0,0 +1,30 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Docs is the document served by DocsHandler.
+type Docs struct {
+	Methods []MethodInfo `json:"methods"`
+}
+
+// DocsHandler returns a handler responding with a JSON Docs document
+// describing the enabled methods exposed to the client, sorted by name,
+// including their deprecation and their example, see SetCaptureExamples and
+// RequireCapability.
+func (s *Server) DocsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		docs := Docs{Methods: s.services.methodInfos(r)}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("x-content-type-options", "nosniff")
+		if err := json.NewEncoder(w).Encode(docs); err != nil {
+			s.logf("rpc: writing docs: %v", err)
+		}
+	})
+}
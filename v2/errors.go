@@ -0,0 +1,45 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"strings"
+)
+
+// InvalidParamsError reports method arguments that were decoded but then
+// rejected by the server. Codecs can use it to report the error with a
+// dedicated code, e.g. -32602 in JSON-RPC 2.0.
+type InvalidParamsError struct {
+	Err error
+}
+
+func (e *InvalidParamsError) Error() string {
+	return "rpc: invalid params: " + e.Err.Error()
+}
+
+func (e *InvalidParamsError) Unwrap() error {
+	return e.Err
+}
+
+// IsUnknownFieldError returns true if err reports a field unknown to the
+// value decoded by a json.Decoder, see DisallowUnknownFields. encoding/json
+// has no dedicated error type for it. Codecs report such errors as an
+// InvalidParamsError.
+func IsUnknownFieldError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "json: unknown field ")
+}
+
+// Error is an error methods can return to set the code and data of the
+// error response, for codecs supporting them, e.g. JSON-RPC 2.0. Codecs write
+// it as-is, without passing it to their error mappers.
+type Error struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
@@ -0,0 +1,62 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+)
+
+// Example is a sample call of a method, captured by SetCaptureExamples.
+type Example struct {
+	Args  json.RawMessage `json:"args"`  // decoded args, encoded as JSON
+	Reply json.RawMessage `json:"reply"` // reply, encoded as JSON
+}
+
+// SetCaptureExamples sets the server to capture the args and the reply of
+// the first successful call of each method, whatever its codec, and to
+// report them in the MethodInfo of the method, e.g. in the output of
+// DocsHandler. Both are encoded as JSON and passed through redact before
+// being captured, e.g. to mask personal data: the examples are published
+// with the docs. A nil redact stops the capture; pass a function returning
+// its argument to capture the calls as they are. Methods reading the body
+// or streaming their response have no examples.
+func (s *Server) SetCaptureExamples(redact func([]byte) []byte) {
+	s.exampleRedactor = redact
+}
+
+// captureExample records the args and reply of a successful call as the
+// example of methodSpec, unless it already has one.
+func (s *Server) captureExample(methodSpec *serviceMethod, args, reply interface{}) {
+	s.services.mutex.Lock()
+	captured := methodSpec.example != nil
+	s.services.mutex.Unlock()
+	if captured {
+		return
+	}
+	example := &Example{
+		Args:  s.exampleJSON(args),
+		Reply: s.exampleJSON(reply),
+	}
+	if example.Args == nil || example.Reply == nil {
+		return
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	if methodSpec.example == nil {
+		methodSpec.example = example
+	}
+}
+
+// exampleJSON returns v encoded as JSON and redacted, nil if it can't be.
+func (s *Server) exampleJSON(v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+	if b = s.exampleRedactor(b); !json.Valid(b) {
+		return nil
+	}
+	return b
+}
@@ -0,0 +1,24 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// OnRegistrationComplete registers a function called by FinalizeRegistration
+// with the registered methods, e.g. for a gateway to build its routes from
+// the final set of methods. Functions are called in the order they were
+// registered.
+func (s *Server) OnRegistrationComplete(f func(methods []string)) {
+	s.registeredFuncs = append(s.registeredFuncs, f)
+}
+
+// FinalizeRegistration signals that all the services are registered: the
+// functions registered with OnRegistrationComplete are called with the
+// enabled methods, sorted as in ListMethods. It can be called again after
+// further registrations.
+func (s *Server) FinalizeRegistration() {
+	methods := s.ListMethods()
+	for _, f := range s.registeredFuncs {
+		f(append([]string(nil), methods...))
+	}
+}
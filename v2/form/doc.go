@@ -0,0 +1,48 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gorilla/rpc/form provides a codec for RPC calls sent as
+multipart/form-data, e.g. file uploads from HTML forms.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/gorilla/rpc/v2"
+		"github.com/gorilla/rpc/v2/form"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(form.NewCodec(), "multipart/form-data")
+		// [...]
+		http.Handle("/rpc", s)
+	}
+
+The method is read from the "method" form field, or given by the server when
+it reads it from the URL path or a header. The other form fields and the
+file parts are mapped onto the fields of the args struct by name, or by the
+name in their "form" tag:
+
+	type UploadArgs struct {
+		Title string
+		Tags  []string
+		File  *multipart.FileHeader `form:"file"`
+	}
+
+Fields can be strings, booleans, integers, floats, slices of those for
+repeated form fields, and multipart.FileHeader, *multipart.FileHeader or
+[]*multipart.FileHeader for file parts.
+The files are only available while the method runs: the temporary files of
+large file parts are removed once the response is written.
+
+The reply is encoded as JSON in the response body. Errors are encoded as
+{"error": "message"}.
+
+Check the gorilla/rpc documentation for more details:
+
+	http://gorilla-web.appspot.com/pkg/rpc
+*/
+package form
@@ -0,0 +1,200 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/rpc/v2"
+)
+
+type UploadArgs struct {
+	Title   string
+	Tags    []string
+	Private bool
+	Size    int
+	File    *multipart.FileHeader `form:"file"`
+	Ignored string                `form:"-"`
+}
+
+type UploadReply struct {
+	Title    string
+	Tags     []string
+	Private  bool
+	Size     int
+	Filename string
+	Content  string
+}
+
+type UploadService struct {
+}
+
+func (t *UploadService) Upload(r *http.Request, args *UploadArgs, reply *UploadReply) error {
+	f, err := args.File.Open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	*reply = UploadReply{
+		Title:    args.Title,
+		Tags:     args.Tags,
+		Private:  args.Private,
+		Size:     args.Size,
+		Filename: args.File.Filename,
+		Content:  string(content),
+	}
+	return nil
+}
+
+// newUploadRequest returns a multipart/form-data request with the given
+// fields and a file part.
+func newUploadRequest(t *testing.T, url string, fields [][2]string) *http.Request {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, field := range fields {
+		if err := mw.WriteField(field[0], field[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("file", "report.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.WriteString(fw, "a,b\n1,2\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", url, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	return r
+}
+
+func TestUpload(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "multipart/form-data")
+	if err := s.RegisterService(new(UploadService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newUploadRequest(t, "http://localhost:8080/", [][2]string{
+		{"method", "UploadService.Upload"},
+		{"Title", "Q3"},
+		{"Tags", "finance"},
+		{"Tags", "quarterly"},
+		{"Private", "true"},
+		{"Size", "8"},
+		{"Ignored", "x"},
+	})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 {
+		t.Fatalf("Status was %d (%s), should be 200", w.Code, w.Body)
+	}
+	var reply UploadReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	expected := UploadReply{
+		Title:    "Q3",
+		Tags:     []string{"finance", "quarterly"},
+		Private:  true,
+		Size:     8,
+		Filename: "report.csv",
+		Content:  "a,b\n1,2\n",
+	}
+	if !reflect.DeepEqual(reply, expected) {
+		t.Errorf("Wrong reply: got %+v, want %+v", reply, expected)
+	}
+}
+
+func TestUploadRemovesFiles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	codec := NewCodec()
+	codec.SetMaxMemory(0)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "multipart/form-data")
+	if err := s.RegisterService(new(UploadService), ""); err != nil {
+		t.Fatal(err)
+	}
+	// The request is copied by the server for the Before function.
+	s.RegisterBeforeFunc(func(i *rpc.RequestInfo) {})
+
+	r := newUploadRequest(t, "http://localhost:8080/", [][2]string{{"method", "UploadService.Upload"}})
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"Content":"a,b\n1,2\n"`) {
+		t.Fatalf("Response was %d %s, should be the reply", w.Code, w.Body)
+	}
+	if files, err := os.ReadDir(dir); err != nil || len(files) != 0 {
+		t.Errorf("Temporary files were %v (%v), should be removed", files, err)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "multipart/form-data")
+	if err := s.RegisterService(new(UploadService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		fields [][2]string
+		error  string
+	}{
+		{[][2]string{{"Title", "Q3"}}, "rpc: method request ill-formed: missing method field"},
+		{[][2]string{{"method", "UploadService.Upload"}, {"Size", "big"}}, `rpc: invalid params: field "Size": strconv.ParseInt: parsing "big": invalid syntax`},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, newUploadRequest(t, "http://localhost:8080/", test.fields))
+		var res struct {
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != 400 || res.Error != test.error {
+			t.Errorf("Response was %d %q, should be 400 %q", w.Code, res.Error, test.error)
+		}
+	}
+}
+
+func TestUploadMethodFromPath(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "multipart/form-data")
+	if err := s.RegisterService(new(UploadService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMethodFromPath("/rpc/")
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, newUploadRequest(t, "http://localhost:8080/rpc/UploadService.Upload", [][2]string{{"Title", "Q4"}}))
+	var reply UploadReply
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Title != "Q4" || reply.Filename != "report.csv" {
+		t.Errorf("Wrong reply: %+v", reply)
+	}
+}
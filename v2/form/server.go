@@ -0,0 +1,231 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package form
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/gorilla/rpc/v2"
+)
+
+// MethodField is the name of the form field holding the method.
+const MethodField = "method"
+
+// defaultMaxMemory is the size of the request body kept in memory, the
+// rest of the file parts being stored in temporary files.
+const defaultMaxMemory = 32 << 20
+
+var (
+	typeOfFileHeader    = reflect.TypeOf(multipart.FileHeader{})
+	typeOfFileHeaderPtr = reflect.TypeOf((*multipart.FileHeader)(nil))
+)
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new multipart/form-data Codec.
+func NewCodec() *Codec {
+	return &Codec{maxMemory: defaultMaxMemory}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+	maxMemory int64
+}
+
+// SetMaxMemory sets the size of the request body kept in memory while
+// parsing it, the rest of the file parts being stored in temporary files.
+// The default is 32 MB.
+func (c *Codec) SetMaxMemory(n int64) {
+	c.maxMemory = n
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	req := c.newCodecRequest(r)
+	if req.err == nil {
+		req.method = r.MultipartForm.Value[MethodField]
+	}
+	return req
+}
+
+// NewParamsRequest returns a CodecRequest for the given method, all the form
+// fields being params.
+func (c *Codec) NewParamsRequest(r *http.Request, method string) rpc.CodecRequest {
+	req := c.newCodecRequest(r)
+	req.method = []string{method}
+	return req
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest parsing the form of r.
+func (c *Codec) newCodecRequest(r *http.Request) *CodecRequest {
+	if err := r.ParseMultipartForm(c.maxMemory); err != nil {
+		return &CodecRequest{err: err}
+	}
+	return &CodecRequest{form: r.MultipartForm}
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	form   *multipart.Form
+	method []string
+	err    error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err != nil {
+		return "", c.err
+	}
+	if len(c.method) != 1 || c.method[0] == "" {
+		return "", errors.New("rpc: method request ill-formed: missing method field")
+	}
+	return c.method[0], nil
+}
+
+// ReadRequest fills the request object for the RPC method, which must be a
+// pointer to a struct.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("rpc: form args must be a pointer to a struct, got %T", args)
+	}
+	v = v.Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("form"); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		if err := setField(v.Field(i), c.form.Value[name], c.form.File[name]); err != nil {
+			return &rpc.InvalidParamsError{Err: fmt.Errorf("field %q: %v", name, err)}
+		}
+	}
+	return nil
+}
+
+// setField sets the struct field v from the form values or files with its
+// name.
+func setField(v reflect.Value, values []string, files []*multipart.FileHeader) error {
+	switch v.Type() {
+	case typeOfFileHeader:
+		if len(files) > 0 {
+			v.Set(reflect.ValueOf(*files[0]))
+		}
+		return nil
+	case typeOfFileHeaderPtr:
+		if len(files) > 0 {
+			v.Set(reflect.ValueOf(files[0]))
+		}
+		return nil
+	case reflect.SliceOf(typeOfFileHeaderPtr):
+		v.Set(reflect.ValueOf(files))
+		return nil
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	if v.Kind() == reflect.Slice {
+		s := reflect.MakeSlice(v.Type(), len(values), len(values))
+		for i, value := range values {
+			if err := setValue(s.Index(i), value); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+		return nil
+	}
+	return setValue(v, values[0])
+}
+
+// setValue sets v from the form value s.
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	defer c.removeFiles()
+	writeServerResponse(w, http.StatusOK, reply)
+}
+
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	defer c.removeFiles()
+	writeServerResponse(w, status, &struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
+
+// removeFiles removes the temporary files of the file parts once the
+// response is written. The server parses the form of a copy of the request,
+// so the files wouldn't be removed by the http package.
+func (c *CodecRequest) removeFiles() {
+	if c.form != nil {
+		c.form.RemoveAll()
+	}
+}
+
+func writeServerResponse(w http.ResponseWriter, status int, res interface{}) {
+	b, err := json.Marshal(res)
+	if err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -0,0 +1,95 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// Forwarder forwards a call to a schema-only method, registered with
+// RegisterSchema, filling the reply, e.g. by calling another server.
+type Forwarder func(r *http.Request, method string, args, reply interface{}) error
+
+// SetForwarder sets the function that calls to schema-only methods are
+// forwarded to. Without one, such calls fail.
+func (s *Server) SetForwarder(f Forwarder) {
+	s.forwarder = f
+}
+
+// RegisterSchema registers a method without a receiver, only declaring the
+// types of its args and reply, e.g. for a gateway. Calls to the method are
+// decoded and validated as usual, then forwarded to the Forwarder set by
+// SetForwarder.
+//
+// The method uses a dotted notation as in "Service.Method". Schema-only
+// methods can't be added to services registered with a receiver.
+func (s *Server) RegisterSchema(method string, argsType, replyType reflect.Type) error {
+	return s.services.registerSchema(method, argsType, replyType)
+}
+
+func (m *serviceMap) registerSchema(method string, argsType, replyType reflect.Type) error {
+	serviceName, methodName, ok := m.split(method)
+	if !ok {
+		return fmt.Errorf("rpc: invalid method name %q", method)
+	}
+	if argsType == nil || replyType == nil {
+		return fmt.Errorf("rpc: missing args or reply type for %q", method)
+	}
+	if argsType.Kind() == reflect.Ptr {
+		argsType = argsType.Elem()
+	}
+	if replyType.Kind() == reflect.Ptr {
+		replyType = replyType.Elem()
+	}
+	methodSpec := &serviceMethod{
+		argsType:  argsType,
+		replyType: replyType,
+		forwarded: true,
+	}
+	methodSpec.info = newMethodInfo(method, methodSpec)
+
+	m.mutex.Lock()
+	s := m.services[serviceName]
+	if s == nil {
+		m.mutex.Unlock()
+		return m.add(&service{
+			name:    serviceName,
+			methods: map[string]*serviceMethod{methodName: methodSpec},
+		})
+	}
+	defer m.mutex.Unlock()
+	if s.rcvr.IsValid() {
+		return fmt.Errorf("rpc: service %q has a receiver", serviceName)
+	}
+	if _, ok := s.methods[methodName]; ok {
+		return fmt.Errorf("rpc: method already defined: %q", method)
+	}
+	if _, ok := m.services[method]; ok {
+		collision := fmt.Sprintf("method %q of service %q collides with service %q", methodName, serviceName, method)
+		if m.strictNamespace {
+			return fmt.Errorf("rpc: %s", collision)
+		}
+		if m.warnf != nil {
+			m.warnf("rpc: warning: %s", collision)
+		}
+	}
+	m.updateMethods(s, func(methods map[string]*serviceMethod) {
+		methods[methodName] = methodSpec
+	})
+	return nil
+}
+
+// forward forwards the call of a schema-only method.
+func (s *Server) forward(r *http.Request, method string, args, reply reflect.Value) []reflect.Value {
+	var err error
+	if s.forwarder == nil {
+		err = fmt.Errorf("rpc: no forwarder for %q", method)
+	} else {
+		err = s.forwarder(r, method, args.Interface(), reply.Interface())
+	}
+	return []reflect.Value{reflect.ValueOf(&err).Elem()}
+}
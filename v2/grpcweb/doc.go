@@ -0,0 +1,38 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package gorilla/rpc/grpcweb provides a codec for calls sent by gRPC-Web
+clients using the JSON message format, so that browser code generated for
+gRPC-Web can call the methods of a RPC server.
+
+To register the codec in a RPC server:
+
+	import (
+		"http"
+		"github.com/gorilla/rpc/v2"
+		"github.com/gorilla/rpc/v2/grpcweb"
+	)
+
+	func init() {
+		s := rpc.NewServer()
+		s.RegisterCodec(grpcweb.NewCodec(), "application/grpc-web+json")
+		s.RegisterService(new(HelloService), "pkg.Greeter")
+		// [...]
+		http.Handle("/", s)
+	}
+
+The method is read from the last two segments of the URL path as gRPC does,
+so that a POST to "/pkg.Greeter/SayHello" calls "pkg.Greeter.SayHello". The
+body holds a single length-prefixed message: a flags byte, the big-endian
+32-bit length of the message and the message itself, the JSON encoding of
+the method args.
+
+Responses always have a 200 status. The body holds the JSON encoding of the
+reply as a length-prefixed message, followed by the trailers frame holding
+the grpc-status and grpc-message of the call. Errors are reported in the
+trailers only, with the gRPC status code matching the status the server
+gave to the error, e.g. INVALID_ARGUMENT for invalid params.
+*/
+package grpcweb
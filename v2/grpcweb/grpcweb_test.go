@@ -0,0 +1,172 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/rpc/v2"
+)
+
+type HelloArgs struct {
+	Name string `json:"name"`
+}
+
+type HelloReply struct {
+	Message string `json:"message"`
+}
+
+type GreeterService struct{}
+
+func (s *GreeterService) SayHello(r *http.Request, args *HelloArgs, reply *HelloReply) error {
+	if args.Name == "" {
+		return errors.New("name required")
+	}
+	reply.Message = "Hello, " + args.Name
+	return nil
+}
+
+func frame(flags byte, msg string) []byte {
+	b := make([]byte, headerLen, headerLen+len(msg))
+	b[0] = flags
+	binary.BigEndian.PutUint32(b[1:], uint32(len(msg)))
+	return append(b, msg...)
+}
+
+// readFrames splits a response body into its message and trailers.
+func readFrames(t *testing.T, body []byte) (msg, trailers string) {
+	for len(body) > 0 {
+		if len(body) < headerLen {
+			t.Fatalf("truncated frame header: %q", body)
+		}
+		n := int(binary.BigEndian.Uint32(body[1:headerLen]))
+		data := string(body[headerLen : headerLen+n])
+		if body[0]&flagTrailers != 0 {
+			trailers = data
+		} else {
+			msg = data
+		}
+		body = body[headerLen+n:]
+	}
+	return msg, trailers
+}
+
+func call(t *testing.T, path string, body []byte) (msg, trailers string) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), ContentType)
+	if err := s.RegisterService(new(GreeterService), "pkg.Greeter"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", path, bytes.NewReader(body))
+	r.Header.Set("Content-Type", ContentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+	}
+	return readFrames(t, w.Body.Bytes())
+}
+
+func TestGRPCWeb(t *testing.T) {
+	msg, trailers := call(t, "/pkg.Greeter/SayHello", frame(0, `{"name":"gopher"}`))
+	if msg != `{"message":"Hello, gopher"}` {
+		t.Errorf("message = %q", msg)
+	}
+	if trailers != "grpc-status: 0\r\ngrpc-message: \r\n" {
+		t.Errorf("trailers = %q", trailers)
+	}
+
+	// The method is read from the last two segments of the path.
+	msg, _ = call(t, "/api/pkg.Greeter/SayHello", frame(0, `{"name":"gopher"}`))
+	if msg != `{"message":"Hello, gopher"}` {
+		t.Errorf("message with path prefix = %q", msg)
+	}
+
+	msg, trailers = call(t, "/pkg.Greeter/SayHello", frame(0, `{}`))
+	if msg != "" {
+		t.Errorf("message of failed call = %q, want none", msg)
+	}
+	if trailers != "grpc-status: 2\r\ngrpc-message: name required\r\n" {
+		t.Errorf("trailers of failed call = %q", trailers)
+	}
+
+	_, trailers = call(t, "/pkg.Greeter", frame(0, `{}`))
+	if !bytes.HasPrefix([]byte(trailers), []byte("grpc-status: 2\r\n")) {
+		t.Errorf("trailers of bad path = %q", trailers)
+	}
+
+	_, trailers = call(t, "/pkg.Greeter/SayHello", frame(flagCompressed, `{}`))
+	if !bytes.HasPrefix([]byte(trailers), []byte("grpc-status: 2\r\n")) {
+		t.Errorf("trailers of compressed message = %q", trailers)
+	}
+}
+
+func TestGRPCWebBody(t *testing.T) {
+	codec := NewCodec()
+	codec.SetMaxMessageSize(64)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, ContentType)
+	if err := s.RegisterService(new(GreeterService), "pkg.Greeter"); err != nil {
+		t.Fatal(err)
+	}
+	// The codec request is created again once the Before function ran.
+	s.RegisterBeforeFunc(func(i *rpc.RequestInfo) {})
+	serve := func(body []byte) (msg, trailers string) {
+		r := httptest.NewRequest("POST", "/pkg.Greeter/SayHello", bytes.NewReader(body))
+		r.Header.Set("Content-Type", ContentType)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return readFrames(t, w.Body.Bytes())
+	}
+
+	msg, trailers := serve(frame(0, `{"name":"gopher"}`))
+	if msg != `{"message":"Hello, gopher"}` || trailers != "grpc-status: 0\r\ngrpc-message: \r\n" {
+		t.Errorf("With a Before function, response was %q %q", msg, trailers)
+	}
+
+	// The declared length is checked before the message is read.
+	huge := frame(0, "{}")
+	binary.BigEndian.PutUint32(huge[1:], 1<<31)
+	if _, trailers := serve(huge); !strings.Contains(trailers, "exceeds the maximum of 64") {
+		t.Errorf("With a huge declared length, trailers were %q", trailers)
+	}
+	if _, trailers := serve(frame(0, `{"name":"`+strings.Repeat("x", 100)+`"}`)); !strings.Contains(trailers, "exceeds the maximum of 64") {
+		t.Errorf("With a message too large, trailers were %q", trailers)
+	}
+	if _, trailers := serve(frame(0, `{"name":"gopher"}`)[:10]); !strings.Contains(trailers, "truncated message") {
+		t.Errorf("With a truncated message, trailers were %q", trailers)
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	tests := []struct {
+		status int
+		err    error
+		code   int
+	}{
+		{http.StatusBadRequest, errors.New("failed"), codeUnknown},
+		{http.StatusBadRequest, &rpc.InvalidParamsError{Err: errors.New("bad")}, codeInvalidArgument},
+		{http.StatusForbidden, rpc.ErrClientCertRequired, codePermissionDenied},
+		{http.StatusServiceUnavailable, rpc.ErrCircuitOpen, codeUnavailable},
+		{http.StatusTooManyRequests, rpc.ErrBudgetExceeded, codeResourceExhausted},
+	}
+	for _, tt := range tests {
+		if code := statusCode(tt.status, tt.err); code != tt.code {
+			t.Errorf("statusCode(%d, %v) = %d, want %d", tt.status, tt.err, code, tt.code)
+		}
+	}
+	if got := encodeMessage("100% ok\n"); got != "100%25 ok%0A" {
+		t.Errorf("encodeMessage = %q", got)
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package grpcweb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/rpc/v2"
+)
+
+// ContentType is the Content-Type of gRPC-Web requests and responses using
+// the JSON message format.
+const ContentType = "application/grpc-web+json"
+
+const (
+	// headerLen is the length of the prefix of a message: a flags byte and
+	// the length of the message.
+	headerLen = 5
+	// flagCompressed marks a compressed message.
+	flagCompressed = 0x01
+	// flagTrailers marks the frame holding the trailers of a response.
+	flagTrailers = 0x80
+	// defaultMaxMessageSize is the default maximum size of a request message.
+	defaultMaxMessageSize = 4 << 20
+)
+
+// gRPC status codes, see
+// https://github.com/grpc/grpc/blob/master/doc/statuscodes.md.
+const (
+	codeOK                = 0
+	codeUnknown           = 2
+	codeInvalidArgument   = 3
+	codeDeadlineExceeded  = 4
+	codeNotFound          = 5
+	codePermissionDenied  = 7
+	codeResourceExhausted = 8
+	codeUnimplemented     = 12
+	codeInternal          = 13
+	codeUnavailable       = 14
+	codeUnauthenticated   = 16
+)
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new gRPC-Web Codec.
+func NewCodec() *Codec {
+	return &Codec{delimiter: ".", maxMessageSize: defaultMaxMessageSize}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+	delimiter      string
+	maxMessageSize int
+}
+
+// SetMethodDelimiter sets the separator placed between the service and the
+// method read from the URL path. It must match the delimiter of the server,
+// see Server.SetMethodDelimiter. The default is ".".
+func (c *Codec) SetMethodDelimiter(sep string) {
+	c.delimiter = sep
+}
+
+// SetMaxMessageSize sets the maximum size of the message of a request,
+// larger messages being rejected before they are read. The default is 4 MB,
+// as for gRPC servers.
+func (c *Codec) SetMaxMessageSize(n int) {
+	c.maxMessageSize = n
+}
+
+// NewRequest returns a CodecRequest.
+func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
+	service, method, err := splitPath(r.URL.Path)
+	if err != nil {
+		return &CodecRequest{err: err}
+	}
+	return newCodecRequest(r, service+c.delimiter+method, c.maxMessageSize)
+}
+
+// NewParamsRequest returns a CodecRequest for the given method, read by the
+// server instead of the URL path.
+func (c *Codec) NewParamsRequest(r *http.Request, method string) rpc.CodecRequest {
+	return newCodecRequest(r, method, c.maxMessageSize)
+}
+
+// splitPath returns the service and the method of a gRPC path, the last two
+// segments of "/pkg.Service/Method".
+func splitPath(path string) (service, method string, err error) {
+	path = strings.TrimSuffix(path, "/")
+	idx := strings.LastIndex(path, "/")
+	if idx > 0 {
+		method = path[idx+1:]
+		service = path[strings.LastIndex(path[:idx], "/")+1 : idx]
+	}
+	if service == "" || method == "" {
+		return "", "", fmt.Errorf("rpc: gRPC-Web path must be /Service/Method, got %q", path)
+	}
+	return service, method, nil
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns a new CodecRequest reading the message in the body
+// of r, at most maxSize bytes long.
+func newCodecRequest(r *http.Request, method string, maxSize int) *CodecRequest {
+	// Copy request body for decoding and access of underlying methods
+	b, err := io.ReadAll(io.LimitReader(r.Body, int64(headerLen+maxSize)+1))
+	if err != nil {
+		return &CodecRequest{err: err}
+	}
+	// Close original body
+	r.Body.Close()
+	// Add close method to buffer and pass as request body
+	r.Body = io.NopCloser(bytes.NewBuffer(b))
+
+	msg, err := readMessage(b, maxSize)
+	return &CodecRequest{method: method, message: msg, err: err}
+}
+
+// readMessage returns the single length-prefixed message of a request body,
+// rejecting messages longer than maxSize.
+func readMessage(body []byte, maxSize int) ([]byte, error) {
+	if len(body) == 0 {
+		// An empty body holds no message: the args are left as zero.
+		return nil, nil
+	}
+	if len(body) < headerLen {
+		return nil, errors.New("rpc: gRPC-Web message ill-formed: truncated header")
+	}
+	if body[0]&flagCompressed != 0 {
+		return nil, errors.New("rpc: gRPC-Web compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(body[1:headerLen])
+	if uint64(size) > uint64(maxSize) {
+		return nil, fmt.Errorf("rpc: gRPC-Web message of %d bytes exceeds the maximum of %d", size, maxSize)
+	}
+	msg := body[headerLen:]
+	if uint64(len(msg)) < uint64(size) {
+		return nil, errors.New("rpc: gRPC-Web message ill-formed: truncated message")
+	}
+	return msg[:size], nil
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	method  string
+	message []byte
+	err     error
+	strict  bool
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "pkg.Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.method, nil
+	}
+	return "", c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err == nil && len(c.message) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(c.message))
+		if c.strict {
+			dec.DisallowUnknownFields()
+		}
+		c.err = dec.Decode(args)
+		if rpc.IsUnknownFieldError(c.err) {
+			c.err = &rpc.InvalidParamsError{Err: c.err}
+		}
+	}
+	return c.err
+}
+
+// DisallowUnknownFields makes ReadRequest reject messages with fields the
+// args don't have, reporting them as invalid params.
+func (c *CodecRequest) DisallowUnknownFields() {
+	c.strict = true
+}
+
+// WriteResponse encodes the response and writes it to the ResponseWriter.
+func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		c.writeResponse(w, nil, codeInternal, err.Error())
+		return
+	}
+	c.writeResponse(w, b, codeOK, "")
+}
+
+// WriteError writes the error in the trailers of the response, with the gRPC
+// status code matching status.
+func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	c.writeResponse(w, nil, statusCode(status, err), err.Error())
+}
+
+// writeResponse writes the message, if any, and the trailers of a response.
+func (c *CodecRequest) writeResponse(w http.ResponseWriter, msg []byte, code int, message string) {
+	var buf bytes.Buffer
+	if msg != nil {
+		writeFrame(&buf, 0, msg)
+	}
+	trailers := fmt.Sprintf("grpc-status: %d\r\ngrpc-message: %s\r\n", code, encodeMessage(message))
+	writeFrame(&buf, flagTrailers, []byte(trailers))
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(buf.Bytes())
+}
+
+// writeFrame writes b to buf prefixed with the flags and its length.
+func writeFrame(buf *bytes.Buffer, flags byte, b []byte) {
+	var header [headerLen]byte
+	header[0] = flags
+	binary.BigEndian.PutUint32(header[1:], uint32(len(b)))
+	buf.Write(header[:])
+	buf.Write(b)
+}
+
+// statusCode returns the gRPC status code of an error the server reported
+// with the given HTTP status.
+func statusCode(status int, err error) int {
+	var invalidParams *rpc.InvalidParamsError
+	if errors.As(err, &invalidParams) {
+		return codeInvalidArgument
+	}
+	switch status {
+	case http.StatusUnauthorized:
+		return codeUnauthenticated
+	case http.StatusForbidden:
+		return codePermissionDenied
+	case http.StatusNotFound:
+		return codeNotFound
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests:
+		return codeResourceExhausted
+	case http.StatusUnsupportedMediaType, http.StatusNotImplemented:
+		return codeUnimplemented
+	case http.StatusServiceUnavailable:
+		return codeUnavailable
+	case http.StatusGatewayTimeout:
+		return codeDeadlineExceeded
+	case http.StatusInternalServerError:
+		return codeInternal
+	}
+	return codeUnknown
+}
+
+// encodeMessage percent-encodes a grpc-message trailer value, as required
+// for the bytes outside printable ASCII and '%'.
+func encodeMessage(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,51 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+const (
+	// HealthStatusOK is the status reported by a passing health check.
+	HealthStatusOK = "ok"
+	// HealthStatusFailing is the status reported by a failing health check.
+	HealthStatusFailing = "failing"
+)
+
+// HealthCheckArgs are the arguments of a health check method.
+type HealthCheckArgs struct {
+}
+
+// HealthCheckReply is the reply of a health check method.
+type HealthCheckReply struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// healthCheck is the receiver of the methods registered by
+// RegisterHealthCheck.
+type healthCheck struct {
+	check func() error
+}
+
+// Check runs the health check. A failing check is reported in the reply, not
+// as an RPC error, so that probes can always read the status.
+func (h *healthCheck) Check(r *http.Request, args *HealthCheckArgs, reply *HealthCheckReply) error {
+	if err := h.check(); err != nil {
+		reply.Status = HealthStatusFailing
+		reply.Error = err.Error()
+		return nil
+	}
+	reply.Status = HealthStatusOK
+	return nil
+}
+
+// RegisterHealthCheck registers a service with the given name exposing a
+// single "Check" method, e.g. "Database.Check", that runs the check function
+// and replies with a HealthCheckReply.
+func (s *Server) RegisterHealthCheck(name string, check func() error) error {
+	return s.RegisterService(&healthCheck{check: check}, name)
+}
@@ -0,0 +1,60 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// RegisterBeforeFuncWithPriority adds a function called before every
+// request, like the one registered with RegisterBeforeFunc. Functions run
+// by decreasing priority, those of the same priority in the order they
+// were added, e.g. to run authentication before logging whatever the
+// registration order. The function registered with RegisterBeforeFunc has
+// priority 0 and runs after the other functions of priority 0.
+func (s *Server) RegisterBeforeFuncWithPriority(f func(i *RequestInfo), priority int) {
+	s.beforeHooks = s.beforeHooks.add(f, priority)
+}
+
+// RegisterAfterFuncWithPriority adds a function called after every
+// request, like the one registered with RegisterAfterFunc, ordered as in
+// RegisterBeforeFuncWithPriority.
+func (s *Server) RegisterAfterFuncWithPriority(f func(i *RequestInfo), priority int) {
+	s.afterHooks = s.afterHooks.add(f, priority)
+}
+
+// priorityHook is a before or after function with its priority.
+type priorityHook struct {
+	f        func(i *RequestInfo)
+	priority int
+}
+
+// hookList holds functions sorted by decreasing priority, then by
+// registration order.
+type hookList []priorityHook
+
+// add returns the list with f inserted after the functions of the same or a
+// higher priority.
+func (l hookList) add(f func(i *RequestInfo), priority int) hookList {
+	i := len(l)
+	for i > 0 && l[i-1].priority < priority {
+		i--
+	}
+	l = append(l, priorityHook{})
+	copy(l[i+1:], l[i:])
+	l[i] = priorityHook{f: f, priority: priority}
+	return l
+}
+
+// run calls the functions of the list with info, and single, if not nil,
+// after the functions of priority 0.
+func (l hookList) run(info *RequestInfo, single func(i *RequestInfo)) {
+	for _, hook := range l {
+		if single != nil && hook.priority < 0 {
+			single(info)
+			single = nil
+		}
+		hook.f(info)
+	}
+	if single != nil {
+		single(info)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// IDCodecRequest is implemented by codec requests of serialization schemes
+// carrying request IDs echoed in the responses, e.g. JSON-RPC.
+type IDCodecRequest interface {
+	CodecRequest
+	// HasID returns true if the request carries an ID.
+	HasID() bool
+	// SetID sets the ID of a request without one, to be echoed in its
+	// response.
+	SetID(id string)
+}
+
+// SetIDGenerator sets a function generating IDs for the requests without
+// one, for codecs implementing IDCodecRequest. The generated ID is echoed in
+// the response, as if the client had sent it, so requests without an ID
+// like JSON-RPC notifications then get a response, e.g. for tracing.
+func (s *Server) SetIDGenerator(f func() string) {
+	s.idGenerator = f
+}
+
+// assignID sets a generated ID on codecReq if it has none, returning it.
+func (s *Server) assignID(codecReq CodecRequest) string {
+	idReq, ok := codecReq.(IDCodecRequest)
+	if !ok || s.idGenerator == nil || idReq.HasID() {
+		return ""
+	}
+	id := s.idGenerator()
+	idReq.SetID(id)
+	return id
+}
@@ -104,6 +104,7 @@ func newCodecRequest(r *http.Request) rpc.CodecRequest {
 type CodecRequest struct {
 	request *serverRequest
 	err     error
+	strict  bool
 }
 
 // Method returns the RPC method for the current request.
@@ -123,7 +124,16 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 			// JSON params is array value. RPC params is struct.
 			// Unmarshal into array containing the request struct.
 			params := [1]interface{}{args}
-			c.err = json.Unmarshal(*c.request.Params, &params)
+			if c.strict {
+				dec := json.NewDecoder(bytes.NewReader(*c.request.Params))
+				dec.DisallowUnknownFields()
+				c.err = dec.Decode(&params)
+			} else {
+				c.err = json.Unmarshal(*c.request.Params, &params)
+			}
+			if rpc.IsUnknownFieldError(c.err) {
+				c.err = &rpc.InvalidParamsError{Err: c.err}
+			}
 		} else {
 			c.err = errors.New("rpc: method request ill-formed: missing params field")
 		}
@@ -131,6 +141,12 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+// DisallowUnknownFields makes ReadRequest reject params with fields the args
+// don't have, reporting them as invalid params.
+func (c *CodecRequest) DisallowUnknownFields() {
+	c.strict = true
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
 	if c.request.Id != nil {
@@ -149,6 +165,9 @@ func (c *CodecRequest) WriteError(w http.ResponseWriter, _ int, err error) {
 		Result: &null,
 		Id:     c.request.Id,
 	}
+	if dispatchErr, ok := err.(*rpc.DispatchError); ok {
+		err = dispatchErr.Err
+	}
 	if jsonErr, ok := err.(*Error); ok {
 		res.Error = jsonErr.Data
 	} else {
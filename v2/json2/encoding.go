@@ -0,0 +1,216 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	typeOfMarshaler     = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	typeOfTextMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	typeOfTime          = reflect.TypeOf(time.Time{})
+	typeOfTimePtr       = reflect.TypeOf((*time.Time)(nil))
+)
+
+// replyEncoding sets how replies are encoded, see Codec.SetCamelCaseReplies
+// and Codec.SetTimeFormat.
+type replyEncoding struct {
+	camelCase   bool
+	marshalTime func(t time.Time) ([]byte, error)
+}
+
+// encodable returns the value of v as it must be encoded: the value itself,
+// unless the encoding differs from the one of encoding/json.
+func (e replyEncoding) encodable(v reflect.Value) interface{} {
+	if !e.camelCase && e.marshalTime == nil {
+		if !v.IsValid() {
+			return nil
+		}
+		return v.Interface()
+	}
+	return e.value(v)
+}
+
+// timeMarshaler encodes a time.Time with a custom function.
+type timeMarshaler struct {
+	t       time.Time
+	marshal func(t time.Time) ([]byte, error)
+}
+
+func (m timeMarshaler) MarshalJSON() ([]byte, error) {
+	return m.marshal(m.t)
+}
+
+// encodedObject is a JSON object encoding its members in order.
+type encodedObject []encodedMember
+
+type encodedMember struct {
+	name  string
+	value interface{}
+}
+
+func (o encodedObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, member := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, err := json.Marshal(member.name)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(name)
+		b.WriteByte(':')
+		value, err := json.Marshal(member.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// value returns a value encoding as v does, except that, with camelCase
+// set, the names of the struct fields without an explicit name in their json
+// tag have their first letter lower cased, and that time.Time values are
+// encoded with marshalTime if it is set. Other values implementing
+// json.Marshaler or encoding.TextMarshaler are kept as they are.
+func (e replyEncoding) value(v reflect.Value) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if e.marshalTime != nil && (v.Type() == typeOfTime || v.Type() == typeOfTimePtr && !v.IsNil()) {
+		return timeMarshaler{t: reflect.Indirect(v).Interface().(time.Time), marshal: e.marshalTime}
+	}
+	if v.Type().Implements(typeOfMarshaler) || v.Type().Implements(typeOfTextMarshaler) {
+		return v.Interface()
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		if p := v.Addr(); p.Type().Implements(typeOfMarshaler) || p.Type().Implements(typeOfTextMarshaler) {
+			return p.Interface()
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return e.value(v.Elem())
+	case reflect.Struct:
+		object := encodedObject{}
+		e.appendFields(&object, v)
+		return object
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Encoded as a base64 string.
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		values := make([]interface{}, v.Len())
+		for i := range values {
+			values[i] = e.value(v.Index(i))
+		}
+		return values
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		values := reflect.MakeMapWithSize(reflect.MapOf(v.Type().Key(), reflect.TypeOf((*interface{})(nil)).Elem()), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			value := reflect.ValueOf(e.value(iter.Value()))
+			if !value.IsValid() {
+				value = reflect.Zero(values.Type().Elem())
+			}
+			values.SetMapIndex(iter.Key(), value)
+		}
+		return values.Interface()
+	}
+	return v.Interface()
+}
+
+// appendFields appends the encoded fields of the struct v to object,
+// flattening embedded structs as encoding/json does.
+func (e replyEncoding) appendFields(object *encodedObject, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		field := v.Field(i)
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if field.Kind() == reflect.Ptr {
+					if field.IsNil() {
+						continue
+					}
+					field = field.Elem()
+				}
+				e.appendFields(object, field)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if strings.Contains(","+options+",", ",omitempty,") && isEmptyValue(field) {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+			if e.camelCase {
+				name = lowerFirst(name)
+			}
+		}
+		*object = append(*object, encodedMember{name: name, value: e.value(field)})
+	}
+}
+
+// lowerFirst returns s with its first letter lower cased.
+func lowerFirst(s string) string {
+	r, n := utf8.DecodeRuneInString(s)
+	return string(unicode.ToLower(r)) + s[n:]
+}
+
+// isEmptyValue reports whether v is omitted by the omitempty option of
+// encoding/json.
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
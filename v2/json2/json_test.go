@@ -7,11 +7,17 @@ package json2
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 )
@@ -274,6 +280,46 @@ func TestServiceWithErrorMapper(t *testing.T) {
 	}
 }
 
+func TestServiceWithRequestErrorMapper(t *testing.T) {
+	messages := map[string]string{
+		"en": "something went wrong",
+		"fr": "une erreur est survenue",
+	}
+	errorMapper := func(r *http.Request, err error) error {
+		message, ok := messages[r.Header.Get("Accept-Language")]
+		if !ok {
+			return err
+		}
+		return &Error{
+			Code:    E_SERVER,
+			Message: message,
+		}
+	}
+
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodecWithRequestErrorMapper(rpc.DefaultEncoderSelector, errorMapper), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, lang := range []string{"en", "fr"} {
+		buf, _ := EncodeClientRequest("Service1.ResponseError", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("Accept-Language", lang)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+		if jsonRpcErr, ok := err.(*Error); !ok {
+			t.Errorf("Expected to get an *Error, but got %T: %v", err, err)
+		} else if jsonRpcErr.Message != messages[lang] {
+			t.Errorf("Expected to get Message %q for %q, but got %q", messages[lang], lang, jsonRpcErr.Message)
+		}
+	}
+}
+
 func TestDecodeNullResult(t *testing.T) {
 	data := `{"jsonrpc": "2.0", "id": 12345, "result": null}`
 	reader := bytes.NewReader([]byte(data))
@@ -289,3 +335,1204 @@ func TestDecodeNullResult(t *testing.T) {
 		t.Error("Expected result to be nil, but got:", result)
 	}
 }
+
+func TestPositionalAndNamedParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		params interface{}
+	}{
+		{"by-position", []int{4, 2}},
+		{"by-name", map[string]int{"A": 4, "B": 2}},
+	}
+	for _, tt := range tests {
+		req := struct {
+			V  string      `json:"jsonrpc"`
+			M  string      `json:"method"`
+			P  interface{} `json:"params"`
+			ID uint64      `json:"id"`
+		}{"2.0", "Service1.Multiply", tt.params, 1}
+		var res Service1Response
+		if err := executeRaw(t, s, &req, &res); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if res.Result != 8 {
+			t.Errorf("%s: wrong response: got %v, want %v", tt.name, res.Result, 8)
+		}
+	}
+
+	// More positional params than fields.
+	req := struct {
+		V  string `json:"jsonrpc"`
+		M  string `json:"method"`
+		P  []int  `json:"params"`
+		ID uint64 `json:"id"`
+	}{"2.0", "Service1.Multiply", []int{4, 2, 1}, 1}
+	var res Service1Response
+	if err := executeRaw(t, s, &req, &res); err == nil {
+		t.Error("Expected an error for too many positional params, but got nil")
+	}
+}
+
+func executeBatch(t *testing.T, s *rpc.Server, batch string) *ResponseRecorder {
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w := executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 1, "B": 1}},
+		{"jsonrpc": "2.0", "method": "Service1.ResponseError", "params": {"A": 1, "B": 1}, "id": 2}
+	]`)
+	var res []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("Expected 2 responses, the notification omitted, but got %d", len(res))
+	}
+	if res[0].Id != 1 || res[0].Result == nil || res[0].Result.Result != 8 {
+		t.Errorf("Wrong first response: %+v", res[0])
+	}
+	if res[1].Id != 2 || res[1].Error == nil || res[1].Error.Message != ErrResponseError.Error() {
+		t.Errorf("Wrong second response: %+v", res[1])
+	}
+
+	// A batch of notifications gets no response at all.
+	w = executeBatch(t, s, `[{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 1, "B": 1}}]`)
+	if w.Body.Len() != 0 {
+		t.Errorf("Expected an empty body, but got %q", w.Body.String())
+	}
+
+	// An element that isn't a request object is an invalid request.
+	w = executeBatch(t, s, `[1]`)
+	res = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Error == nil || res[0].Error.Code != E_INVALID_REQ {
+		t.Errorf("Expected an invalid request error, but got %q", w.Body.String())
+	}
+}
+
+func TestBatchFunc(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int
+	var calls int
+	s.RegisterBatchFunc(func(size int, r *http.Request) {
+		sizes = append(sizes, size)
+	})
+	s.RegisterBeforeFunc(func(i *rpc.RequestInfo) {
+		calls++
+	})
+
+	executeBatch(t, s, `[
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 1, "B": 1}, "id": 2},
+		{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 1, "B": 1}}
+	]`)
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 1 || sizes[0] != 3 {
+		t.Errorf("Expected the batch function to be called once with 3, but got %v", sizes)
+	}
+	if calls != 4 {
+		t.Errorf("Expected the before function to be called 4 times, but got %d", calls)
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	var calls int
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterAfterFunc(func(i *rpc.RequestInfo) {
+		calls++
+	})
+	s.SetMaxBatchSize(2)
+
+	call := `{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 1}`
+
+	// At the limit.
+	w := executeBatch(t, s, "["+call+","+call+"]")
+	var res []serverResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 || calls != 2 {
+		t.Errorf("Expected 2 responses and calls, but got %d and %d", len(res), calls)
+	}
+
+	// Above the limit.
+	calls = 0
+	w = executeBatch(t, s, "["+call+","+call+","+call+"]")
+	var single Service1Response
+	err := DecodeClientResponse(w.Body, &single)
+	if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to get an *Error, but got %T: %v", err, err)
+	} else if jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected to get an E_INVALID_REQ error (%d), but got %d", E_INVALID_REQ, jsonRpcErr.Code)
+	}
+	if calls != 0 {
+		t.Errorf("Expected no calls to be dispatched, but got %d", calls)
+	}
+}
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func gzipBatch(w io.Writer, calls int) error {
+	zw := gzip.NewWriter(w)
+	if _, err := io.WriteString(zw, "["); err != nil {
+		return err
+	}
+	for i := 0; i < calls; i++ {
+		if i > 0 {
+			if _, err := io.WriteString(zw, ","); err != nil {
+				return err
+			}
+		}
+		call := fmt.Sprintf(`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": %d, "B": 2}, "id": %d}`, i, i)
+		if _, err := io.WriteString(zw, call); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(zw, "]"); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func TestGzipBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetRequestDecompression(true)
+	s.SetMaxBatchSize(10000)
+
+	var body bytes.Buffer
+	if err := gzipBatch(&body, 5000); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", &body)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	var res []struct {
+		Result *Service1Response `json:"result"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%v: %.200s", err, w.Body.String())
+	}
+	if len(res) != 5000 {
+		t.Fatalf("Expected 5000 responses, got %d", len(res))
+	}
+	for i, res := range res {
+		if res.Id != i || res.Result == nil || res.Result.Result != 2*i {
+			t.Fatalf("Wrong response %d: %+v", i, res)
+		}
+	}
+
+	// A batch above the limit is rejected without decompressing all of it.
+	const calls = 200000
+	pr, pw := io.Pipe()
+	written := make(chan int64)
+	go func() {
+		counter := &countingWriter{w: pw}
+		gzipBatch(counter, calls)
+		written <- counter.n
+	}()
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", pr)
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	pr.CloseWithError(errors.New("closed"))
+	var total bytes.Buffer
+	if err := gzipBatch(&total, calls); err != nil {
+		t.Fatal(err)
+	}
+	if n := <-written; n >= int64(total.Len())/2 {
+		t.Errorf("Expected the server to stop reading early, but %d of %d compressed bytes were written", n, total.Len())
+	}
+	var single Service1Response
+	err := DecodeClientResponse(w.Body, &single)
+	if jsonRpcErr, ok := err.(*Error); !ok || jsonRpcErr.Code != E_INVALID_REQ {
+		t.Errorf("Expected an E_INVALID_REQ error, but got %v", err)
+	}
+
+	// Bodies that aren't gzip are rejected.
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("[]"))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Content-Encoding", "gzip")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400, got %d", w.Code)
+	}
+}
+
+type Service2Request struct {
+	Name string
+}
+
+type Service2Response struct {
+	Greeting string
+}
+
+type Service2 struct {
+}
+
+func (t *Service2) Greet(r *http.Request, req *Service2Request, res *Service2Response) error {
+	res.Greeting = "Hello, " + req.Name
+	return nil
+}
+
+func TestArgsPreprocessor(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service2), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetArgsPreprocessor(func(method string, args interface{}) error {
+		req, ok := args.(*Service2Request)
+		if !ok || method != "Service2.Greet" {
+			t.Errorf("Unexpected preprocessor call for %s with %T", method, args)
+			return nil
+		}
+		req.Name = strings.TrimSpace(req.Name)
+		if req.Name == "" {
+			return errors.New("name is required")
+		}
+		return nil
+	})
+
+	var res Service2Response
+	if err := execute(t, s, "Service2.Greet", &Service2Request{"  Gopher \n"}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Greeting != "Hello, Gopher" {
+		t.Errorf("Wrong response: got %q, want %q", res.Greeting, "Hello, Gopher")
+	}
+
+	err := execute(t, s, "Service2.Greet", &Service2Request{"   "}, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to get an *Error, but got %T: %v", err, err)
+	} else if jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to get an E_BAD_PARAMS error (%d), but got %d", E_BAD_PARAMS, jsonRpcErr.Code)
+	} else if jsonRpcErr.Message != "name is required" {
+		t.Errorf("Expected to get Message %q, but got %q", "name is required", jsonRpcErr.Message)
+	}
+}
+
+type ProxyResponse struct {
+	Params string
+}
+
+type ProxyService struct {
+}
+
+func (t *ProxyService) Forward(r *http.Request, req *json.RawMessage, res *ProxyResponse) error {
+	res.Params = string(*req)
+	return nil
+}
+
+func TestRawParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(ProxyService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("ProxyService.Forward") {
+		t.Fatal("Expected to be registered: ProxyService.Forward")
+	}
+
+	for _, params := range []string{`{"b": 2,  "a": [1, 2.50]}`, `[3, "x",null]`} {
+		body := `{"jsonrpc": "2.0", "method": "ProxyService.Forward", "params": ` + params + `, "id": 1}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res ProxyResponse
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Params != params {
+			t.Errorf("Wrong raw params: got %q, want %q", res.Params, params)
+		}
+	}
+}
+
+type ErrorDataService struct {
+}
+
+func (t *ErrorDataService) Fail(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return &rpc.Error{
+		Code:    42,
+		Message: "invalid operands",
+		Data:    map[string]int{"A": req.A, "B": req.B},
+	}
+}
+
+func TestErrorData(t *testing.T) {
+	s := rpc.NewServer()
+	// The mapper must not be applied to rpc.Error.
+	errorMapper := func(err error) error {
+		return &Error{Code: E_SERVER, Message: "mapped"}
+	}
+	s.RegisterCodec(NewCustomCodecWithErrorMapper(rpc.DefaultEncoderSelector, errorMapper), "application/json")
+	if err := s.RegisterService(new(ErrorDataService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var res Service1Response
+	err := execute(t, s, "ErrorDataService.Fail", &Service1Request{4, 2}, &res)
+	jsonRpcErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected to get an *Error, but got %T: %v", err, err)
+	}
+	if jsonRpcErr.Code != 42 || jsonRpcErr.Message != "invalid operands" {
+		t.Errorf("Expected code 42 and message %q, but got %d and %q", "invalid operands", jsonRpcErr.Code, jsonRpcErr.Message)
+	}
+	data, ok := jsonRpcErr.Data.(map[string]interface{})
+	if !ok || data["A"] != float64(4) || data["B"] != float64(2) {
+		t.Errorf("Wrong error data: %#v", jsonRpcErr.Data)
+	}
+}
+
+type ValidationDetail struct {
+	FieldName string
+	Reason    string
+}
+
+type BrokenDetail struct {
+	Reason string
+	Notify func()
+}
+
+type DetailService struct {
+}
+
+func (t *DetailService) Validate(r *http.Request, req *struct{}, res *struct{}) error {
+	return &rpc.Error{Code: 42, Message: "invalid", Data: ValidationDetail{FieldName: "email", Reason: "missing"}}
+}
+
+func (t *DetailService) Broken(r *http.Request, req *struct{}, res *struct{}) error {
+	return &rpc.Error{Code: 43, Message: "broken", Data: BrokenDetail{Reason: "unencodable"}}
+}
+
+func TestErrorDataEncoding(t *testing.T) {
+	codec := NewCodec()
+	codec.SetCamelCaseReplies(true)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	if err := s.RegisterService(new(DetailService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The data is encoded as replies are, with camel case names.
+	err := execute(t, s, "DetailService.Validate", struct{}{}, new(struct{}))
+	jsonErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected an *Error, got %T: %v", err, err)
+	}
+	expected := map[string]interface{}{"fieldName": "email", "reason": "missing"}
+	if !reflect.DeepEqual(jsonErr.Data, expected) {
+		t.Errorf("Wrong error data: %#v", jsonErr.Data)
+	}
+
+	// Data that can't be encoded is written as a string.
+	err = execute(t, s, "DetailService.Broken", struct{}{}, new(struct{}))
+	jsonErr, ok = err.(*Error)
+	if !ok {
+		t.Fatalf("Expected an *Error, got %T: %v", err, err)
+	}
+	if jsonErr.Code != 43 || jsonErr.Message != "broken" {
+		t.Errorf("Wrong error: %d %q", jsonErr.Code, jsonErr.Message)
+	}
+	if data, ok := jsonErr.Data.(string); !ok || !strings.Contains(data, "Reason:unencodable") {
+		t.Errorf("Wrong error data: %#v", jsonErr.Data)
+	}
+}
+
+type ImportReply struct {
+	Imported int
+}
+
+type ImportService struct {
+}
+
+func (t *ImportService) Import(r *http.Request, req *struct{}, res *ImportReply) error {
+	res.Imported = 7
+	return errors.New("row 8 is invalid")
+}
+
+func TestIncludeReplyOnError(t *testing.T) {
+	codec := NewCodec()
+	codec.SetCamelCaseReplies(true)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	if err := s.RegisterService(new(ImportService), ""); err != nil {
+		t.Fatal(err)
+	}
+	serve := func() map[string]json.RawMessage {
+		buf, _ := EncodeClientRequest("ImportService.Import", struct{}{})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res map[string]json.RawMessage
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// The reply is discarded by default.
+	if res := serve(); res["result"] != nil || res["error"] == nil {
+		t.Errorf("Expected only an error, got %v", res)
+	}
+
+	s.SetIncludeReplyOnError(true)
+	res := serve()
+	if string(res["result"]) != `{"imported":7}` {
+		t.Errorf("Wrong result: %s", res["result"])
+	}
+	var jsonErr Error
+	if err := json.Unmarshal(res["error"], &jsonErr); err != nil {
+		t.Fatal(err)
+	}
+	if jsonErr.Code != E_SERVER || jsonErr.Message != "row 8 is invalid" {
+		t.Errorf("Wrong error: %+v", jsonErr)
+	}
+}
+
+func TestMethodFromPath(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMethodFromPath("/rpc/")
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/rpc/Service1.Multiply", strings.NewReader(`{"A": 4, "B": 2}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: got %v, want %v", res.Result, 8)
+	}
+
+	// Other paths are served as usual.
+	buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{3, 2})
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 6 {
+		t.Errorf("Wrong response: got %v, want %v", res.Result, 6)
+	}
+}
+
+func TestMethodHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMethodHeader("X-RPC-Method")
+
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`{"A": 4, "B": 3}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-RPC-Method", "Service1.Multiply")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res Service1Response
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 12 {
+		t.Errorf("Wrong response: got %v, want %v", res.Result, 12)
+	}
+
+	// Requests without the header are served as usual.
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{3, 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 6 {
+		t.Errorf("Wrong response: got %v, want %v", res.Result, 6)
+	}
+}
+
+func TestIDGenerator(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	s.SetIDGenerator(func() string {
+		n++
+		return fmt.Sprintf("gen-%d", n)
+	})
+
+	tests := []struct {
+		body     string
+		expected string
+	}{
+		// Notifications get a response with a generated id.
+		{`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}}`, `"gen-1"`},
+		// Client ids are kept.
+		{`{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": {"A": 4, "B": 2}, "id": 7}`, `7`},
+		{`{"jsonrpc": "2.0", "method": "Service1.Missing", "params": {"A": 4, "B": 2}}`, `"gen-2"`},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res struct {
+			Id json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Invalid response %q to %s: %v", w.Body, test.body, err)
+		}
+		if string(res.Id) != test.expected {
+			t.Errorf("Wrong id for %s: got %s, want %s", test.body, res.Id, test.expected)
+		}
+	}
+}
+
+// requiredValidator supports the "required" keyword of JSON Schema only,
+// standing in for a JSON Schema library.
+type requiredValidator struct {
+}
+
+type requiredSchema struct {
+	Required []string `json:"required"`
+}
+
+func (requiredValidator) Compile(schema []byte) (rpc.Schema, error) {
+	s := new(requiredSchema)
+	if err := json.Unmarshal(schema, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *requiredSchema) Validate(params []byte) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(params, &object); err != nil {
+		return err
+	}
+	for _, name := range s.Required {
+		if _, ok := object[name]; !ok {
+			return errors.New("missing required property " + name)
+		}
+	}
+	return nil
+}
+
+func TestMethodSchema(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service2), ""); err != nil {
+		t.Fatal(err)
+	}
+	schema := []byte(`{"type": "object", "required": ["Name"]}`)
+	if err := s.SetMethodSchema("Service2.Greet", schema); err == nil {
+		t.Error("Expected error setting a schema without a validator")
+	}
+	s.SetSchemaValidator(requiredValidator{})
+	if err := s.SetMethodSchema("Service2.Greet", schema); err != nil {
+		t.Fatal(err)
+	}
+
+	var res Service2Response
+	if err := execute(t, s, "Service2.Greet", map[string]string{"Name": "Gopher"}, &res); err != nil {
+		t.Error(err)
+	}
+
+	err := execute(t, s, "Service2.Greet", map[string]string{"Nickname": "Gopher"}, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to get an *Error, but got %T: %v", err, err)
+	} else if jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to get an E_BAD_PARAMS error (%d), but got %d", E_BAD_PARAMS, jsonRpcErr.Code)
+	} else if jsonRpcErr.Message != "missing required property Name" {
+		t.Errorf("Expected the violation in the message, but got %q", jsonRpcErr.Message)
+	}
+}
+
+type LookupRequest struct {
+	ID interface{}
+}
+
+type LookupService struct {
+}
+
+func (t *LookupService) Find(r *http.Request, req *LookupRequest, res *string) error {
+	*res = fmt.Sprintf("%T %v", req.ID, req.ID)
+	return nil
+}
+
+func TestUseNumber(t *testing.T) {
+	for _, useNumber := range []bool{false, true} {
+		codec := NewCodec()
+		codec.SetUseNumber(useNumber)
+		s := rpc.NewServer()
+		s.RegisterCodec(codec, "application/json")
+		if err := s.RegisterService(new(LookupService), ""); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := "float64 9.007199254740992e+15"
+		if useNumber {
+			expected = "json.Number 9007199254740993"
+		}
+		for _, params := range []string{`{"ID": 9007199254740993}`, `[9007199254740993]`} {
+			var res string
+			if err := executeRaw(t, s, map[string]interface{}{
+				"jsonrpc": "2.0",
+				"method":  "LookupService.Find",
+				"params":  json.RawMessage(params),
+				"id":      1,
+			}, &res); err != nil {
+				t.Fatal(err)
+			}
+			if res != expected {
+				t.Errorf("UseNumber %v, params %s: got %q, want %q", useNumber, params, res, expected)
+			}
+		}
+	}
+}
+
+type ProfileAddress struct {
+	StreetName string
+}
+
+type ProfileReply struct {
+	ProfileAddress
+	FieldName  string
+	UserID     int    `json:"user_id"`
+	Nickname   string `json:",omitempty"`
+	Secret     string `json:"-"`
+	Addresses  []ProfileAddress
+	Attributes map[string]ProfileAddress
+	UpdatedAt  time.Time
+}
+
+type ProfileService struct {
+}
+
+func (t *ProfileService) Get(r *http.Request, req *struct{}, res *ProfileReply) error {
+	*res = ProfileReply{
+		ProfileAddress: ProfileAddress{StreetName: "Main"},
+		FieldName:      "value",
+		UserID:         7,
+		Secret:         "hidden",
+		Addresses:      []ProfileAddress{{StreetName: "Side"}},
+		Attributes:     map[string]ProfileAddress{"Home": {StreetName: "Elm"}},
+		UpdatedAt:      time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	return nil
+}
+
+func TestCamelCaseReplies(t *testing.T) {
+	codec := NewCodec()
+	codec.SetCamelCaseReplies(true)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	if err := s.RegisterService(new(ProfileService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var res json.RawMessage
+	if err := execute(t, s, "ProfileService.Get", struct{}{}, &res); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"streetName":"Main","fieldName":"value","user_id":7,"addresses":[{"streetName":"Side"}],` +
+		`"attributes":{"Home":{"streetName":"Elm"}},"updatedAt":"2020-01-02T03:04:05Z"}`
+	if string(res) != expected {
+		t.Errorf("Wrong reply:\n got %s\nwant %s", res, expected)
+	}
+}
+
+func TestTimeFormat(t *testing.T) {
+	codec := NewCodec()
+	codec.SetTimeFormat("2006-01-02T15:04:05.000Z07:00")
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	if err := s.RegisterService(new(ProfileService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var res json.RawMessage
+	if err := execute(t, s, "ProfileService.Get", struct{}{}, &res); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"StreetName":"Main","FieldName":"value","user_id":7,"Addresses":[{"StreetName":"Side"}],` +
+		`"Attributes":{"Home":{"StreetName":"Elm"}},"UpdatedAt":"2020-01-02T03:04:05.000Z"}`
+	if string(res) != expected {
+		t.Errorf("Wrong reply:\n got %s\nwant %s", res, expected)
+	}
+
+	codec.SetCamelCaseReplies(true)
+	codec.SetTimeMarshaler(func(t time.Time) ([]byte, error) {
+		return json.Marshal(t.Unix())
+	})
+	if err := execute(t, s, "ProfileService.Get", struct{}{}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(res), `"updatedAt":1577934245}`) {
+		t.Errorf("Wrong reply with a time marshaler: %s", res)
+	}
+
+	codec.SetCamelCaseReplies(false)
+	codec.SetTimeFormat("")
+	if err := execute(t, s, "ProfileService.Get", struct{}{}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(string(res), `"UpdatedAt":"2020-01-02T03:04:05Z"}`) {
+		t.Errorf("Wrong reply with the default format: %s", res)
+	}
+}
+
+type CachedService struct {
+}
+
+const cachedReply = `{ "b": [1, 2],  "a": "x" }`
+
+func (t *CachedService) Get(r *http.Request, req *struct{}, res *json.RawMessage) error {
+	*res = json.RawMessage(cachedReply)
+	return nil
+}
+
+func TestRawMessageReply(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(CachedService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	buf, _ := EncodeClientRequest("CachedService.Get", struct{}{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var envelope struct {
+		Id uint64 `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Invalid response %q: %v", w.Body, err)
+	}
+	expected := fmt.Sprintf(`{"jsonrpc":"2.0","result":%s,"id":%d}`+"\n", cachedReply, envelope.Id)
+	if w.Body.String() != expected {
+		t.Errorf("Wrong response:\n got %q\nwant %q", w.Body, expected)
+	}
+}
+
+// brokenResponseWriter fails all the writes, as after a client disconnect.
+type brokenResponseWriter struct {
+	*ResponseRecorder
+}
+
+var errBrokenPipe = errors.New("write: broken pipe")
+
+func (w brokenResponseWriter) Write(p []byte) (int, error) {
+	return 0, errBrokenPipe
+}
+
+func TestWriteErrorHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	var methods []string
+	var errs []error
+	s.SetWriteErrorHandler(func(method string, err error) {
+		methods = append(methods, method)
+		errs = append(errs, err)
+	})
+
+	for _, broken := range []bool{false, true} {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		var w http.ResponseWriter = NewRecorder()
+		if broken {
+			w = brokenResponseWriter{NewRecorder()}
+		}
+		s.ServeHTTP(w, r)
+	}
+	if len(methods) != 1 || methods[0] != "Service1.Multiply" || errs[0] != errBrokenPipe {
+		t.Errorf("Write error handler was called with %q and %v, should be called once for the broken writer", methods, errs)
+	}
+}
+
+func TestRejectUnknownFields(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	req := map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "Service1.Multiply",
+		"params":  map[string]int{"A": 4, "B": 2, "C": 3},
+	}
+
+	var res Service1Response
+	if err := executeRaw(t, s, req, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 8 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+
+	s.SetRejectUnknownFields(true)
+	err := executeRaw(t, s, req, &res)
+	if jsonRpcErr, ok := err.(*Error); !ok {
+		t.Errorf("Expected to get an *Error, but got %T: %v", err, err)
+	} else if jsonRpcErr.Code != E_BAD_PARAMS {
+		t.Errorf("Expected to get an E_BAD_PARAMS error (%d), but got %d", E_BAD_PARAMS, jsonRpcErr.Code)
+	} else if want := `json: unknown field "C"`; jsonRpcErr.Message != want {
+		t.Errorf("Expected to get Message %q, but got %q", want, jsonRpcErr.Message)
+	}
+}
+
+type UploadService struct{}
+
+type UploadReply struct {
+	Size int64
+}
+
+func (s *UploadService) Ingest(r *http.Request, body io.Reader, reply *UploadReply) error {
+	n, err := io.Copy(io.Discard, body)
+	reply.Size = n
+	return err
+}
+
+func TestReaderArgs(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(UploadService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMethodFromPath("/rpc/")
+
+	// The body is streamed to the method as it is written.
+	const size = 64 << 20
+	pr, pw := io.Pipe()
+	go func() {
+		chunk := bytes.Repeat([]byte("x"), 1<<16)
+		for i := 0; i < size/len(chunk); i++ {
+			if _, err := pw.Write(chunk); err != nil {
+				return
+			}
+		}
+		pw.Close()
+	}()
+	r, _ := http.NewRequest("POST", "http://localhost:8080/rpc/UploadService.Ingest", pr)
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var res UploadReply
+	if err := DecodeClientResponse(w.Body, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Size != size {
+		t.Errorf("Wrong response: got %v, want %v", res.Size, size)
+	}
+
+	// The body can't be streamed if it holds the method.
+	buf, _ := EncodeClientRequest("UploadService.Ingest", nil)
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	if err := DecodeClientResponse(w.Body, &res); err == nil {
+		t.Error("Expected error calling the method from the body")
+	}
+}
+
+type TallyService struct {
+	totals []int
+}
+
+func (s *TallyService) Add(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A + req.B
+	s.totals = append(s.totals, res.Result)
+	return nil
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	service := new(TallyService)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var recording bytes.Buffer
+	s.StartRecording(&recording, func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte(`"B":2`), []byte(`"B":0`))
+	})
+	var res Service1Response
+	for _, req := range []*Service1Request{{1, 1}, {3, 2}, {5, 3}} {
+		if err := execute(t, s, "TallyService.Add", req, &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.StopRecording()
+	if err := execute(t, s, "TallyService.Add", &Service1Request{7, 7}, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	service.totals = nil
+	if err := s.Replay(&recording); err != nil {
+		t.Fatal(err)
+	}
+	// The redacted params are replayed.
+	if expected := []int{2, 3, 8}; fmt.Sprint(service.totals) != fmt.Sprint(expected) {
+		t.Errorf("Replayed calls got %v, should get %v.", service.totals, expected)
+	}
+
+	if err := s.Replay(strings.NewReader(`{"method": "TallyService.Add", "contentType": "text/plain"}`)); err == nil {
+		t.Error("Expected error replaying a call without codec")
+	}
+
+	// Large params are replayed, without being recorded again.
+	var large, again bytes.Buffer
+	s.StartRecording(&large, func(b []byte) []byte { return b })
+	big := map[string]interface{}{"A": 4, "B": 4, "Pad": strings.Repeat("x", 100<<10)}
+	if err := execute(t, s, "TallyService.Add", big, &res); err != nil {
+		t.Fatal(err)
+	}
+	s.StartRecording(&again, func(b []byte) []byte { return b })
+	service.totals = nil
+	if err := s.Replay(&large); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(service.totals) != "[8]" {
+		t.Errorf("Replayed large call got %v, should get [8].", service.totals)
+	}
+	if again.Len() != 0 {
+		t.Errorf("Recorded %d bytes while replaying, should record nothing.", again.Len())
+	}
+	s.StopRecording()
+
+	// Nothing is recorded without a redact function.
+	recording.Reset()
+	s.StartRecording(&recording, nil)
+	if err := execute(t, s, "TallyService.Add", &Service1Request{1, 1}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if recording.Len() != 0 {
+		t.Errorf("Recorded %q without a redact function, should record nothing.", recording.String())
+	}
+}
+
+func TestFallbackCodec(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterCodec(NewCodec(), "application/json-rpc")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(contentType string) *ResponseRecorder {
+		buf, _ := EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("text/plain"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Status was %d, should be 415 without fallback.", w.Code)
+	}
+
+	s.SetFallbackCodec(NewCodec())
+	for _, contentType := range []string{"text/plain", "", "application/x-odd; charset=utf-8"} {
+		w := serve(contentType)
+		var res Service1Response
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Errorf("Content-Type %q: %v", contentType, err)
+		} else if res.Result != 8 {
+			t.Errorf("Wrong response for Content-Type %q: %v.", contentType, res.Result)
+		}
+	}
+
+	s.SetStrictContentType(true)
+	if w := serve("text/plain"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("Status was %d, should be 415 in strict mode.", w.Code)
+	}
+}
+
+func TestGETNotifications(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	service := new(TallyService)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	query := url.Values{"method": {"TallyService.Add"}, "params": {`{"A": 1, "B": 2}`}}
+	serve := func(query url.Values) *ResponseRecorder {
+		r, _ := http.NewRequest("GET", "http://localhost:8080/?"+query.Encode(), nil)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(query); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Status was %d, should be 405 when disabled.", w.Code)
+	}
+
+	s.SetGETNotifications(true)
+	w := serve(query)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Response was %d %q, should be 204 without body.", w.Code, w.Body)
+	}
+	if fmt.Sprint(service.totals) != "[3]" {
+		t.Errorf("Method got %v, should run once with the params.", service.totals)
+	}
+
+	if w := serve(url.Values{"params": {"{}"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("Status was %d, should be 400 without method.", w.Code)
+	}
+}
+
+type ListService struct{}
+
+type ListItem struct {
+	ID   int
+	Name string
+}
+
+func (s *ListService) All(r *http.Request, req *Service1Request, res *StreamedArray) error {
+	i := 0
+	res.Next = func() (interface{}, bool) {
+		if i == req.A {
+			return nil, false
+		}
+		i++
+		return ListItem{ID: i - 1, Name: fmt.Sprint("item", i-1)}, true
+	}
+	return nil
+}
+
+func (s *ListService) Slice(r *http.Request, req *Service1Request, res *StreamedArray) error {
+	res.Elems = make([]ListItem, req.A)
+	return nil
+}
+
+// writeCountingRecorder counts the writes of the response body.
+type writeCountingRecorder struct {
+	*ResponseRecorder
+	writes int
+}
+
+func (w *writeCountingRecorder) Write(p []byte) (int, error) {
+	w.writes++
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestStreamedArray(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	if err := s.RegisterService(new(ListService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100000
+	buf, _ := EncodeClientRequest("ListService.All", &Service1Request{A: n})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := &writeCountingRecorder{ResponseRecorder: NewRecorder()}
+	s.ServeHTTP(w, r)
+	if w.writes < 2 {
+		t.Errorf("Response was written in %d writes, should be streamed.", w.writes)
+	}
+
+	var items []ListItem
+	if err := DecodeClientResponse(w.Body, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n || items[n-1] != (ListItem{ID: n - 1, Name: fmt.Sprint("item", n-1)}) {
+		t.Errorf("Got %d items, should get the %d items in order.", len(items), n)
+	}
+
+	// Empty arrays are written too.
+	if err := execute(t, s, "ListService.All", &Service1Request{A: 0}, &items); err != nil {
+		t.Fatal(err)
+	}
+	if items == nil || len(items) != 0 {
+		t.Errorf("Got %v, should get an empty array.", items)
+	}
+
+	// Slices are written element by element.
+	if err := execute(t, s, "ListService.Slice", &Service1Request{A: 3}, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Errorf("Got %v, should get the 3 elements of the slice.", items)
+	}
+}
@@ -6,10 +6,15 @@
 package json2
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
+	"reflect"
+	"time"
 
 	"github.com/gorilla/rpc/v2"
 )
@@ -72,6 +77,7 @@ func NewCustomCodec(encSel rpc.EncoderSelector) *Codec {
 // error as a param, replacing it by the value returned by this function. This function is intended
 // to decouple your service implementation from the codec itself, making possible to return abstract
 // errors in your service, and then mapping them here to the JSON-RPC error codes.
+// With rpc.Server.SetDispatchErrors, the errors are *rpc.DispatchError values.
 func NewCustomCodecWithErrorMapper(encSel rpc.EncoderSelector, errorMapper func(error) error) *Codec {
 	return &Codec{
 		encSel:      encSel,
@@ -79,6 +85,16 @@ func NewCustomCodecWithErrorMapper(encSel rpc.EncoderSelector, errorMapper func(
 	}
 }
 
+// NewCustomCodecWithRequestErrorMapper is like NewCustomCodecWithErrorMapper,
+// but the errorMapper function also receives the request, e.g. to localize
+// the error messages according to its Accept-Language header.
+func NewCustomCodecWithRequestErrorMapper(encSel rpc.EncoderSelector, errorMapper func(r *http.Request, err error) error) *Codec {
+	return &Codec{
+		encSel:             encSel,
+		requestErrorMapper: errorMapper,
+	}
+}
+
 // NewCodec returns a new JSON Codec.
 func NewCodec() *Codec {
 	return NewCustomCodec(rpc.DefaultEncoderSelector)
@@ -86,25 +102,144 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
-	encSel      rpc.EncoderSelector
-	errorMapper func(error) error
+	encSel             rpc.EncoderSelector
+	errorMapper        func(error) error
+	requestErrorMapper func(*http.Request, error) error
+	useNumber          bool
+	replies            replyEncoding
+}
+
+// SetUseNumber sets the codec to decode JSON numbers held by interface{}
+// values of the params as json.Number instead of float64, preserving the
+// precision of large integers.
+func (c *Codec) SetUseNumber(enabled bool) {
+	c.useNumber = enabled
+}
+
+// SetCamelCaseReplies sets the codec to lower case the first letter of the
+// names of the struct fields in replies, e.g. "fieldName" for FieldName,
+// unless their json tag sets an explicit name. Values implementing
+// json.Marshaler or encoding.TextMarshaler are encoded as usual.
+func (c *Codec) SetCamelCaseReplies(enabled bool) {
+	c.replies.camelCase = enabled
+}
+
+// SetTimeFormat sets the codec to encode the time.Time values of replies as
+// strings formatted with the given layout, e.g. "2006-01-02T15:04:05.000Z07:00"
+// for RFC 3339 with milliseconds, instead of time.RFC3339Nano. The error
+// data is encoded the same way. An empty layout restores the default.
+func (c *Codec) SetTimeFormat(layout string) {
+	if layout == "" {
+		c.SetTimeMarshaler(nil)
+		return
+	}
+	c.SetTimeMarshaler(func(t time.Time) ([]byte, error) {
+		return json.Marshal(t.Format(layout))
+	})
+}
+
+// SetTimeMarshaler sets the function encoding the time.Time values of
+// replies, and of the error data, to JSON. A nil function restores the
+// default encoding.
+func (c *Codec) SetTimeMarshaler(f func(t time.Time) ([]byte, error)) {
+	c.replies.marshalTime = f
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) rpc.CodecRequest {
-	return newCodecRequest(r, c.encSel.Select(r), c.errorMapper)
+	req := newCodecRequest(r, c.encSel.Select(r), c.errorMapperFor(r))
+	req.useNumber = c.useNumber
+	req.replies = c.replies
+	return req
+}
+
+// NewParamsRequest returns a CodecRequest for a request whose body holds
+// only the params of the given method. An empty body means no params. The
+// response is always written, with a null id.
+func (c *Codec) NewParamsRequest(r *http.Request, method string) rpc.CodecRequest {
+	req := newParamsCodecRequest(r, method, c.encSel.Select(r), c.errorMapperFor(r))
+	req.useNumber = c.useNumber
+	req.replies = c.replies
+	return req
+}
+
+// Warmup fills the encoding/json caches of the args and reply types of a
+// method, see rpc.Server.Warmup.
+func (c *Codec) Warmup(argsType, replyType reflect.Type) {
+	if argsType != nil {
+		json.Unmarshal([]byte("{}"), reflect.New(argsType).Interface())
+	}
+	if replyType != nil {
+		json.Marshal(reflect.New(replyType).Interface())
+	}
+}
+
+// errorMapperFor returns the function mapping the errors of the request r.
+func (c *Codec) errorMapperFor(r *http.Request) func(error) error {
+	if c.requestErrorMapper == nil {
+		return c.errorMapper
+	}
+	return func(err error) error {
+		return c.requestErrorMapper(r, err)
+	}
 }
 
 // ----------------------------------------------------------------------------
 // CodecRequest
 // ----------------------------------------------------------------------------
 
+// newParamsCodecRequest returns a new CodecRequest reading only the params
+// from the request body.
+func newParamsCodecRequest(r *http.Request, method string, encoder rpc.Encoder, errorMapper func(error) error) *CodecRequest {
+	null := json.RawMessage("null")
+	req := &serverRequest{
+		Version: Version,
+		Method:  method,
+		Id:      &null,
+	}
+
+	// Copy request body for decoding and access of underlying methods
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		err = &Error{
+			Code:    E_PARSE,
+			Message: err.Error(),
+			Data:    req,
+		}
+		return &CodecRequest{request: req, err: err, encoder: encoder, errorMapper: errorMapper}
+	}
+	// Close original body
+	r.Body.Close()
+
+	// Add close method to buffer and pass as request body
+	r.Body = io.NopCloser(bytes.NewBuffer(b))
+
+	if len(bytes.TrimSpace(b)) > 0 {
+		if !json.Valid(b) {
+			err = &Error{
+				Code:    E_PARSE,
+				Message: "invalid JSON params",
+				Data:    req,
+			}
+		}
+		params := json.RawMessage(b)
+		req.Params = &params
+	}
+	return &CodecRequest{request: req, err: err, encoder: encoder, errorMapper: errorMapper}
+}
+
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request, encoder rpc.Encoder, errorMapper func(error) error) rpc.CodecRequest {
+func newCodecRequest(r *http.Request, encoder rpc.Encoder, errorMapper func(error) error) *CodecRequest {
 	req := new(serverRequest)
 
+	// Batches are decoded call by call as the body is read, see Batch.
+	body := bufio.NewReader(r.Body)
+	if peekBatch(body) {
+		return &CodecRequest{request: req, batch: json.NewDecoder(body), encoder: encoder, errorMapper: errorMapper}
+	}
+
 	// Copy request body for decoding and access of underlying methods
-	b, err := io.ReadAll(r.Body)
+	b, err := io.ReadAll(body)
 	if err != nil {
 		err = &Error{
 			Code:    E_PARSE,
@@ -117,9 +252,27 @@ func newCodecRequest(r *http.Request, encoder rpc.Encoder, errorMapper func(erro
 	// Close original body
 	r.Body.Close()
 
+	// Add close method to buffer and pass as request body
+	r.Body = io.NopCloser(bytes.NewBuffer(b))
+
+	return parseCodecRequest(b, encoder, errorMapper)
+}
+
+// parseCodecRequest returns a new CodecRequest for a single call.
+func parseCodecRequest(b []byte, encoder rpc.Encoder, errorMapper func(error) error) *CodecRequest {
+	req := new(serverRequest)
+
 	// Decode the request body and check if RPC method is valid.
-	err = json.Unmarshal(b, req)
-	if err != nil {
+	err := json.Unmarshal(b, req)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		// Valid JSON, but not a request object, e.g. a batch element.
+		err = &Error{
+			Code:    E_INVALID_REQ,
+			Message: err.Error(),
+			Data:    req,
+		}
+	} else if err != nil {
 		err = &Error{
 			Code:    E_PARSE,
 			Message: err.Error(),
@@ -133,18 +286,108 @@ func newCodecRequest(r *http.Request, encoder rpc.Encoder, errorMapper func(erro
 		}
 	}
 
-	// Add close method to buffer and pass as request body
-	r.Body = io.NopCloser(bytes.NewBuffer(b))
-
 	return &CodecRequest{request: req, err: err, encoder: encoder, errorMapper: errorMapper}
 }
 
+// peekBatch returns true if the request body read by b is a JSON array,
+// skipping the leading whitespace.
+func peekBatch(b *bufio.Reader) bool {
+	for {
+		c, err := b.ReadByte()
+		if err != nil {
+			return false
+		}
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		b.UnreadByte()
+		return c == '['
+	}
+}
+
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
 	request     *serverRequest
+	batch       *json.Decoder
 	err         error
 	encoder     rpc.Encoder
 	errorMapper func(error) error
+	useNumber   bool
+	replies     replyEncoding
+	strict      bool
+}
+
+// Batch returns a CodecRequest for each call of a batch request.
+//
+// An empty batch, or one larger than maxSize when it is greater than zero,
+// is rejected as an invalid request. The calls are decoded one at a time as
+// the body is read, e.g. as it is decompressed, so that the body isn't held
+// in memory besides the calls, and a batch larger than maxSize is rejected
+// without reading the rest of it.
+func (c *CodecRequest) Batch(maxSize int) ([]rpc.CodecRequest, bool, error) {
+	if c.batch == nil {
+		return nil, false, nil
+	}
+	parseError := func(err error) error {
+		return &Error{
+			Code:    E_PARSE,
+			Message: err.Error(),
+		}
+	}
+	// Skip the opening bracket, checked by peekBatch.
+	if _, err := c.batch.Token(); err != nil {
+		return nil, true, parseError(err)
+	}
+	var calls []rpc.CodecRequest
+	for c.batch.More() {
+		if maxSize > 0 && len(calls) == maxSize {
+			return nil, true, &Error{
+				Code:    E_INVALID_REQ,
+				Message: fmt.Sprintf("batch exceeds the maximum of %d requests", maxSize),
+			}
+		}
+		var b json.RawMessage
+		if err := c.batch.Decode(&b); err != nil {
+			return nil, true, parseError(err)
+		}
+		// Responses are encoded once for the whole batch.
+		call := parseCodecRequest(b, rpc.DefaultEncoder, c.errorMapper)
+		call.useNumber = c.useNumber
+		call.replies = c.replies
+		calls = append(calls, call)
+	}
+	if _, err := c.batch.Token(); err != nil {
+		return nil, true, parseError(err)
+	}
+	if len(calls) == 0 {
+		return nil, true, &Error{
+			Code:    E_INVALID_REQ,
+			Message: "empty batch",
+		}
+	}
+	return calls, true, nil
+}
+
+// WriteBatchResponse encodes the responses of a batch as a JSON array and
+// writes it to the ResponseWriter. Nothing is written if all of the calls
+// were notifications.
+func (c *CodecRequest) WriteBatchResponse(w http.ResponseWriter, responses [][]byte) {
+	if len(responses) == 0 {
+		return
+	}
+	b := []byte{'['}
+	for i, res := range responses {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		b = append(b, bytes.TrimSpace(res)...)
+	}
+	b = append(b, ']', '\n')
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := c.encoder.Encode(w).Write(b); err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
 }
 
 // Method returns the RPC method for the current request.
@@ -157,6 +400,35 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// HasID returns true if the request carries an id. Requests created by
+// NewParamsRequest have none.
+func (c *CodecRequest) HasID() bool {
+	return c.request.Id != nil && string(*c.request.Id) != "null"
+}
+
+// SetID sets the id of the request, as a JSON string, so that a response is
+// written with it.
+func (c *CodecRequest) SetID(id string) {
+	b, err := json.Marshal(id)
+	if err != nil {
+		return
+	}
+	raw := json.RawMessage(b)
+	c.request.Id = &raw
+}
+
+// RawParams returns the undecoded params of the request, or null if there
+// are none.
+func (c *CodecRequest) RawParams() ([]byte, error) {
+	if c.err != nil {
+		return nil, c.err
+	}
+	if c.request.Params == nil {
+		return []byte("null"), nil
+	}
+	return *c.request.Params, nil
+}
+
 // ReadRequest fills the request object for the RPC method.
 //
 // ReadRequest parses request parameters in two supported forms in
@@ -170,17 +442,32 @@ func (c *CodecRequest) Method() (string, error) {
 // absence of expected names MAY result in an error being
 // generated. The names MUST match exactly, including
 // case, to the method's expected parameters.
+//
+// A by-position array holding a single object is decoded as the args
+// object itself. Any other by-position array is mapped onto the exported
+// fields of the args struct, in declaration order.
+//
+// Methods whose args are a *json.RawMessage receive a copy of the params
+// as-is, without decoding, e.g. to forward them.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if raw, ok := args.(*json.RawMessage); ok && c.err == nil {
+		if c.request.Params != nil {
+			*raw = append((*raw)[:0], *c.request.Params...)
+		}
+		return nil
+	}
 	if c.err == nil && c.request.Params != nil {
 		// Note: if c.request.Params is nil it's not an error, it's an optional member.
 		// JSON params structured object. Unmarshal to the args object.
-		if err := json.Unmarshal(*c.request.Params, args); err != nil {
+		if err := c.unmarshal(*c.request.Params, args); err != nil {
+			if rpc.IsUnknownFieldError(err) {
+				c.err = &rpc.InvalidParamsError{Err: err}
+				return c.err
+			}
 			// Clearly JSON params is not a structured object,
 			// fallback and attempt an unmarshal with JSON params as
-			// array value and RPC params is struct. Unmarshal into
-			// array containing the request struct.
-			params := [1]interface{}{args}
-			if err = json.Unmarshal(*c.request.Params, &params); err != nil {
+			// array value.
+			if err = c.readPositionalParams(*c.request.Params, args); err != nil {
 				c.err = &Error{
 					Code:    E_INVALID_REQ,
 					Message: err.Error(),
@@ -192,8 +479,87 @@ func (c *CodecRequest) ReadRequest(args interface{}) error {
 	return c.err
 }
 
+// DisallowUnknownFields makes ReadRequest reject params objects with fields
+// the args don't have, reporting them as invalid params.
+func (c *CodecRequest) DisallowUnknownFields() {
+	c.strict = true
+}
+
+// unmarshal decodes the JSON-encoded data into v, as configured by
+// Codec.SetUseNumber and DisallowUnknownFields.
+func (c *CodecRequest) unmarshal(data []byte, v interface{}) error {
+	if !c.useNumber && !c.strict {
+		return json.Unmarshal(data, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if c.useNumber {
+		dec.UseNumber()
+	}
+	if c.strict {
+		dec.DisallowUnknownFields()
+	}
+	return dec.Decode(v)
+}
+
+// readPositionalParams decodes a by-position params array into args.
+func (c *CodecRequest) readPositionalParams(raw json.RawMessage, args interface{}) error {
+	var params []json.RawMessage
+	if err := json.Unmarshal(raw, &params); err != nil {
+		return err
+	}
+	// RPC params is struct. Unmarshal into array containing the request
+	// struct.
+	if len(params) == 1 && bytes.HasPrefix(bytes.TrimSpace(params[0]), []byte("{")) {
+		return c.unmarshal(params[0], args)
+	}
+	v := reflect.ValueOf(args)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		single := [1]interface{}{args}
+		return c.unmarshal(raw, &single)
+	}
+	fields := positionalFields(v.Elem().Type())
+	if len(params) > len(fields) {
+		return fmt.Errorf("too many params: got %d, want at most %d", len(params), len(fields))
+	}
+	for i, param := range params {
+		field := v.Elem().Field(fields[i])
+		if err := c.unmarshal(param, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("param %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// positionalFields returns the indexes of the struct fields that by-position
+// params map onto: the exported fields not ignored by encoding/json, in
+// declaration order.
+func positionalFields(t reflect.Type) []int {
+	var fields []int
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" {
+			continue
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
 // WriteResponse encodes the response and writes it to the ResponseWriter.
+//
+// A *json.RawMessage reply, e.g. a cached one, is written verbatim as the
+// result, without being encoded again: it must hold valid JSON.
+// A *StreamedArray reply is streamed, see StreamedArray.
 func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	if raw, ok := reply.(*json.RawMessage); ok {
+		c.writeRawResponse(w, *raw)
+		return
+	}
+	if array, ok := reply.(*StreamedArray); ok {
+		c.writeStreamedArray(w, array)
+		return
+	}
+	reply = c.replies.encodable(reflect.ValueOf(reply))
 	res := &serverResponse{
 		Version: Version,
 		Result:  reply,
@@ -203,33 +569,92 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
 }
 
 func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	res := &serverResponse{
+		Version: Version,
+		Error:   c.jsonError(err),
+		Id:      c.request.Id,
+	}
+	c.writeServerResponse(w, res)
+}
+
+// WriteErrorWithReply writes err as WriteError does, with reply as the
+// result, see rpc.Server.SetIncludeReplyOnError.
+func (c *CodecRequest) WriteErrorWithReply(w http.ResponseWriter, status int, err error, reply interface{}) {
+	if reply != nil {
+		reply = c.replies.encodable(reflect.ValueOf(reply))
+	}
+	res := &serverResponse{
+		Version: Version,
+		Result:  reply,
+		Error:   c.jsonError(err),
+		Id:      c.request.Id,
+	}
+	c.writeServerResponse(w, res)
+}
+
+// jsonError returns the JSON-RPC error written for err.
+func (c *CodecRequest) jsonError(err error) *Error {
 	err = c.tryToMapIfNotAnErrorAlready(err)
-	jsonErr, ok := err.(*Error)
-	if !ok {
+	var jsonErr *Error
+	switch e := err.(type) {
+	case *Error:
+		jsonErr = e
+	case *rpc.InvalidParamsError:
+		jsonErr = &Error{
+			Code:    E_BAD_PARAMS,
+			Message: e.Err.Error(),
+		}
+	case *rpc.Error:
+		jsonErr = &Error{
+			Code:    ErrorCode(e.Code),
+			Message: e.Message,
+			Data:    e.Data,
+		}
+	default:
 		jsonErr = &Error{
 			Code:    E_SERVER,
 			Message: err.Error(),
 		}
 	}
-	res := &serverResponse{
-		Version: Version,
-		Error:   jsonErr,
-		Id:      c.request.Id,
+	if jsonErr.Data != nil {
+		// Copy the error rather than modifying the one returned by the method.
+		withData := *jsonErr
+		withData.Data = c.encodeErrorData(jsonErr.Data)
+		jsonErr = &withData
 	}
-	c.writeServerResponse(w, res)
+	return jsonErr
+}
+
+// encodeErrorData returns the data of an error encoded as replies are, or its
+// string representation if it can't be encoded, so that the error is still
+// written.
+func (c *CodecRequest) encodeErrorData(data interface{}) interface{} {
+	b, err := json.Marshal(c.replies.encodable(reflect.ValueOf(data)))
+	if err != nil {
+		return fmt.Sprintf("%+v", data)
+	}
+	return json.RawMessage(b)
 }
 
 func (c CodecRequest) tryToMapIfNotAnErrorAlready(err error) error {
-	if _, ok := err.(*Error); ok || c.errorMapper == nil {
+	inner := err
+	if dispatchErr, ok := err.(*rpc.DispatchError); ok {
+		inner = dispatchErr.Err
+	}
+	switch inner.(type) {
+	case *Error, *rpc.InvalidParamsError, *rpc.Error:
+		return inner
+	}
+	if c.errorMapper == nil {
 		return err
 	}
 	return c.errorMapper(err)
 }
 
 func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
-	// Id is null for notifications and they don't have a response, unless we couldn't even parse the JSON, in that
-	// case we can't know whether it was intended to be a notification
-	if c.request.Id != nil || isParseErrorResponse(res) {
+	// Id is null for notifications and they don't have a response, unless we couldn't even parse the JSON or the
+	// request object, in that case we can't know whether it was intended to be a notification
+	if c.request.Id != nil || c.batch != nil || isUnreadableRequestResponse(res) {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
 		encoder := json.NewEncoder(c.encoder.Encode(w))
 		err := encoder.Encode(res)
@@ -241,8 +666,33 @@ func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverRes
 	}
 }
 
-func isParseErrorResponse(res *serverResponse) bool {
-	return res != nil && res.Error != nil && res.Error.Code == E_PARSE
+// writeRawResponse writes a response with the given result, as is.
+func (c *CodecRequest) writeRawResponse(w http.ResponseWriter, result json.RawMessage) {
+	if c.request.Id == nil && c.batch == nil {
+		return
+	}
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	id, err := json.Marshal(c.request.Id)
+	if err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	b := make([]byte, 0, len(result)+len(id)+40)
+	b = append(b, `{"jsonrpc":"`+Version+`","result":`...)
+	b = append(b, result...)
+	b = append(b, `,"id":`...)
+	b = append(b, id...)
+	b = append(b, '}', '\n')
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if _, err := c.encoder.Encode(w).Write(b); err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func isUnreadableRequestResponse(res *serverResponse) bool {
+	return res != nil && res.Error != nil && (res.Error.Code == E_PARSE || res.Error.Code == E_INVALID_REQ)
 }
 
 type EmptyResponse struct {
@@ -0,0 +1,123 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/gorilla/rpc/v2"
+)
+
+// StreamedArray is a reply written as a JSON array encoded element by
+// element, instead of being encoded as a whole, to reduce the memory used by
+// large replies. Methods taking a *StreamedArray reply set Next to a
+// function producing the elements while they are written, so that the array
+// is never held in memory, or Elems to a slice holding them.
+//
+// The response is streamed, chunked by the http.ResponseWriter, unless it is
+// compressed by the encoder of the codec. Since the status is sent before
+// the elements are encoded, an element failing to encode truncates the
+// response.
+type StreamedArray struct {
+	// Next returns the next element, and false once there are no more. It
+	// is called after the method returned, while the response is written.
+	Next func() (interface{}, bool)
+	// Elems is the slice or array to write when Next is nil.
+	Elems interface{}
+}
+
+// elements returns an iterator over the elements of the array, or an error
+// if Elems isn't a slice or an array.
+func (a *StreamedArray) elements() (func() (reflect.Value, bool), error) {
+	if a.Next != nil {
+		return func() (reflect.Value, bool) {
+			elem, ok := a.Next()
+			return reflect.ValueOf(elem), ok
+		}, nil
+	}
+	elems := reflect.ValueOf(a.Elems)
+	if elems.Kind() != reflect.Slice && elems.Kind() != reflect.Array {
+		return nil, fmt.Errorf("json2: streamed array of %T", a.Elems)
+	}
+	i := 0
+	return func() (reflect.Value, bool) {
+		if i == elems.Len() {
+			return reflect.Value{}, false
+		}
+		i++
+		return elems.Index(i - 1), true
+	}, nil
+}
+
+// writeStreamedArray writes a response whose result is the streamed array.
+func (c *CodecRequest) writeStreamedArray(w http.ResponseWriter, reply *StreamedArray) {
+	if c.request.Id == nil && c.batch == nil {
+		return
+	}
+	next, err := reply.elements()
+	if err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if c.encoder != rpc.Encoder(rpc.DefaultEncoder) {
+		// Encoders like gzip must be written at once.
+		var buf bytes.Buffer
+		if err := c.writeArray(&buf, next); err != nil {
+			rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.writeRawResponse(w, buf.Bytes())
+		return
+	}
+	id, err := json.Marshal(c.request.Id)
+	if err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"jsonrpc":"` + Version + `","result":`)
+	if err := c.writeArray(bw, next); err != nil {
+		return
+	}
+	bw.WriteString(`,"id":`)
+	bw.Write(id)
+	bw.WriteString("}\n")
+	bw.Flush()
+}
+
+// writeArray writes the elements returned by next to out as a JSON array,
+// one at a time.
+func (c *CodecRequest) writeArray(out io.Writer, next func() (reflect.Value, bool)) error {
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		elem, ok := next()
+		if !ok {
+			break
+		}
+		if i > 0 {
+			if _, err := io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		b, err := json.Marshal(c.replies.encodable(elem))
+		if err != nil {
+			return err
+		}
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(out, "]")
+	return err
+}
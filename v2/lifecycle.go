@@ -0,0 +1,93 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// Initializer is implemented by service receivers holding resources to set
+// up when they are registered, e.g. a pool of connections. Receivers
+// releasing resources implement io.Closer. See RegisterService and
+// SwapReceiver.
+type Initializer interface {
+	Init() error
+}
+
+// isLifecycleMethod returns true if method is the Init method of an
+// Initializer or the Close method of an io.Closer, which aren't RPC methods.
+func isLifecycleMethod(method reflect.Method) bool {
+	if method.Name != "Init" && method.Name != "Close" {
+		return false
+	}
+	// The receiver is the first argument.
+	mtype := method.Type
+	return mtype.NumIn() == 1 && mtype.NumOut() == 1 && mtype.Out(0) == typeOfError
+}
+
+// initReceiver calls the Init method of rcvr, if it is an Initializer.
+func initReceiver(rcvr interface{}) error {
+	if initializer, ok := rcvr.(Initializer); ok {
+		if err := initializer.Init(); err != nil {
+			return fmt.Errorf("rpc: init: %w", err)
+		}
+	}
+	return nil
+}
+
+// closeService calls the Close method of the receivers of s, if they are
+// io.Closers. The receivers of services registered with a factory are left
+// alone.
+func closeService(s *service) error {
+	if s.factory != nil {
+		return nil
+	}
+	if s.replicas != nil {
+		return closeReceivers(s.replicas.rcvrs)
+	}
+	return closeReceivers([]reflect.Value{s.rcvr})
+}
+
+// closeReceivers calls the Close method of each of rcvrs that is an
+// io.Closer, returning their joined errors.
+func closeReceivers(rcvrs []reflect.Value) error {
+	var errs []error
+	for _, rcvr := range rcvrs {
+		if !rcvr.IsValid() {
+			continue
+		}
+		if closer, ok := rcvr.Interface().(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown removes all the registered services as UnregisterService does,
+// calling the Close method of their receivers. The returned error joins the
+// errors of the Close methods failing, in the order of the service names.
+// Unlike Reset, the registered functions and the settings of the server are
+// kept.
+//
+// Shutdown must not be called while the server is serving requests.
+func (s *Server) Shutdown() error {
+	services := s.services.removeAll()
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].name < services[j].name
+	})
+	var errs []error
+	for _, service := range services {
+		if err := closeService(service); err != nil {
+			errs = append(errs, fmt.Errorf("rpc: closing service %q: %w", service.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,87 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+)
+
+// SetBodyLogging sets whether the server writes the body of every request
+// and response to the configured logger. If redact is not nil, the bodies
+// are passed through it before being logged, e.g. to strip secrets; the
+// request body is buffered so that the codec still reads the original one.
+//
+// Response bodies are logged as written, after any compression done by the
+// codec encoder.
+func (s *Server) SetBodyLogging(enabled bool, redact func([]byte) []byte) {
+	s.bodyLogging = enabled
+	s.bodyRedactor = redact
+}
+
+// SetResponseTap sets a function receiving a copy of the response body of
+// every call, e.g. to audit them, along with the requested method. The body
+// is captured as written to the client, without encoding the reply again.
+// The method is empty if the codec failed to read it.
+//
+// The calls of a batch are tapped separately, with the encoding of each
+// call before they are joined in the batch response.
+func (s *Server) SetResponseTap(f func(method string, body []byte)) {
+	s.responseTap = f
+}
+
+// logRequestBody logs the body of r, restoring it for the codec.
+func (s *Server) logRequestBody(r *http.Request) {
+	var body []byte
+	if r.Body != nil {
+		b, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			s.logf("rpc: can't read request body: %v", err)
+		}
+		body = b
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	s.logf("rpc: request body: %s", s.redactBody(body))
+}
+
+// logResponseBody logs the body written to w.
+func (s *Server) logResponseBody(w *teeResponseWriter) {
+	s.logf("rpc: response body: %s", s.redactBody(w.body.Bytes()))
+}
+
+func (s *Server) redactBody(body []byte) []byte {
+	if s.bodyRedactor == nil {
+		return body
+	}
+	return s.bodyRedactor(append([]byte(nil), body...))
+}
+
+// teeResponseWriter is an http.ResponseWriter keeping a copy of the response
+// body written to the underlying ResponseWriter.
+type teeResponseWriter struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *teeResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.body.Write(p[:n])
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it supports it, for
+// streaming methods.
+func (w *teeResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *teeResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
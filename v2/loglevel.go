@@ -0,0 +1,56 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"strings"
+)
+
+// LogLevelHeader is the header clients set to raise the logging verbosity
+// of their request, see SetMaxRequestLogLevel.
+const LogLevelHeader = "X-RPC-Log-Level"
+
+// LogLevel is the logging verbosity of a request.
+type LogLevel int
+
+const (
+	// LogLevelDefault logs what the server is configured to log.
+	LogLevelDefault LogLevel = iota
+	// LogLevelDebug also logs the request and response bodies, as
+	// SetBodyLogging does. It is requested with "debug".
+	LogLevelDebug
+	// LogLevelTrace also logs the time spent in each phase of the calls, as
+	// SetTraceTimings does. It is requested with "trace".
+	LogLevelTrace
+)
+
+// logLevels maps the values of the LogLevelHeader to their level.
+var logLevels = map[string]LogLevel{
+	"debug": LogLevelDebug,
+	"trace": LogLevelTrace,
+}
+
+// SetMaxRequestLogLevel sets the highest logging level requests can ask for
+// with the LogLevelHeader, so that a single client can be debugged through
+// the configured logger without raising the verbosity of the other
+// requests. Higher levels are clamped to max, and unknown values are
+// ignored. The default is LogLevelDefault, the header being ignored.
+func (s *Server) SetMaxRequestLogLevel(max LogLevel) {
+	s.maxLogLevel = max
+}
+
+// requestLogLevel returns the logging level requested by r, clamped to the
+// maximum level.
+func (s *Server) requestLogLevel(r *http.Request) LogLevel {
+	if s.maxLogLevel == LogLevelDefault {
+		return LogLevelDefault
+	}
+	level := logLevels[strings.ToLower(strings.TrimSpace(r.Header.Get(LogLevelHeader)))]
+	if level > s.maxLogLevel {
+		level = s.maxLogLevel
+	}
+	return level
+}
@@ -6,11 +6,17 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -19,6 +25,12 @@ var (
 	// Precompute the reflect.Type of error and http.Request
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	// and of http.ResponseWriter, taken by streaming methods
+	typeOfResponseWriter = reflect.TypeOf((*http.ResponseWriter)(nil)).Elem()
+	// and of context.Context, taken instead of *http.Request
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+	// and of io.Reader, taken instead of *args by methods reading the body
+	typeOfReader = reflect.TypeOf((*io.Reader)(nil)).Elem()
 )
 
 // ----------------------------------------------------------------------------
@@ -26,16 +38,69 @@ var (
 // ----------------------------------------------------------------------------
 
 type service struct {
-	name     string                    // name of service
-	rcvr     reflect.Value             // receiver of methods for the service
-	rcvrType reflect.Type              // type of the receiver
-	methods  map[string]*serviceMethod // registered methods
+	name     string                          // name of service
+	rcvr     reflect.Value                   // receiver of methods for the service
+	rcvrType reflect.Type                    // type of the receiver
+	methods  map[string]*serviceMethod       // registered methods
+	factory  func(*http.Request) interface{} // returns the receiver of each request, if set
+	versions *versionRange                   // accepted API versions, any if nil
+	replicas *replicaSet                     // receivers the calls are spread across, if set
 }
 
 type serviceMethod struct {
-	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	method      reflect.Method // receiver method
+	argsType    reflect.Type   // type of the request argument, io.Reader for methods reading the body
+	replyType   reflect.Type   // type of the response argument, nil for streaming methods
+	streaming   bool           // writes the response itself to an http.ResponseWriter
+	withContext bool           // takes the request context instead of the request
+	readsBody   bool           // takes the request body as an io.Reader instead of the args
+	forwarded   bool           // has no receiver method, calls are forwarded
+	info        MethodInfo     // description of the method
+
+	retryAttempts int             // calls made while the method fails with temporary errors
+	retryBackoff  time.Duration   // wait between retries
+	timeout       time.Duration   // maximum execution time, overriding service timeouts
+	disabled      atomic.Bool     // hides the method from get without unregistering it
+	schema        Schema          // validates the raw params
+	coalesce      *coalesceGroup  // running calls, if identical calls are coalesced
+	contentTypes  []string        // accepted media types, any if empty
+	breaker       *circuitBreaker // fails calls fast after too many failures, if set
+	binder        ArgBinder       // binds args from other sources than the params, if set
+	panicStatus   int             // status of the response to a panic, 500 if zero
+	maxBodyBytes  int64           // body size limit, overriding the server limit if not zero
+	transforms    transformChain  // map the replies before they are written
+	canary        *canaryRoute    // routes a fraction of the calls elsewhere, if set
+	example       *Example        // first successful call, if examples are captured
+	cache         *methodCache    // replies of the latest calls, if cached
+	argsPool      *sync.Pool      // reused args, if pooled
+	capability    string          // required from clients to expose the method, if set
+}
+
+// describe returns the description of the method, with its example.
+//
+// The caller must hold the mutex of the service map.
+func (m *serviceMethod) describe() MethodInfo {
+	info := m.info
+	info.Example = m.example
+	return info
+}
+
+// acceptsContentType returns true if the method accepts requests with the
+// given Content-Type.
+func (m *serviceMethod) acceptsContentType(contentType string) bool {
+	if len(m.contentTypes) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, accepted := range m.contentTypes {
+		if mediaType == accepted {
+			return true
+		}
+	}
+	return false
 }
 
 // ----------------------------------------------------------------------------
@@ -46,10 +111,77 @@ type serviceMethod struct {
 type serviceMap struct {
 	mutex    sync.Mutex
 	services map[string]*service
+
+	// strictNamespace rejects services colliding with the methods of
+	// other services instead of warning about them through warnf.
+	strictNamespace bool
+	warnf           func(format string, v ...interface{})
+
+	// nameTransform maps the names of the receiver methods to the names
+	// they are registered with.
+	nameTransform func(string) string
+
+	// methodFilter excludes the receiver methods it returns false for
+	// from registration.
+	methodFilter func(goName string, m reflect.Method) bool
+
+	// stripPrefix is trimmed from requested methods before resolving them.
+	stripPrefix string
+
+	// defaultService is the service of methods requested without one.
+	defaultService string
+
+	// delimiter separates the parts of service and method names, "." if
+	// empty.
+	delimiter string
+
+	// lenient trims surrounding whitespace and a trailing delimiter from
+	// requested methods before resolving them.
+	lenient bool
+
+	// timeouts holds the maximum execution time of the methods of the
+	// services under each path of the service tree.
+	timeouts map[string]time.Duration
 }
 
 // register adds a new service using reflection to extract its methods.
 func (m *serviceMap) register(rcvr interface{}, name string) error {
+	s, err := m.newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	if err := initReceiver(rcvr); err != nil {
+		return err
+	}
+	if err := m.add(s); err != nil {
+		// Release what Init set up for the rejected service.
+		closeService(s)
+		return err
+	}
+	return nil
+}
+
+// registerFactory adds a new service whose receiver is returned by factory
+// for each request, extracting its methods from a sample receiver.
+func (m *serviceMap) registerFactory(factory func(*http.Request) interface{}, name string) error {
+	sample, err := http.NewRequest(http.MethodPost, "/", http.NoBody)
+	if err != nil {
+		return err
+	}
+	rcvr := factory(sample)
+	if rcvr == nil {
+		return fmt.Errorf("rpc: factory of service %q returned nil", name)
+	}
+	s, err := m.newService(rcvr, name)
+	if err != nil {
+		return err
+	}
+	s.factory = factory
+	return m.add(s)
+}
+
+// newService returns a new service using reflection to extract its methods.
+func (m *serviceMap) newService(rcvr interface{}, name string) (*service, error) {
 	// Setup service.
 	s := &service{
 		name:     name,
@@ -60,58 +192,105 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
 		if !isExported(s.name) {
-			return fmt.Errorf("rpc: type %q is not exported", s.name)
+			return nil, fmt.Errorf("rpc: type %q is not exported", s.name)
 		}
 	}
 	if s.name == "" {
-		return fmt.Errorf("rpc: no service name for type %q",
+		return nil, fmt.Errorf("rpc: no service name for type %q",
 			s.rcvrType.String())
 	}
-	// Setup methods.
+	for _, part := range strings.Split(s.name, m.sep()) {
+		if part == "" {
+			return nil, fmt.Errorf("rpc: invalid service name %q", s.name)
+		}
+	}
+	// Setup methods. reflect lists them sorted by name, so that they are
+	// registered in the same order.
 	for i := 0; i < s.rcvrType.NumMethod(); i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
-		// Method must be exported.
-		if method.PkgPath != "" {
-			continue
-		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
-			continue
-		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-			continue
-		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
-		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
-			continue
-		}
-		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
-		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
+		methodSpec, reason := newServiceMethod(method)
+		if reason != "" {
 			continue
 		}
-		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
+		if m.methodFilter != nil && !m.methodFilter(method.Name, method) {
 			continue
 		}
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			continue
+		name := method.Name
+		if m.nameTransform != nil {
+			name = m.nameTransform(name)
+			if name == "" || strings.Contains(name, m.sep()) {
+				return nil, fmt.Errorf("rpc: invalid name %q for method %q of %q", name, method.Name, s.name)
+			}
 		}
-		s.methods[method.Name] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+		if other, ok := s.methods[name]; ok {
+			return nil, fmt.Errorf("rpc: methods %q and %q of %q have the same name %q",
+				other.method.Name, method.Name, s.name, name)
 		}
+		methodSpec.info = newMethodInfo(s.name+m.sep()+name, methodSpec)
+		s.methods[name] = methodSpec
 	}
 	if len(s.methods) == 0 {
-		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
+		return nil, fmt.Errorf("rpc: %q has no exported methods of suitable type",
 			s.name)
 	}
-	// Add to the map.
+	return s, nil
+}
+
+// newServiceMethod returns the spec of a receiver method, or the reason why
+// the method can't be registered.
+func newServiceMethod(method reflect.Method) (*serviceMethod, string) {
+	mtype := method.Type
+	// Method must be exported.
+	if method.PkgPath != "" {
+		return nil, "not exported"
+	}
+	// Method needs four ins: receiver, *http.Request, *args, *reply.
+	if mtype.NumIn() != 4 {
+		return nil, fmt.Sprintf("takes %d arguments instead of 3: the request, the args and the reply", mtype.NumIn()-1)
+	}
+	// First argument must be a pointer and must be http.Request, or
+	// a context.Context.
+	reqType := mtype.In(1)
+	withContext := reqType == typeOfContext
+	if !withContext && (reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest) {
+		return nil, fmt.Sprintf("first argument is %v instead of *http.Request or context.Context", reqType)
+	}
+	// Second argument must be a pointer and must be exported, or an
+	// io.Reader for methods reading the request body.
+	args := mtype.In(2)
+	readsBody := args == typeOfReader
+	if !readsBody && (args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args)) {
+		return nil, fmt.Sprintf("args %v are not a pointer to an exported type nor an io.Reader", args)
+	}
+	// Third argument must be a pointer and must be exported, or an
+	// http.ResponseWriter for streaming methods.
+	reply := mtype.In(3)
+	streaming := reply == typeOfResponseWriter
+	if !streaming && (reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply)) {
+		return nil, fmt.Sprintf("reply %v is not a pointer to an exported type nor an http.ResponseWriter", reply)
+	}
+	// Method needs one out: error.
+	if mtype.NumOut() != 1 || mtype.Out(0) != typeOfError {
+		return nil, "doesn't return a single error"
+	}
+	methodSpec := &serviceMethod{
+		method:      method,
+		argsType:    args,
+		streaming:   streaming,
+		withContext: withContext,
+		readsBody:   readsBody,
+	}
+	if !readsBody {
+		methodSpec.argsType = args.Elem()
+	}
+	if !streaming {
+		methodSpec.replyType = reply.Elem()
+	}
+	return methodSpec, ""
+}
+
+// add adds the service s to the map.
+func (m *serviceMap) add(s *service) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	if m.services == nil {
@@ -119,27 +298,202 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 	} else if _, ok := m.services[s.name]; ok {
 		return fmt.Errorf("rpc: service already defined: %q", s.name)
 	}
+	if collisions := m.namespaceCollisions(s); len(collisions) > 0 {
+		if m.strictNamespace {
+			return fmt.Errorf("rpc: %s", strings.Join(collisions, "; "))
+		}
+		if m.warnf != nil {
+			for _, collision := range collisions {
+				m.warnf("rpc: warning: %s", collision)
+			}
+		}
+	}
 	m.services[s.name] = s
 	return nil
 }
 
-// get returns a registered service given a method name.
+// updateMethods replaces the registered service s with a copy whose methods
+// are changed by update. The methods of a registered service are read
+// without holding the mutex, so they are copied on write instead of being
+// changed in place.
 //
-// The method name uses a dotted notation as in "Service.Method".
+// The caller must hold the mutex.
+func (m *serviceMap) updateMethods(s *service, update func(methods map[string]*serviceMethod)) *service {
+	updated := *s
+	updated.methods = make(map[string]*serviceMethod, len(s.methods)+1)
+	for name, method := range s.methods {
+		updated.methods[name] = method
+	}
+	update(updated.methods)
+	m.services[s.name] = &updated
+	return &updated
+}
+
+// unregister removes the service with the given name, closing its receiver
+// once the mutex is released.
+func (m *serviceMap) unregister(name string) error {
+	m.mutex.Lock()
+	s, ok := m.services[name]
+	delete(m.services, name)
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("rpc: can't find service %q", name)
+	}
+	return closeService(s)
+}
+
+// removeAll removes all the services, returning them.
+func (m *serviceMap) removeAll() []*service {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	services := make([]*service, 0, len(m.services))
+	for _, s := range m.services {
+		services = append(services, s)
+	}
+	m.services = nil
+	return services
+}
+
+// swapReceiver replaces the receiver of the service with the given name,
+// keeping its methods and their settings. The new receiver is initialized
+// before replacing the old one, which is closed afterwards.
+func (m *serviceMap) swapReceiver(name string, rcvr interface{}) error {
+	m.mutex.Lock()
+	_, err := m.swappable(name, rcvr)
+	m.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := initReceiver(rcvr); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	s, err := m.swappable(name, rcvr)
+	var old reflect.Value
+	if err == nil {
+		old, s.rcvr = s.rcvr, reflect.ValueOf(rcvr)
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		// The service changed while the receiver was initialized.
+		closeReceivers([]reflect.Value{reflect.ValueOf(rcvr)})
+		return err
+	}
+	return closeReceivers([]reflect.Value{old})
+}
+
+// swappable returns the service with the given name, if its receiver can be
+// replaced by rcvr. The caller must hold the mutex.
+func (m *serviceMap) swappable(name string, rcvr interface{}) (*service, error) {
+	s, ok := m.services[name]
+	if !ok {
+		return nil, fmt.Errorf("rpc: can't find service %q", name)
+	}
+	if s.factory != nil || s.replicas != nil || !s.rcvr.IsValid() {
+		return nil, fmt.Errorf("rpc: service %q has no receiver to swap", name)
+	}
+	if t := reflect.TypeOf(rcvr); t != s.rcvrType {
+		return nil, fmt.Errorf("rpc: receiver of service %q must be %v, got %v", name, s.rcvrType, t)
+	}
+	return s, nil
+}
+
+// receiver returns the receiver of the call r to method of the service s and
+// the function to call on it: the canary of the method if the call is routed
+// to it, otherwise a replica or the receiver of the service. The canary
+// result is true for a canary, the receiver of services registered with a
+// factory being only replaced by the factory otherwise.
+func (m *serviceMap) receiver(s *service, method *serviceMethod, r *http.Request) (rcvr, fn reflect.Value, canary bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if route := method.canary; route != nil && route.pick(r) {
+		return route.rcvr, route.fn, true
+	}
+	if s.replicas != nil {
+		return s.replicas.pick(), method.method.Func, false
+	}
+	return s.rcvr, method.method.Func, false
+}
+
+// reset removes all the registered services and their settings.
+func (m *serviceMap) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.services = nil
+	m.timeouts = nil
+}
+
+// namespaceCollisions describes the names of the new service s clashing
+// with the methods of registered services, e.g. the method "B" of service
+// "A" and the service "A.B": "A.B" calls the method, while "A.B.C" calls the
+// service method "C".
+//
+// The caller must hold the mutex.
+func (m *serviceMap) namespaceCollisions(s *service) []string {
+	var collisions []string
+	for _, name := range sortedKeys(s.methods) {
+		if _, ok := m.services[s.name+m.sep()+name]; ok {
+			collisions = append(collisions, fmt.Sprintf(
+				"method %q of service %q collides with service %q", name, s.name, s.name+m.sep()+name))
+		}
+	}
+	if parentName, name, ok := m.split(s.name); ok {
+		if parent := m.services[parentName]; parent != nil {
+			if _, ok := parent.methods[name]; ok {
+				collisions = append(collisions, fmt.Sprintf(
+					"service %q collides with method %q of service %q", s.name, name, parent.name))
+			}
+		}
+	}
+	return collisions
+}
+
+// get returns a registered and enabled service method given a method name.
+//
+// The method name is resolved as in lookup.
 func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
-	parts := strings.Split(method, ".")
-	if len(parts) != 2 {
+	service, serviceMethod, err := m.lookup(method)
+	if err != nil {
+		return nil, nil, err
+	}
+	if serviceMethod.disabled.Load() {
+		err := fmt.Errorf("rpc: can't find method %q", method)
+		return nil, nil, err
+	}
+	return service, serviceMethod, nil
+}
+
+// lookup returns a registered service given a method name.
+//
+// The method name uses a dotted notation as in "Service.Method". Service
+// names can be dotted too, the method being the last part, as in
+// "Parent.Service.Method". The configured prefix is trimmed from the method
+// name first. If a default service is set, a method name without dots is
+// then looked up in that service. In lenient mode, surrounding whitespace
+// and a single trailing delimiter are trimmed before anything else.
+func (m *serviceMap) lookup(method string) (*service, *serviceMethod, error) {
+	if m.lenient {
+		method = strings.TrimSuffix(strings.TrimSpace(method), m.sep())
+	}
+	if m.stripPrefix != "" {
+		method = strings.TrimPrefix(method, m.stripPrefix)
+	}
+	if m.defaultService != "" && !strings.Contains(method, m.sep()) {
+		method = m.defaultService + m.sep() + method
+	}
+	serviceName, methodName, ok := m.split(method)
+	if !ok {
 		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
 		return nil, nil, err
 	}
 	m.mutex.Lock()
-	service := m.services[parts[0]]
+	service := m.services[serviceName]
 	m.mutex.Unlock()
 	if service == nil {
 		err := fmt.Errorf("rpc: can't find service %q", method)
 		return nil, nil, err
 	}
-	serviceMethod := service.methods[parts[1]]
+	serviceMethod := service.methods[methodName]
 	if serviceMethod == nil {
 		err := fmt.Errorf("rpc: can't find method %q", method)
 		return nil, nil, err
@@ -147,6 +501,114 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 	return service, serviceMethod, nil
 }
 
+// serviceMethods describes the enabled methods of the service with the
+// given name.
+func (m *serviceMap) serviceMethods(name string) (map[string]MethodInfo, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s, ok := m.services[name]
+	if !ok {
+		return nil, fmt.Errorf("rpc: can't find service %q", name)
+	}
+	methods := make(map[string]MethodInfo, len(s.methods))
+	for methodName, method := range s.methods {
+		if method.disabled.Load() {
+			continue
+		}
+		methods[methodName] = method.describe()
+	}
+	return methods, nil
+}
+
+// methodInfos returns the descriptions of the enabled methods exposed to the
+// client of r, sorted by name. A nil r leaves out the methods requiring a
+// capability.
+func (m *serviceMap) methodInfos(r *http.Request) []MethodInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var infos []MethodInfo
+	for name, service := range m.services {
+		for methodName, method := range service.methods {
+			if method.disabled.Load() || !method.exposedTo(r) {
+				continue
+			}
+			info := method.describe()
+			info.Name = name + m.sep() + methodName
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// list returns the full names of the enabled methods starting with prefix,
+// in increasing order, leaving out the methods requiring a capability.
+func (m *serviceMap) list(prefix string) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var methods []string
+	for name, service := range m.services {
+		for methodName, method := range service.methods {
+			fullName := name + m.sep() + methodName
+			if strings.HasPrefix(fullName, prefix) && !method.disabled.Load() && method.exposedTo(nil) {
+				methods = append(methods, fullName)
+			}
+		}
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// timeout returns the maximum execution time of a service method: its own
+// timeout if set, otherwise the one of the nearest service tree path
+// including the service.
+func (m *serviceMap) timeout(s *service, method *serviceMethod) time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if method.timeout > 0 {
+		return method.timeout
+	}
+	path := s.name
+	for {
+		if timeout, ok := m.timeouts[path]; ok {
+			return timeout
+		}
+		parent, _, ok := m.split(path)
+		if !ok {
+			return 0
+		}
+		path = parent
+	}
+}
+
+// sep returns the delimiter of the parts of service and method names.
+func (m *serviceMap) sep() string {
+	if m.delimiter == "" {
+		return "."
+	}
+	return m.delimiter
+}
+
+// split splits name at its last delimiter, e.g. "A.B.Method" into "A.B" and
+// "Method", returning false if either part would be empty.
+func (m *serviceMap) split(name string) (string, string, bool) {
+	i := strings.LastIndex(name, m.sep())
+	if i <= 0 || i+len(m.sep()) == len(name) {
+		return "", "", false
+	}
+	return name[:i], name[i+len(m.sep()):], true
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
@@ -0,0 +1,53 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"reflect"
+)
+
+// CallMiddleware is called before a service method, once its args are
+// decoded, and can handle the call itself, e.g. to reply from a cache. The
+// RequestInfo holds the receiver of the method, the decoded args and the
+// reply the method would fill.
+//
+// Returning handled as true, or a non-nil error, skips the method and the
+// remaining middleware: the reply held by the RequestInfo is written, or
+// the error. The reply can be filled in place or replaced by another value.
+// For streaming methods the reply is the http.ResponseWriter of the call.
+type CallMiddleware func(info *RequestInfo) (handled bool, err error)
+
+// Use registers call middleware, called in the order they were registered.
+func (s *Server) Use(middleware ...CallMiddleware) {
+	s.callMiddleware = append(s.callMiddleware, middleware...)
+}
+
+// runCallMiddleware calls the registered call middleware, returning whether
+// one of them handled the call, with the resulting error and reply.
+func (s *Server) runCallMiddleware(r *http.Request, method string, rcvr, args, reply reflect.Value) (bool, []reflect.Value, reflect.Value) {
+	info := &RequestInfo{
+		Method:  method,
+		Request: r,
+		Args:    args.Interface(),
+		Reply:   reply.Interface(),
+	}
+	if rcvr.IsValid() {
+		info.Receiver = rcvr.Interface()
+	}
+	for _, middleware := range s.callMiddleware {
+		handled, err := middleware(info)
+		if err != nil {
+			return true, []reflect.Value{reflect.ValueOf(&err).Elem()}, reply
+		}
+		if handled {
+			if info.Reply == nil {
+				return true, []reflect.Value{nilErrorValue}, reflect.Zero(reply.Type())
+			}
+			return true, []reflect.Value{nilErrorValue}, reflect.ValueOf(info.Reply)
+		}
+	}
+	return false, []reflect.Value{nilErrorValue}, reply
+}
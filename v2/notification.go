@@ -0,0 +1,49 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"strings"
+)
+
+// SetGETNotifications sets whether the server serves GET requests as
+// notifications, e.g. for beacons: the method and the params are read from
+// the "method" and "params" query string parameters, the params being
+// encoded as in the body of a request of the codec, and the server responds
+// with 204 No Content once the method returns, whatever its outcome.
+//
+// The codec is selected as for other requests, usually being the only
+// registered codec or the fallback codec, and must implement ParamsCodec.
+func (s *Server) SetGETNotifications(enabled bool) {
+	s.getNotifications = enabled
+}
+
+// serveGETNotification serves a notification whose method and params are in
+// the query string.
+func (s *Server) serveGETNotification(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	method := query.Get("method")
+	if method == "" {
+		WriteError(w, http.StatusBadRequest, "rpc: missing method in query string")
+		return
+	}
+	codec, contentType := s.selectCodec(r)
+	paramsCodec, ok := codec.(ParamsCodec)
+	if !ok {
+		WriteError(w, http.StatusUnsupportedMediaType, "rpc: query string notifications not supported for Content-Type: "+contentType)
+		return
+	}
+	params := query.Get("params")
+	newRequest := func(r *http.Request) CodecRequest {
+		r = r.WithContext(r.Context())
+		r.Body = io.NopCloser(strings.NewReader(params))
+		return paramsCodec.NewParamsRequest(r, method)
+	}
+	// Notifications have no response.
+	s.serveRequest(newResponseBuffer(), r, newRequest, newRequest(r), false)
+	w.WriteHeader(http.StatusNoContent)
+}
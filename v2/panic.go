@@ -0,0 +1,66 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+)
+
+// PanicError is the error of a call whose method panicked. The value given
+// to panic is logged by the server but left out of the error message, so
+// that it isn't sent to clients.
+type PanicError struct {
+	Value interface{}
+}
+
+func (e *PanicError) Error() string {
+	return "rpc: method panicked"
+}
+
+// SetPanicStatus sets the HTTP status of the error response written when the
+// given method panics. Panics are recovered and reported as a PanicError,
+// with status 500 by default.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetPanicStatus(method string, status int) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if status < 100 || status > 599 {
+		return fmt.Errorf("rpc: invalid panic status for %q: %d", method, status)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.panicStatus = status
+	return nil
+}
+
+// callRecover runs call, turning a panic into a PanicError result. A panic
+// with http.ErrAbortHandler is left to abort the handler.
+func (s *Server) callRecover(method string, call func() []reflect.Value) (errValue []reflect.Value) {
+	defer func() {
+		if v := recover(); v != nil {
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			s.logf("rpc: panic serving %q: %v\n%s", method, v, debug.Stack())
+			errValue = []reflect.Value{reflect.ValueOf(error(&PanicError{Value: v}))}
+		}
+	}()
+	return call()
+}
+
+// panicStatusCode returns the status of the error response for a panic in the
+// method.
+func (m *serviceMethod) panicStatusCode() int {
+	if m.panicStatus != 0 {
+		return m.panicStatus
+	}
+	return http.StatusInternalServerError
+}
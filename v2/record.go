@@ -0,0 +1,131 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// recordedCall is a call written by StartRecording, one JSON object per
+// line. Params that aren't valid JSON are kept in RawParams instead.
+type recordedCall struct {
+	Method      string          `json:"method"`
+	ContentType string          `json:"contentType"`
+	Params      json.RawMessage `json:"params,omitempty"`
+	RawParams   []byte          `json:"rawParams,omitempty"`
+}
+
+// recorder writes the recorded calls.
+type recorder struct {
+	mutex  sync.Mutex
+	enc    *json.Encoder
+	redact func([]byte) []byte
+}
+
+// StartRecording sets the server to write the method and the params of
+// every call to w, as JSON lines that Replay can issue again, e.g. to
+// reproduce a production issue. The params are passed through redact before
+// being written, e.g. to mask personal data. Nothing is recorded if redact
+// is nil; pass a function returning its argument to record the params as
+// they are. Only the calls whose codec request implements
+// RawParamsCodecRequest are recorded, and a failed write is logged and stops
+// the recording.
+//
+// StartRecording can be called while the server is serving requests, and
+// replaces any recording already started.
+func (s *Server) StartRecording(w io.Writer, redact func([]byte) []byte) {
+	if redact == nil {
+		s.recorder.Store(nil)
+		return
+	}
+	s.recorder.Store(&recorder{enc: json.NewEncoder(w), redact: redact})
+}
+
+// StopRecording stops the recording started with StartRecording.
+func (s *Server) StopRecording() {
+	s.recorder.Store(nil)
+}
+
+// record writes the call to the recording, if started.
+func (s *Server) record(r *http.Request, method string, codecReq CodecRequest) {
+	rec := s.recorder.Load()
+	if rec == nil || r.Context().Value(replayKey) != nil {
+		// Replayed calls aren't recorded again.
+		return
+	}
+	rawReq, ok := codecReq.(RawParamsCodecRequest)
+	if !ok {
+		return
+	}
+	params, err := rawReq.RawParams()
+	if err != nil {
+		return
+	}
+	call := recordedCall{
+		Method:      method,
+		ContentType: r.Header.Get("Content-Type"),
+	}
+	if params = rec.redact(params); json.Valid(params) {
+		call.Params = params
+	} else {
+		call.RawParams = params
+	}
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if err := rec.enc.Encode(call); err != nil {
+		s.logf("rpc: can't record call: %v", err)
+		s.recorder.CompareAndSwap(rec, nil)
+	}
+}
+
+// Replay issues again the calls read from r, as written by StartRecording,
+// discarding their responses. The codec of each call is selected by its
+// content type and must implement ParamsCodec. Replay stops at the first
+// call it can't issue, returning the error. Replayed calls aren't recorded
+// by a recording in progress.
+func (s *Server) Replay(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for n := 1; ; n++ {
+		var call recordedCall
+		if err := dec.Decode(&call); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("rpc: invalid recorded call %d: %v", n, err)
+		}
+		if err := s.replay(call); err != nil {
+			return fmt.Errorf("rpc: can't replay call %d: %v", n, err)
+		}
+	}
+}
+
+// replay issues the recorded call.
+func (s *Server) replay(call recordedCall) error {
+	params := call.RawParams
+	if call.Params != nil {
+		params = call.Params
+	}
+	ctx := context.WithValue(context.Background(), replayKey, true)
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "/", bytes.NewReader(params))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", call.ContentType)
+	codec, contentType := s.selectCodec(r)
+	paramsCodec, ok := codec.(ParamsCodec)
+	if !ok {
+		return fmt.Errorf("no codec reading params for Content-Type %q", contentType)
+	}
+	newRequest := func(r *http.Request) CodecRequest {
+		return paramsCodec.NewParamsRequest(r, call.Method)
+	}
+	s.serveRequest(newResponseBuffer(), r, newRequest, newRequest(r), false)
+	return nil
+}
@@ -0,0 +1,40 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"net/http"
+)
+
+// Redirect is an error methods can return to redirect the client, e.g. to a
+// signed URL: the response has a Location header set to URL and the status
+// Code, 302 if zero, and no body. Calls of batch requests can't be
+// redirected, the error is written instead.
+type Redirect struct {
+	URL  string
+	Code int
+}
+
+func (e *Redirect) Error() string {
+	return "rpc: redirect to " + e.URL
+}
+
+// status returns the status of the redirect response.
+func (e *Redirect) status() int {
+	if e.Code == 0 {
+		return http.StatusFound
+	}
+	return e.Code
+}
+
+// asRedirect returns the Redirect held by err, nil if none.
+func asRedirect(err error) *Redirect {
+	var redirect *Redirect
+	if errors.As(err, &redirect) {
+		return redirect
+	}
+	return nil
+}
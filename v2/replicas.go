@@ -0,0 +1,134 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"sync/atomic"
+)
+
+// replicaSet is the set of receivers of a service registered with
+// RegisterReplicas, picked in turn following their schedule.
+type replicaSet struct {
+	rcvrs    []reflect.Value
+	schedule []int // indexes of the receivers of consecutive calls
+	next     atomic.Uint64
+}
+
+// pick returns the receiver of the next call.
+func (r *replicaSet) pick() reflect.Value {
+	n := r.next.Add(1) - 1
+	return r.rcvrs[r.schedule[n%uint64(len(r.schedule))]]
+}
+
+// RegisterReplicas registers a service as RegisterService does, with several
+// receivers of the same type, e.g. shards of a CPU-heavy service. Calls are
+// dispatched to the receivers in turn, round-robin. The methods are
+// extracted from the first receiver, and the Init and Close methods of
+// Initializer and io.Closer receivers are called for each of them.
+//
+// The receivers of a service registered with replicas can't be swapped with
+// SwapReceiver.
+func (s *Server) RegisterReplicas(name string, receivers []interface{}) error {
+	return s.services.registerReplicas(receivers, nil, name)
+}
+
+// RegisterWeightedReplicas registers a service as RegisterReplicas does,
+// dispatching the calls to each receiver in proportion to its weight, e.g.
+// for shards running on machines of different sizes. With weights 3 and 1,
+// the first receiver gets 3 calls out of 4. The calls to a receiver are
+// spread out rather than consecutive. There must be a positive weight per
+// receiver.
+func (s *Server) RegisterWeightedReplicas(name string, receivers []interface{}, weights []int) error {
+	if len(weights) != len(receivers) {
+		return fmt.Errorf("rpc: %d weights for the %d receivers of service %q", len(weights), len(receivers), name)
+	}
+	for i, weight := range weights {
+		if weight <= 0 {
+			return fmt.Errorf("rpc: invalid weight for receiver %d of service %q: %d", i, name, weight)
+		}
+	}
+	return s.services.registerReplicas(receivers, weights, name)
+}
+
+// registerReplicas adds a new service dispatching its calls across rcvrs,
+// following their weights, or in turn if weights is nil.
+func (m *serviceMap) registerReplicas(rcvrs []interface{}, weights []int, name string) error {
+	if len(rcvrs) == 0 {
+		return fmt.Errorf("rpc: no receivers for service %q", name)
+	}
+	s, err := m.newService(rcvrs[0], name)
+	if err != nil {
+		return err
+	}
+	replicas := &replicaSet{rcvrs: make([]reflect.Value, len(rcvrs))}
+	for i, rcvr := range rcvrs {
+		if t := reflect.TypeOf(rcvr); t != s.rcvrType {
+			return fmt.Errorf("rpc: receiver %d of service %q must be %v, got %v", i, s.name, s.rcvrType, t)
+		}
+		replicas.rcvrs[i] = reflect.ValueOf(rcvr)
+	}
+	replicas.schedule = replicaSchedule(len(rcvrs), weights)
+	s.replicas = replicas
+	for i, rcvr := range rcvrs {
+		if err := initReceiver(rcvr); err != nil {
+			// Release what Init set up for the previous receivers.
+			closeReceivers(replicas.rcvrs[:i])
+			return err
+		}
+	}
+	if err := m.add(s); err != nil {
+		closeService(s)
+		return err
+	}
+	return nil
+}
+
+// replicaSchedule returns the indexes of the receivers of consecutive calls
+// to n replicas with the given weights, using smooth weighted round-robin
+// so that the calls to a replica are interleaved with the others. Without
+// weights, each replica gets a call in turn.
+func replicaSchedule(n int, weights []int) []int {
+	if weights == nil {
+		weights = make([]int, n)
+		for i := range weights {
+			weights[i] = 1
+		}
+	}
+	// Reduce the weights to keep the schedule short.
+	divisor := weights[0]
+	for _, weight := range weights[1:] {
+		divisor = gcd(divisor, weight)
+	}
+	total := 0
+	reduced := make([]int, n)
+	for i, weight := range weights {
+		reduced[i] = weight / divisor
+		total += reduced[i]
+	}
+	schedule := make([]int, 0, total)
+	current := make([]int, n)
+	for len(schedule) < total {
+		best := 0
+		for i, weight := range reduced {
+			current[i] += weight
+			if current[i] > current[best] {
+				best = i
+			}
+		}
+		current[best] -= total
+		schedule = append(schedule, best)
+	}
+	return schedule
+}
+
+// gcd returns the greatest common divisor of the positive a and b.
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,25 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// ReplyErrorCodecRequest is implemented by codec requests able to write the
+// reply of a method along with its error.
+type ReplyErrorCodecRequest interface {
+	CodecRequest
+	// WriteErrorWithReply writes err as WriteError does, with reply.
+	WriteErrorWithReply(w http.ResponseWriter, status int, err error, reply interface{})
+}
+
+// SetIncludeReplyOnError sets the server to write the reply of methods
+// returning an error along with the error, for codecs implementing
+// ReplyErrorCodecRequest, so that clients get what the method filled in
+// before failing. By default the reply is discarded.
+func (s *Server) SetIncludeReplyOnError(include bool) {
+	s.replyOnError = include
+}
@@ -0,0 +1,68 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// SetMethodRetry sets the server to call the given method up to attempts
+// times while it fails with a temporary error, waiting backoff between calls.
+// An error is temporary if it, or an error it wraps, has a Temporary() bool
+// method returning true. The reply is reset to its zero value before each
+// retry.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodRetry(method string, attempts int, backoff time.Duration) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if attempts < 1 {
+		return fmt.Errorf("rpc: invalid number of attempts for %q: %d", method, attempts)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.retryAttempts = attempts
+	methodSpec.retryBackoff = backoff
+	return nil
+}
+
+// callWithRetry calls fn, the service method or its canary, retrying it as
+// configured by SetMethodRetry.
+func callWithRetry(r *http.Request, methodSpec *serviceMethod, fn reflect.Value, in []reflect.Value, reply reflect.Value) []reflect.Value {
+	for attempt := 1; ; attempt++ {
+		errValue := fn.Call(in)
+		// Streaming methods may have written part of their response, and
+		// methods reading the body may have consumed it.
+		if attempt >= methodSpec.retryAttempts || methodSpec.streaming || methodSpec.readsBody || !isTemporary(errValue[0]) {
+			return errValue
+		}
+		reply.Elem().Set(reflect.Zero(methodSpec.replyType))
+		if methodSpec.retryBackoff > 0 {
+			timer := time.NewTimer(methodSpec.retryBackoff)
+			select {
+			case <-timer.C:
+			case <-r.Context().Done():
+				timer.Stop()
+				return errValue
+			}
+		}
+	}
+}
+
+// isTemporary returns true if errValue holds a temporary error.
+func isTemporary(errValue reflect.Value) bool {
+	err, ok := errValue.Interface().(error)
+	if !ok {
+		return false
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
@@ -0,0 +1,77 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"errors"
+)
+
+// SchemaValidator compiles the schemas set with Server.SetMethodSchema. It is
+// usually an adapter for a JSON Schema library.
+type SchemaValidator interface {
+	Compile(schema []byte) (Schema, error)
+}
+
+// Schema validates the raw params of a method call.
+type Schema interface {
+	// Validate returns an error describing the violations of the schema.
+	Validate(params []byte) error
+}
+
+// RawParamsCodecRequest is implemented by codec requests that can return the
+// params of the call as they were received, before decoding them, e.g. to
+// validate them against a schema.
+type RawParamsCodecRequest interface {
+	CodecRequest
+	// RawParams returns the undecoded params, in the serialization format
+	// of the codec.
+	RawParams() ([]byte, error)
+}
+
+// SetSchemaValidator sets the validator compiling method schemas. It must be
+// set before calling SetMethodSchema.
+func (s *Server) SetSchemaValidator(v SchemaValidator) {
+	s.schemaValidator = v
+}
+
+// SetMethodSchema sets the schema the raw params of the given method are
+// validated against before being decoded. Calls with params violating the
+// schema fail with an *InvalidParamsError describing the violations. The
+// codec requests must implement RawParamsCodecRequest.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodSchema(method string, schema []byte) error {
+	if s.schemaValidator == nil {
+		return errors.New("rpc: no schema validator set")
+	}
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	compiled, err := s.schemaValidator.Compile(schema)
+	if err != nil {
+		return err
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.schema = compiled
+	return nil
+}
+
+// validateParams validates the raw params of codecReq against the schema.
+func validateParams(codecReq CodecRequest, schema Schema) error {
+	rawReq, ok := codecReq.(RawParamsCodecRequest)
+	if !ok {
+		return errors.New("rpc: codec doesn't support params validation")
+	}
+	params, err := rawReq.RawParams()
+	if err != nil {
+		return err
+	}
+	if err := schema.Validate(params); err != nil {
+		return &InvalidParamsError{Err: err}
+	}
+	return nil
+}
@@ -6,10 +6,19 @@
 package rpc
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"mime"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
+	"sync/atomic"
+	"time"
 )
 
 var nilErrorValue = reflect.Zero(reflect.TypeOf((*error)(nil)).Elem())
@@ -23,6 +32,14 @@ type Codec interface {
 	NewRequest(*http.Request) CodecRequest
 }
 
+// ParamsCodec is implemented by codecs that can read requests whose body
+// holds only the params of the method, the method being given by the server,
+// e.g. from the URL path. See Server.SetMethodFromPath.
+type ParamsCodec interface {
+	Codec
+	NewParamsRequest(r *http.Request, method string) CodecRequest
+}
+
 // CodecRequest decodes a request and encodes a response using a specific
 // serialization scheme.
 type CodecRequest interface {
@@ -42,10 +59,18 @@ type CodecRequest interface {
 
 // NewServer returns a new RPC server.
 func NewServer() *Server {
-	return &Server{
+	s := &Server{
 		codecs:   make(map[string]Codec),
 		services: new(serviceMap),
 	}
+	s.services.warnf = s.logf
+	return s
+}
+
+// Logger is the interface of the logger used by the server. It is satisfied
+// by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...interface{})
 }
 
 // RequestInfo contains all the information we pass to before/after functions
@@ -54,16 +79,68 @@ type RequestInfo struct {
 	Error      error
 	Request    *http.Request
 	StatusCode int
+
+	// Receiver, Args and Reply are only set for call middleware, see Use.
+	// Receiver is the receiver the method is called on, nil for
+	// schema-only methods.
+	Receiver interface{}
+	Args     interface{}
+	Reply    interface{}
+
+	values map[interface{}]interface{} // set with SetValue
 }
 
 // Server serves registered RPC services using registered codecs.
 type Server struct {
-	codecs        map[string]Codec
-	services      *serviceMap
-	interceptFunc func(i *RequestInfo) *http.Request
-	beforeFunc    func(i *RequestInfo)
-	afterFunc     func(i *RequestInfo)
-	validateFunc  reflect.Value
+	codecs            map[string]Codec
+	services          *serviceMap
+	interceptFunc     func(i *RequestInfo) *http.Request
+	beforeFunc        func(i *RequestInfo)
+	afterFunc         func(i *RequestInfo)
+	beforeHooks       hookList
+	afterHooks        hookList
+	validateFunc      reflect.Value
+	strictContentType bool
+	maxBatchSize      int
+	maxDeadline       time.Duration
+	argsPreprocessor  func(method string, args interface{}) error
+	logger            Logger
+	bodyLogging       bool
+	bodyRedactor      func([]byte) []byte
+	methodPathPrefix  string
+	methodHeader      string
+	unknownMethodFunc func(method string, r *http.Request)
+	respondToHead     bool
+	schemaValidator   SchemaValidator
+	stats             *callStats
+	responseTap       func(method string, body []byte)
+	writeErrorHandler func(method string, err error)
+	callMiddleware    []CallMiddleware
+	forwarder         Forwarder
+	batchFunc         func(size int, r *http.Request)
+	idGenerator       func() string
+	allocatePointers  bool
+	rejectUnknown     bool
+	emptyReplyStatus  int
+	tenantHeader      string
+	budgets           *tenantBudgets
+	recorder          atomic.Pointer[recorder]
+	fallbackCodec     Codec
+	getNotifications  bool
+	argBinder         ArgBinder
+	maxBodyBytes      int64
+	maxMethodBody     int64
+	clientCertCheck   func(cert *x509.Certificate, method string) error
+	traceTimings      bool
+	decompress        bool
+	exampleRedactor   func([]byte) []byte
+	replyOnError      bool
+	alwaysHTTP200     bool
+	maxLogLevel       LogLevel
+	dispatchErrors    bool
+	registeredFuncs   []func(methods []string)
+	maxInFlight       int64
+	inFlight          atomic.Int64
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -75,6 +152,147 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 	s.codecs[strings.ToLower(contentType)] = codec
 }
 
+// HasCodecs returns true if a codec was registered with RegisterCodec or
+// set with SetFallbackCodec. A server without codecs responds to every call
+// with a 500 status.
+func (s *Server) HasCodecs() bool {
+	return len(s.codecs) > 0 || s.fallbackCodec != nil
+}
+
+// SetLogger sets the logger the server writes warnings to. By default the
+// standard logger of the log package is used.
+func (s *Server) SetLogger(logger Logger) {
+	s.logger = logger
+}
+
+// SetStrictNamespace sets whether RegisterService rejects a service whose
+// name collides with a method of another service, e.g. the service "A.B"
+// and the method "B" of service "A", or the other way around. By default
+// the collision is only logged as a warning.
+func (s *Server) SetStrictNamespace(strict bool) {
+	s.services.strictNamespace = strict
+}
+
+// SetMethodNameTransform sets a function mapping the names of the receiver
+// methods to the names they are registered with by RegisterService, e.g.
+// to lower case them. If two methods of a receiver are mapped to the same
+// name, the registration fails.
+func (s *Server) SetMethodNameTransform(f func(name string) string) {
+	s.services.nameTransform = f
+}
+
+// SetMethodFilter sets a function excluding receiver methods from
+// registration by RegisterService: only the methods satisfying the
+// signature rules for which f returns true are registered. f receives the Go
+// name of the method, before any name transform.
+func (s *Server) SetMethodFilter(f func(goName string, m reflect.Method) bool) {
+	s.services.methodFilter = f
+}
+
+// SetDefaultService sets the service of the methods requested without a
+// service name, so that e.g. "Ping" is served as "Default.Ping" given the
+// name "Default". By default such requests are ill-formed.
+func (s *Server) SetDefaultService(name string) {
+	s.services.defaultService = name
+}
+
+// SetMethodDelimiter sets the separator of the parts of service and method
+// names, "." by default, e.g. "/" to register the service "A/B" and serve
+// its methods as "A/B/Method". It is used both to register services and to
+// resolve the requested methods, so it must be set before registering any
+// service.
+func (s *Server) SetMethodDelimiter(sep string) {
+	s.services.delimiter = sep
+}
+
+// SetLenientMethodNames sets the server to trim surrounding whitespace and a
+// single trailing delimiter from requested methods before resolving them, so
+// that e.g. "Users.Get " and "Users.Get." are served as "Users.Get". By
+// default such methods can't be found.
+func (s *Server) SetLenientMethodNames(lenient bool) {
+	s.services.lenient = lenient
+}
+
+// SetMethodPrefixStrip sets a prefix trimmed from requested methods before
+// resolving them, so that e.g. "v1.Users.Get" is served as "Users.Get" given
+// the prefix "v1.". Methods without the prefix are resolved as usual.
+func (s *Server) SetMethodPrefixStrip(prefix string) {
+	s.services.stripPrefix = prefix
+}
+
+// SetMethodFromPath sets the server to take the method from the URL path of
+// requests starting with the given prefix, e.g. "Users.Get" for
+// "/rpc/Users.Get" given the prefix "/rpc/". The body of such requests
+// holds only the params, and their codec must implement ParamsCodec.
+// Requests to other paths are served as usual.
+func (s *Server) SetMethodFromPath(prefix string) {
+	s.methodPathPrefix = prefix
+}
+
+// SetMethodHeader sets the server to take the method from the given header,
+// e.g. "X-RPC-Method", when it is present and the method isn't taken from
+// the URL path. As with SetMethodFromPath, the body of such requests holds
+// only the params, and their codec must implement ParamsCodec.
+func (s *Server) SetMethodHeader(header string) {
+	s.methodHeader = header
+}
+
+// SetRespondToHead sets whether the server responds to HEAD requests with
+// 200 OK and no body, e.g. for load balancer health probes, instead of
+// rejecting them as any other non-POST request.
+func (s *Server) SetRespondToHead(respond bool) {
+	s.respondToHead = respond
+}
+
+// SetFallbackCodec sets the codec of the requests whose Content-Type, missing
+// or not, matches no registered codec, e.g. a JSON codec for clients sending
+// odd content types. Without a fallback codec, the default, such requests
+// are rejected with 415 Unsupported Media Type. The fallback codec isn't used
+// in strict mode, see SetStrictContentType.
+func (s *Server) SetFallbackCodec(codec Codec) {
+	s.fallbackCodec = codec
+}
+
+// SetStrictContentType sets whether the server requires the media type of the
+// "Content-Type" header to match a registered codec exactly.
+//
+// In strict mode a missing or malformed Content-Type is never resolved to a
+// default codec; requests that don't match are rejected with
+// 415 Unsupported Media Type.
+func (s *Server) SetStrictContentType(strict bool) {
+	s.strictContentType = strict
+}
+
+// SetMaxBatchSize limits the number of calls a batch request may carry, for
+// codecs supporting batches. Larger batches are rejected before any of their
+// calls is dispatched. A value of zero or less, the default, means unlimited.
+func (s *Server) SetMaxBatchSize(n int) {
+	s.maxBatchSize = n
+}
+
+// SetMaxInFlight limits the number of requests the server serves at once.
+// Requests beyond the limit are rejected with 503 Service Unavailable before
+// being decoded. A value of zero or less, the default, means unlimited.
+func (s *Server) SetMaxInFlight(n int) {
+	s.maxInFlight = int64(n)
+}
+
+// SetEmptyReplyStatus sets the server to respond with the given status and
+// no body, e.g. 204 No Content, instead of writing the reply of successful
+// calls to methods whose reply is an empty struct. Calls of batch requests
+// still get their response. A status of zero, the default, disables it.
+func (s *Server) SetEmptyReplyStatus(status int) {
+	s.emptyReplyStatus = status
+}
+
+// SetWriteErrorHandler sets a function called when writing the response of a
+// call fails, e.g. because the client disconnected, with the requested
+// method and the first write error. The method is empty if the codec failed
+// to read it.
+func (s *Server) SetWriteErrorHandler(f func(method string, err error)) {
+	s.writeErrorHandler = f
+}
+
 // RegisterInterceptFunc registers the specified function as the function
 // that will be called before every request. The function is allowed to intercept
 // the request e.g. add values to the context.
@@ -86,10 +304,12 @@ func (s *Server) RegisterInterceptFunc(f func(i *RequestInfo) *http.Request) {
 }
 
 // RegisterBeforeFunc registers the specified function as the function
-// that will be called before every request.
+// that will be called before every request. It can pass values to the
+// method with RequestInfo.SetValue.
 //
 // Note: Only one function can be registered, subsequent calls to this
-// method will overwrite all the previous functions.
+// method will overwrite all the previous functions. Use
+// RegisterBeforeFuncWithPriority to register several functions.
 func (s *Server) RegisterBeforeFunc(f func(i *RequestInfo)) {
 	s.beforeFunc = f
 }
@@ -104,11 +324,33 @@ func (s *Server) RegisterValidateRequestFunc(f func(r *RequestInfo, i interface{
 	s.validateFunc = reflect.ValueOf(f)
 }
 
+// SetArgsPreprocessor registers the specified function as the function that
+// will be called with the already-unmarshalled *args parameter of the method,
+// before the Validator Function. The function is allowed to modify the args
+// in place, e.g. to trim strings or normalize values. If it returns a non-nil
+// error, the method won't be invoked and an *InvalidParamsError wrapping the
+// error will be written.
+func (s *Server) SetArgsPreprocessor(f func(method string, args interface{}) error) {
+	s.argsPreprocessor = f
+}
+
+// OnUnknownMethod registers the specified function as the function that will
+// be called with the requested method whenever it can't be resolved to a
+// registered one, before the error is written. This is useful to detect
+// clients calling removed methods.
+//
+// Note: Only one function can be registered, subsequent calls to this
+// method will overwrite all the previous functions.
+func (s *Server) OnUnknownMethod(f func(method string, r *http.Request)) {
+	s.unknownMethodFunc = f
+}
+
 // RegisterAfterFunc registers the specified function as the function
 // that will be called after every request
 //
 // Note: Only one function can be registered, subsequent calls to this
-// method will overwrite all the previous functions.
+// method will overwrite all the previous functions. Use
+// RegisterAfterFuncWithPriority to register several functions.
 func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
 	s.afterFunc = f
 }
@@ -116,23 +358,83 @@ func (s *Server) RegisterAfterFunc(f func(i *RequestInfo)) {
 // RegisterService adds a new service to the server.
 //
 // The name parameter is optional: if empty it will be inferred from
-// the receiver type name.
+// the receiver type name. It can use a dotted notation, as in
+// "Parent.Service", to nest services.
 //
 // Methods from the receiver will be extracted if these rules are satisfied:
 //
-//    - The receiver is exported (begins with an upper case letter) or local
-//      (defined in the package registering the service).
-//    - The method name is exported.
-//    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
-//    - The second and third arguments are exported or local.
-//    - The method has return type error.
+//   - The receiver is exported (begins with an upper case letter) or local
+//     (defined in the package registering the service).
+//   - The method name is exported.
+//   - The method has three arguments: *http.Request, *args, *reply.
+//   - All three arguments are pointers.
+//   - The second and third arguments are exported or local.
+//   - The method has return type error.
+//
+// Methods taking a context.Context instead of the *http.Request are
+// extracted too. They receive the context of the request, including any
+// deadline set by the server.
+//
+// Streaming methods, whose third argument is an http.ResponseWriter instead
+// of *reply, are extracted too. They write the response body themselves,
+// bypassing the codec, which only writes the returned error if the method
+// wrote nothing.
+//
+// Methods whose second argument is an io.Reader instead of *args are
+// extracted too. They read the request body themselves, as a stream, so they
+// must be called with the method given outside the body, see
+// SetMethodFromPath and SetMethodHeader.
 //
 // All other methods are ignored.
+//
+// If the receiver is an Initializer, its Init method is called before the
+// service is added, the registration failing if it returns an error. If it
+// is an io.Closer, its Close method is called when the service is removed
+// by UnregisterService or Shutdown, so that receivers can manage their
+// resources. Neither is called for RegisterServiceFactory.
 func (s *Server) RegisterService(receiver interface{}, name string) error {
 	return s.services.register(receiver, name)
 }
 
+// RegisterServiceIf registers the service as RegisterService does if cond is
+// true, e.g. for services behind a feature flag. Otherwise it does nothing
+// and returns nil.
+func (s *Server) RegisterServiceIf(cond bool, receiver interface{}, name string) error {
+	if !cond {
+		return nil
+	}
+	return s.RegisterService(receiver, name)
+}
+
+// RegisterAll registers each of the services as RegisterService does, with
+// its key as the name. The registration is best-effort: a failing service
+// doesn't prevent the others from being registered, and the returned error
+// joins the errors of all the failing ones, in the order of their names.
+func (s *Server) RegisterAll(services map[string]interface{}) error {
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if err := s.RegisterService(services[name], name); err != nil {
+			errs = append(errs, fmt.Errorf("rpc: service %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RegisterServiceFactory adds a new service whose receiver is returned by
+// factory for each request, e.g. to carry request-scoped dependencies. The
+// factory must always return receivers of the same type: their methods are
+// extracted once, as in RegisterService, from a receiver returned for a
+// placeholder request at registration. The name can't be inferred when the
+// sample receiver isn't a named type.
+func (s *Server) RegisterServiceFactory(name string, factory func(r *http.Request) interface{}) error {
+	return s.services.registerFactory(factory, name)
+}
+
 // HasMethod returns true if the given method is registered.
 //
 // The method uses a dotted notation as in "Service.Method".
@@ -143,42 +445,364 @@ func (s *Server) HasMethod(method string) bool {
 	return false
 }
 
+// ListMethods returns the registered methods, in dotted notation as in
+// "Service.Method", sorted by name. Disabled methods and methods requiring a
+// capability aren't listed, see RequireCapability.
+func (s *Server) ListMethods() []string {
+	return s.services.list("")
+}
+
+// ListMethodsByPrefix returns the registered methods starting with the given
+// prefix, e.g. "Users." for the methods of the service "Users" and the
+// services nested in it, sorted as in ListMethods.
+func (s *Server) ListMethodsByPrefix(prefix string) []string {
+	return s.services.list(prefix)
+}
+
+// ServiceMethods returns the enabled methods of the service registered with
+// the given name, by name, e.g. for contract tests asserting the exact
+// methods a service exposes. The methods of nested services aren't
+// included. The returned map is a copy.
+func (s *Server) ServiceMethods(service string) (map[string]MethodInfo, error) {
+	return s.services.serviceMethods(service)
+}
+
+// UnregisterService removes the service registered with the given name.
+// Nested services, like "A.B" for "A", are kept. If its receiver is an
+// io.Closer, its Close method is called, and its error returned.
+func (s *Server) UnregisterService(name string) error {
+	return s.services.unregister(name)
+}
+
+// SwapReceiver replaces the receiver of the service registered with the
+// given name, e.g. to update its dependencies. The new receiver must have
+// the type of the current one, so that the methods and their settings are
+// kept as they are. Calls made once SwapReceiver returns use the new
+// receiver, while running calls complete with the old one.
+//
+// If the new receiver is an Initializer, its Init method is called first,
+// its error being returned without swapping the receivers. If the old
+// receiver is an io.Closer, its Close method is called once it is replaced,
+// and its error returned: it must let the running calls complete.
+//
+// Services registered with RegisterServiceFactory or RegisterSchema have no
+// receiver to swap.
+func (s *Server) SwapReceiver(name string, receiver interface{}) error {
+	return s.services.swapReceiver(name, receiver)
+}
+
+// SnapshotServices returns a copy of the service tree, holding only the
+// names of the services and their methods. Unlike WalkServices, the
+// registrations are only locked while copying the set of services, and the
+// snapshot is unaffected by later registrations.
+func (s *Server) SnapshotServices() *ServiceSnapshot {
+	return s.services.snapshot()
+}
+
+// WalkServices calls fn for each node of the service tree formed by the
+// dotted service names, depth-first with parents before their children and
+// siblings sorted by name. The path is the full dotted name of the node.
+// Nodes that are only a prefix of service names have no methods.
+//
+// Registrations are locked during the walk: fn must not call methods of the
+// server.
+func (s *Server) WalkServices(fn func(path string, info ServiceInfo)) {
+	s.services.walk(fn)
+}
+
+// Reset removes all the registered services, with their method and service
+// settings and the stats enabled by EnableStats, and all the registered
+// functions: intercept, before, after, validate, args preprocessor, unknown
+// method, batch, call middleware and registration complete. Registered codecs
+// and server-wide settings are kept.
+//
+// Reset must not be called while the server is serving requests.
+func (s *Server) Reset() {
+	s.services.reset()
+	s.interceptFunc = nil
+	s.beforeFunc = nil
+	s.afterFunc = nil
+	s.beforeHooks = nil
+	s.afterHooks = nil
+	s.registeredFuncs = nil
+	s.validateFunc = reflect.Value{}
+	s.argsPreprocessor = nil
+	s.unknownMethodFunc = nil
+	s.callMiddleware = nil
+	s.batchFunc = nil
+	s.stats = nil
+}
+
+// SetMethodEnabled enables or disables the given method at runtime. Calls to
+// a disabled method fail as if it wasn't registered, and HasMethod reports
+// it as such, but its registration and settings are kept so that it can be
+// enabled again. Methods are enabled by default.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) SetMethodEnabled(method string, enabled bool) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	methodSpec.disabled.Store(!enabled)
+	return nil
+}
+
+// RequireContentType restricts the given method to requests with the given
+// Content-Type, excluding parameters such as the charset. Calls with another
+// Content-Type are rejected with a 415 status before being decoded. It can
+// be called several times to accept several content types.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) RequireContentType(method, contentType string) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("rpc: invalid Content-Type %q for %q: %v", contentType, method, err)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.contentTypes = append(methodSpec.contentTypes, mediaType)
+	return nil
+}
+
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
+	if r.Method == http.MethodHead && s.respondToHead {
+		// Let health probes pass without decoding a call.
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	notification := r.Method == http.MethodGet && s.getNotifications
+	if r.Method != "POST" && !notification {
 		WriteError(w, http.StatusMethodNotAllowed, "rpc: POST method required, received "+r.Method)
 		return
 	}
-	contentType := r.Header.Get("Content-Type")
-	idx := strings.Index(contentType, ";")
-	if idx != -1 {
-		contentType = contentType[:idx]
+	if !s.HasCodecs() {
+		WriteError(w, http.StatusInternalServerError, "rpc: no codec registered, see Server.RegisterCodec")
+		return
 	}
-	var codec Codec
-	if contentType == "" && len(s.codecs) == 1 {
-		// If Content-Type is not set and only one codec has been registered,
-		// then default to that codec.
-		for _, c := range s.codecs {
-			codec = c
+	if s.maxInFlight > 0 {
+		defer s.inFlight.Add(-1)
+		if s.inFlight.Add(1) > s.maxInFlight {
+			WriteError(w, http.StatusServiceUnavailable, "rpc: too many requests in flight")
+			return
+		}
+	}
+	if notification {
+		s.serveGETNotification(w, r)
+		return
+	}
+	if s.decompress {
+		if err := decompressBody(r); err != nil {
+			WriteError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-	} else if codec = s.codecs[strings.ToLower(contentType)]; codec == nil {
+	}
+	method, ok := s.methodFromPath(r)
+	if !ok {
+		method, ok = s.methodFromHeader(r)
+	}
+	// Limit the size of the body before anything reads it, to the limit of
+	// the method if it is known.
+	if r.Body != nil && (s.maxBodyBytes > 0 || s.maxMethodBody > 0) {
+		r = limitBody(w, r, s.readLimit(method, ok))
+	}
+	if s.bodyLogging || s.requestLogLevel(r) >= LogLevelDebug {
+		s.logRequestBody(r)
+		tee := &teeResponseWriter{ResponseWriter: w}
+		defer s.logResponseBody(tee)
+		w = tee
+	}
+	codec, contentType := s.selectCodec(r)
+	if codec == nil {
 		WriteError(w, http.StatusUnsupportedMediaType, "rpc: unrecognized Content-Type: "+contentType)
 		return
 	}
 	// Create a new codec request.
-	codecReq := codec.NewRequest(r)
+	newRequest := codec.NewRequest
+	unreadBody := false
+	if ok {
+		paramsCodec, ok := codec.(ParamsCodec)
+		if !ok {
+			WriteError(w, http.StatusUnsupportedMediaType, "rpc: method outside the body not supported for Content-Type: "+contentType)
+			return
+		}
+		// Leave the body unread for the methods reading it themselves.
+		unreadBody = s.readsBody(method)
+		newRequest = func(r *http.Request) CodecRequest {
+			if unreadBody {
+				r = withoutBody(r)
+			}
+			return paramsCodec.NewParamsRequest(r, method)
+		}
+	}
+	if s.alwaysHTTP200 {
+		w = &okStatusWriter{ResponseWriter: w}
+	}
+	// Measure the sizes of the request and the response for the stats.
+	var body *countingReader
+	var out *countingWriter
+	if s.stats != nil {
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+		out = &countingWriter{ResponseWriter: w}
+		w = out
+	}
+	codecReq := newRequest(r)
+	if batchReq, ok := codecReq.(BatchCodecRequest); ok {
+		calls, isBatch, err := batchReq.Batch(s.maxBatchSize)
+		if err != nil {
+			if errSize := checkBodySize(r, "", 0); errSize != nil {
+				codecReq.WriteError(w, http.StatusRequestEntityTooLarge, errSize)
+				return
+			}
+			codecReq.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if isBatch {
+			s.serveBatch(w, r, batchReq, calls)
+			return
+		}
+	}
+	served := s.serveRequest(w, r, newRequest, codecReq, unreadBody)
+	if s.stats != nil && served != "" {
+		var in int64
+		if body != nil {
+			in = body.n
+		}
+		s.stats.recordSizes(served, in, out.n)
+	}
+}
+
+// serveRequest dispatches a single call. If newRequest is not nil, it is
+// used to create the codec request again once the Intercept and Before
+// functions had a chance to modify the request. unreadBody is true if the
+// codec left the request body unread for the method. The canonical name of
+// the called method is returned, as in "Service.Method", empty if the call
+// was rejected before reaching it, e.g. for an unknown method.
+func (s *Server) serveRequest(w http.ResponseWriter, r *http.Request, newRequest func(*http.Request) CodecRequest, codecReq CodecRequest, unreadBody bool) (called string) {
+	var method string
+	if s.responseTap != nil {
+		tee := &teeResponseWriter{ResponseWriter: w}
+		defer func() { s.responseTap(method, tee.body.Bytes()) }()
+		w = tee
+	}
+	if s.writeErrorHandler != nil {
+		ew := &errorRecordingWriter{ResponseWriter: w}
+		defer func() {
+			if ew.err != nil {
+				s.writeErrorHandler(method, ew.err)
+			}
+		}()
+		w = ew
+	}
+	var trace *phaseTimer
+	if s.traceTimings || s.requestLogLevel(r) >= LogLevelTrace {
+		trace = newPhaseTimer()
+		defer func() { s.logTrace(method, trace) }()
+	}
+	fail := func(status int, phase Phase, err error) {
+		if s.dispatchErrors {
+			err = &DispatchError{Phase: phase, Method: method, Err: err}
+		}
+		codecReq.WriteError(w, status, err)
+		if s.dispatchErrors && (s.afterFunc != nil || len(s.afterHooks) > 0) {
+			s.afterHooks.run(&RequestInfo{
+				Request:    r,
+				Method:     method,
+				Error:      err,
+				StatusCode: status,
+			}, s.afterFunc)
+		}
+	}
+
+	// Generate the ID of requests without one.
+	id := s.assignID(codecReq)
+
 	// Get service method to be called.
 	method, errMethod := codecReq.Method()
 	if errMethod != nil {
-		codecReq.WriteError(w, http.StatusBadRequest, errMethod)
+		if err := checkBodySize(r, "", 0); err != nil {
+			fail(http.StatusRequestEntityTooLarge, PhaseResolve, err)
+			return
+		}
+		fail(http.StatusBadRequest, PhaseResolve, errMethod)
 		return
 	}
 	serviceSpec, methodSpec, errGet := s.services.get(method)
+	if errGet == nil && !methodSpec.exposedTo(r) {
+		errGet = fmt.Errorf("rpc: can't find method %q", method)
+	}
 	if errGet != nil {
-		codecReq.WriteError(w, http.StatusBadRequest, errGet)
+		if s.unknownMethodFunc != nil {
+			s.unknownMethodFunc(method, r)
+		}
+		fail(http.StatusBadRequest, PhaseResolve, errGet)
+		return
+	}
+	setResolvedMethod(r, method)
+	s.record(r, method, codecReq)
+
+	// Reject the API versions the service doesn't accept.
+	if serviceSpec.versions != nil {
+		if err := serviceSpec.versions.check(r); err != nil {
+			fail(http.StatusBadRequest, PhaseResolve, err)
+			return
+		}
+	}
+
+	// Reject the clients whose identity isn't accepted for the method.
+	if s.clientCertCheck != nil {
+		if err := s.checkClientCert(r, methodSpec.info.Name); err != nil {
+			fail(http.StatusForbidden, PhaseResolve, err)
+			return
+		}
+	}
+
+	// Reject the bodies larger than the limit of the method.
+	if err := checkBodySize(r, method, s.bodyLimit(methodSpec)); err != nil {
+		fail(http.StatusRequestEntityTooLarge, PhaseResolve, err)
+		return
+	}
+
+	// The body was decoded by the codec, it can't be streamed anymore.
+	if methodSpec.readsBody && !unreadBody {
+		err := fmt.Errorf("rpc: method %q reads the request body, the method must be given outside the body", method)
+		fail(http.StatusBadRequest, PhaseResolve, err)
 		return
 	}
 
+	// Reject the content types the method doesn't accept before decoding.
+	if !methodSpec.acceptsContentType(r.Header.Get("Content-Type")) {
+		err := fmt.Errorf("rpc: method %q requires Content-Type %s", method, strings.Join(methodSpec.contentTypes, " or "))
+		fail(http.StatusUnsupportedMediaType, PhaseResolve, err)
+		return
+	}
+
+	// Fail fast while the circuit breaker of the method is open.
+	if methodSpec.breaker != nil && !methodSpec.breaker.allow() {
+		fail(http.StatusServiceUnavailable, PhaseResolve, ErrCircuitOpen)
+		return
+	}
+
+	// Throttle the tenants that used up their budget.
+	var tenant string
+	if s.budgets != nil {
+		tenant = s.tenant(r)
+		if !s.budgets.allow(tenant) {
+			fail(http.StatusTooManyRequests, PhaseResolve, ErrBudgetExceeded)
+			return
+		}
+	}
+
+	trace.mark("resolve")
+
 	// Call the registered Intercept Function
 	if s.interceptFunc != nil {
 		req := s.interceptFunc(&RequestInfo{
@@ -195,77 +819,330 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Method:  method,
 	}
 
-	// Call the registered Before Function
-	if s.beforeFunc != nil {
-		s.beforeFunc(requestInfo)
-	}
+	// Call the registered Before Functions
+	s.beforeHooks.run(requestInfo, s.beforeFunc)
 
 	// Close request body after Intercept and Before Function if it exists
 	// if it's already closed, error still would be nil
-	if r.Body != nil {
+	if r.Body != nil && !methodSpec.readsBody {
 		r.Body.Close()
 	}
 
 	// Update codec request with request values after Intercept and Before functions if they exist
-	if s.interceptFunc != nil || s.beforeFunc != nil {
-		codecReq = codec.NewRequest(r)
+	if newRequest != nil && (s.interceptFunc != nil || s.beforeFunc != nil || len(s.beforeHooks) > 0) {
+		codecReq = newRequest(r)
+		if idReq, ok := codecReq.(IDCodecRequest); ok && id != "" {
+			idReq.SetID(id)
+		}
 	}
+	trace.mark("before-hooks")
+
+	// Validate the raw params against the method schema.
+	if methodSpec.schema != nil {
+		if err := validateParams(codecReq, methodSpec.schema); err != nil {
+			fail(http.StatusBadRequest, PhaseValidate, err)
+			return
+		}
+	}
+	trace.mark("schema")
 
 	// Decode the args.
-	args := reflect.New(methodSpec.argsType)
-	if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-		codecReq.WriteError(w, http.StatusBadRequest, errRead)
+	args := methodSpec.newArgs()
+	defer methodSpec.releaseArgs(args)
+	if s.allocatePointers {
+		allocateNestedPointers(args.Elem(), make(map[reflect.Type]bool))
+	}
+	if strictReq, ok := codecReq.(StrictCodecRequest); ok && s.rejectUnknown {
+		strictReq.DisallowUnknownFields()
+	}
+	if methodSpec.readsBody {
+		args.Elem().Set(reflect.ValueOf(io.Reader(r.Body)))
+	} else if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
+		fail(http.StatusBadRequest, PhaseDecode, errRead)
+		return
+	}
+	trace.mark("decode")
+
+	// Overlay the args with values from other sources than the params.
+	if !methodSpec.readsBody {
+		if err := s.bindArgs(r, methodSpec, args); err != nil {
+			fail(http.StatusBadRequest, PhaseDecode, &InvalidParamsError{Err: err})
+			return
+		}
+	}
+
+	// Call the registered Args Preprocessor
+	if s.argsPreprocessor != nil {
+		if err := s.argsPreprocessor(method, args.Interface()); err != nil {
+			fail(http.StatusBadRequest, PhaseValidate, &InvalidParamsError{Err: err})
+			return
+		}
+	}
+	trace.mark("bind")
+
+	// Apply the deadline requested by the client, if any.
+	deadline, hasDeadline, errDeadline := s.requestDeadline(r)
+	if errDeadline != nil {
+		fail(http.StatusBadRequest, PhaseResolve, errDeadline)
 		return
 	}
+	if hasDeadline {
+		ctx, cancel := context.WithTimeout(r.Context(), deadline)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if timeout := s.services.timeout(serviceSpec, methodSpec); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
 
-	// Prepare the reply, we need it even if validation fails
-	reply := reflect.New(methodSpec.replyType)
+	// Prepare the reply, we need it even if validation fails. Streaming
+	// methods write their response themselves instead.
+	var reply reflect.Value
+	var stream *streamResponseWriter
+	if methodSpec.streaming {
+		stream = &streamResponseWriter{ResponseWriter: w}
+		reply = reflect.ValueOf(http.ResponseWriter(stream))
+	} else {
+		reply = reflect.New(methodSpec.replyType)
+	}
 	errValue := []reflect.Value{nilErrorValue}
 
 	// Call the registered Validator Function
 	if s.validateFunc.IsValid() {
 		errValue = s.validateFunc.Call([]reflect.Value{reflect.ValueOf(requestInfo), args})
 	}
+	validated := errValue[0].IsNil()
+	trace.mark("validate")
+
+	// Get the receiver of the request from the canary or the service
+	// factory, if any
+	rcvr, fn, canary := s.services.receiver(serviceSpec, methodSpec, r)
+	if errValue[0].IsNil() && serviceSpec.factory != nil && !canary {
+		v := serviceSpec.factory(r)
+		rcvr = reflect.ValueOf(v)
+		if !rcvr.IsValid() || rcvr.Type() != serviceSpec.rcvrType {
+			err := fmt.Errorf("rpc: factory of service %q returned %T instead of %v", serviceSpec.name, v, serviceSpec.rcvrType)
+			fail(http.StatusInternalServerError, PhaseHandler, err)
+			return
+		}
+	}
+
+	// Call the registered call middleware, which may handle the call
+	handled := false
+	if errValue[0].IsNil() && len(s.callMiddleware) > 0 {
+		handled, errValue, reply = s.runCallMiddleware(r, method, rcvr, args, reply)
+	}
 
 	// If still no errors after validation, call the method
-	if errValue[0].IsNil() {
-		errValue = methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			reflect.ValueOf(r),
-			args,
-			reply,
-		})
+	state := &callState{info: &methodSpec.info, values: requestInfo.values}
+	if errValue[0].IsNil() && !handled {
+		call := func() []reflect.Value {
+			if methodSpec.forwarded {
+				return s.forward(r, method, args, reply)
+			}
+			// Let the method read its own description and set headers.
+			callReq := r.WithContext(context.WithValue(r.Context(), callStateKey, state))
+			req := reflect.ValueOf(callReq)
+			if methodSpec.withContext {
+				req = reflect.ValueOf(callReq.Context())
+			}
+			in := args
+			if methodSpec.readsBody {
+				in = args.Elem()
+			}
+			return callWithRetry(r, methodSpec, fn, []reflect.Value{
+				rcvr,
+				req,
+				in,
+				reply,
+			}, reply)
+		}
+		start := time.Now()
+		cache := methodSpec.cache
+		var cacheKey string
+		cached := false
+		if cache != nil {
+			cacheKey, cached = cache.get(args, reply)
+		}
+		if cached {
+			errValue = []reflect.Value{nilErrorValue}
+		} else if methodSpec.coalesce != nil {
+			errValue = methodSpec.coalesce.do(args, reply, func() []reflect.Value {
+				return s.callRecover(method, call)
+			})
+		} else {
+			errValue = s.callRecover(method, call)
+		}
+		if cache != nil && !cached && cacheKey != "" && errValue[0].IsNil() && r.Context().Err() == nil {
+			cache.put(cacheKey, reply)
+		}
+		if s.stats != nil {
+			s.stats.record(methodSpec.info.Name, time.Since(start))
+		}
+		if s.budgets != nil {
+			s.budgets.record(tenant, time.Since(start))
+		}
+		if methodSpec.breaker != nil {
+			methodSpec.breaker.record(!errValue[0].IsNil() || r.Context().Err() == context.DeadlineExceeded)
+		}
 	}
+	trace.mark("handler")
 
 	// Extract the result to error if needed.
 	var errResult error
 	statusCode := http.StatusOK
+	phase := PhaseHandler
 	errInter := errValue[0].Interface()
 	if errInter != nil {
 		statusCode = http.StatusBadRequest
 		errResult = errInter.(error)
+		if !validated {
+			phase = PhaseValidate
+		}
+		if _, ok := errResult.(*PanicError); ok {
+			statusCode = methodSpec.panicStatusCode()
+		}
+	}
+	if r.Context().Err() == context.DeadlineExceeded {
+		statusCode = http.StatusGatewayTimeout
+		errResult = ErrDeadlineExceeded
+	}
+	partial := errResult != nil && !methodSpec.streaming && isPartialResult(r, reply.Interface(), errResult)
+
+	// Transform the reply before writing it.
+	var result interface{}
+	if !methodSpec.streaming {
+		result = reply.Interface()
+		if errResult == nil || partial || s.replyOnError {
+			var errTransform error
+			if result, errTransform = methodSpec.transforms.apply(method, result); errTransform != nil {
+				statusCode = http.StatusInternalServerError
+				errResult = errTransform
+				phase = PhaseEncode
+				partial = false
+			}
+		}
 	}
 
 	// Prevents Internet Explorer from MIME-sniffing a response away
 	// from the declared content-type
 	w.Header().Set("x-content-type-options", "nosniff")
+	if !methodSpec.streaming {
+		state.applyHeader(w.Header())
+	}
+
+	if errResult != nil && s.dispatchErrors {
+		errResult = &DispatchError{Phase: phase, Method: method, Err: errResult}
+	}
 
 	// Encode the response.
-	if errResult == nil {
-		codecReq.WriteResponse(w, reply.Interface())
+	if methodSpec.streaming {
+		// The error can only be written if the method wrote nothing.
+		if errResult != nil && !stream.wroteHeader {
+			codecReq.WriteError(w, statusCode, errResult)
+		}
+	} else if redirect := asRedirect(errResult); redirect != nil && newRequest != nil {
+		// Batch calls, served without newRequest, are left out.
+		statusCode = redirect.status()
+		w.Header().Set("Location", redirect.URL)
+		w.WriteHeader(statusCode)
+	} else if errResult == nil && s.emptyReplyStatus != 0 && newRequest != nil && isEmptyStruct(methodSpec.replyType) {
+		// Batch calls, served without newRequest, are left out.
+		statusCode = s.emptyReplyStatus
+		w.WriteHeader(statusCode)
+	} else if errResult == nil {
+		codecReq.WriteResponse(w, result)
+	} else if partial {
+		statusCode = http.StatusOK
+		w.Header().Set("Warning", partialResultWarning(errResult))
+		codecReq.WriteResponse(w, result)
+	} else if replyReq, ok := codecReq.(ReplyErrorCodecRequest); ok && s.replyOnError {
+		replyReq.WriteErrorWithReply(w, statusCode, errResult, result)
 	} else {
 		codecReq.WriteError(w, statusCode, errResult)
 	}
+	trace.mark("encode")
+
+	// Keep the first successful call as the example of the method.
+	if s.exampleRedactor != nil && errResult == nil && !methodSpec.streaming && !methodSpec.readsBody {
+		s.captureExample(methodSpec, args.Interface(), result)
+	}
 
-	// Call the registered After Function
-	if s.afterFunc != nil {
-		s.afterFunc(&RequestInfo{
+	// Call the registered After Functions
+	if s.afterFunc != nil || len(s.afterHooks) > 0 {
+		s.afterHooks.run(&RequestInfo{
 			Request:    r,
 			Method:     method,
 			Error:      errResult,
 			StatusCode: statusCode,
-		})
+		}, s.afterFunc)
 	}
+	trace.mark("after-hooks")
+	return methodSpec.info.Name
+}
+
+// isEmptyStruct returns true if t is a struct type without fields.
+func isEmptyStruct(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.NumField() == 0
+}
+
+// methodFromPath returns the method in the URL path of r, if the server is
+// set to read it from there.
+func (s *Server) methodFromPath(r *http.Request) (string, bool) {
+	if s.methodPathPrefix == "" || !strings.HasPrefix(r.URL.Path, s.methodPathPrefix) {
+		return "", false
+	}
+	method := strings.TrimPrefix(r.URL.Path, s.methodPathPrefix)
+	return method, method != ""
+}
+
+// methodFromHeader returns the method in the header of r, if the server is
+// set to read it from there.
+func (s *Server) methodFromHeader(r *http.Request) (string, bool) {
+	if s.methodHeader == "" {
+		return "", false
+	}
+	method := r.Header.Get(s.methodHeader)
+	return method, method != ""
+}
+
+// selectCodec returns the codec registered for the request Content-Type, or
+// the fallback codec if there is none, which may be nil. The media type used for the lookup is returned too.
+func (s *Server) selectCodec(r *http.Request) (Codec, string) {
+	contentType := r.Header.Get("Content-Type")
+	if s.strictContentType {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, contentType
+		}
+		return s.codecs[mediaType], mediaType
+	}
+	idx := strings.Index(contentType, ";")
+	if idx != -1 {
+		contentType = contentType[:idx]
+	}
+	if contentType == "" && len(s.codecs) == 1 {
+		// If Content-Type is not set and only one codec has been registered,
+		// then default to that codec.
+		for _, c := range s.codecs {
+			return c, contentType
+		}
+	}
+	if codec, ok := s.codecs[strings.ToLower(contentType)]; ok {
+		return codec, contentType
+	}
+	return s.fallbackCodec, contentType
+}
+
+// logf writes a message to the configured logger.
+func (s *Server) logf(format string, v ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, v...)
+		return
+	}
+	log.Printf(format, v...)
 }
 
 func WriteError(w http.ResponseWriter, status int, msg string) {
@@ -273,3 +1150,57 @@ func WriteError(w http.ResponseWriter, status int, msg string) {
 	w.WriteHeader(status)
 	fmt.Fprint(w, msg)
 }
+
+// streamResponseWriter is the http.ResponseWriter passed to streaming
+// methods, recording whether they wrote a response.
+type streamResponseWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *streamResponseWriter) WriteHeader(status int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *streamResponseWriter) Write(p []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data to the client, if the underlying
+// ResponseWriter supports it.
+func (w *streamResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// errorRecordingWriter is an http.ResponseWriter recording the first error
+// returned by the underlying ResponseWriter.
+type errorRecordingWriter struct {
+	http.ResponseWriter
+	err error
+}
+
+func (w *errorRecordingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it supports it, for
+// streaming methods.
+func (w *errorRecordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *errorRecordingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -7,13 +7,29 @@ package rpc
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/token"
+	"go/types"
 	"io"
 	"log"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -396,3 +412,3564 @@ func TestValidationFails(t *testing.T) {
 		t.Errorf("Response body was %s, should be %s.", w.Body, expected)
 	}
 }
+
+func TestMethodFromContext(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+
+	var (
+		method string
+		ok     bool
+	)
+	outer := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, found := s.MethodFromContext(r.Context()); found {
+				t.Error("Expected no method before the server resolved it")
+			}
+			next.ServeHTTP(w, r)
+			method, ok = s.MethodFromContext(r.Context())
+		})
+	}
+
+	r, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock")
+	w := NewMockResponseWriter()
+	s.Handler(outer).ServeHTTP(w, r)
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if !ok || method != "Service1.Multiply" {
+		t.Errorf("Method was %q (%v), should be %q.", method, ok, "Service1.Multiply")
+	}
+
+	// Requests served directly carry no method.
+	if _, found := s.MethodFromContext(r.Context()); found {
+		t.Error("Expected no method for a request not served through Handler")
+	}
+}
+
+func TestStrictContentType(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterCodec(MockCodec{2, 3}, "mock")
+	s.SetStrictContentType(true)
+
+	tests := []struct {
+		contentType string
+		status      int
+	}{
+		{"mock", 200},
+		{"mock; charset=utf-8", 200},
+		{"unregistered", 415},
+		{"", 415},
+		{"mock;;", 415},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest("POST", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != tt.status {
+			t.Errorf("Content-Type %q: status was %d, should be %d.", tt.contentType, w.Status, tt.status)
+		}
+	}
+}
+
+// MockJSONCodec decodes a body with the shape {"method": ..., "params": ...}
+// and writes the JSON encoded reply.
+type MockJSONCodec struct {
+}
+
+func (c MockJSONCodec) NewRequest(r *http.Request) CodecRequest {
+	req := new(MockJSONCodecRequest)
+	if r.Body == nil {
+		req.err = errors.New("mock: empty body")
+		return req
+	}
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		req.err = err
+		return req
+	}
+	r.Body.Close()
+	req.err = json.Unmarshal(b, req)
+	r.Body = io.NopCloser(bytes.NewBuffer(b))
+	return req
+}
+
+type MockJSONCodecRequest struct {
+	M   string          `json:"method"`
+	P   json.RawMessage `json:"params"`
+	err error
+}
+
+func (r *MockJSONCodecRequest) Method() (string, error) {
+	return r.M, r.err
+}
+
+func (r *MockJSONCodecRequest) ReadRequest(args interface{}) error {
+	if r.P == nil {
+		return nil
+	}
+	return json.Unmarshal(r.P, args)
+}
+
+func (r *MockJSONCodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func (r *MockJSONCodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
+	w.WriteHeader(status)
+	if _, er := w.Write([]byte(err.Error())); er != nil {
+		log.Fatal(er)
+	}
+}
+
+// serveMockJSON calls method on s through MockJSONCodec, which must be
+// registered for the "mock/json" content type.
+func serveMockJSON(t *testing.T, s *Server, method string, params interface{}) *MockResponseWriter {
+	b, err := json.Marshal(map[string]interface{}{"method": method, "params": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock/json")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestRegisterHealthCheck(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterHealthCheck("Cache", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterHealthCheck("Database", func() error { return errors.New("connection refused") }); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method string
+		reply  HealthCheckReply
+	}{
+		{"Cache.Check", HealthCheckReply{Status: HealthStatusOK}},
+		{"Database.Check", HealthCheckReply{Status: HealthStatusFailing, Error: "connection refused"}},
+	}
+	for _, tt := range tests {
+		w := serveMockJSON(t, s, tt.method, nil)
+		if w.Status != 200 {
+			t.Errorf("%s: status was %d, should be 200.", tt.method, w.Status)
+		}
+		var reply HealthCheckReply
+		if err := json.Unmarshal([]byte(w.Body), &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply != tt.reply {
+			t.Errorf("%s: reply was %+v, should be %+v.", tt.method, reply, tt.reply)
+		}
+	}
+}
+
+type SlowRequest struct {
+	Millis int
+}
+
+type SlowService struct {
+}
+
+// Wait waits for the requested time unless the request context is done first.
+func (t *SlowService) Wait(r *http.Request, req *SlowRequest, res *Service1Response) error {
+	select {
+	case <-time.After(time.Duration(req.Millis) * time.Millisecond):
+		res.Result = req.Millis
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+func serveWithDeadline(t *testing.T, s *Server, wait int, deadline string) *MockResponseWriter {
+	b, err := json.Marshal(map[string]interface{}{"method": "SlowService.Wait", "params": SlowRequest{wait}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock/json")
+	r.Header.Set(DeadlineHeader, deadline)
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestDeadlineHeader(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(SlowService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveWithDeadline(t, s, 5000, "10")
+	if w.Status != http.StatusGatewayTimeout {
+		t.Errorf("Status was %d, should be %d.", w.Status, http.StatusGatewayTimeout)
+	}
+	if w.Body != ErrDeadlineExceeded.Error() {
+		t.Errorf("Response body was %q, should be %q.", w.Body, ErrDeadlineExceeded.Error())
+	}
+
+	w = serveWithDeadline(t, s, 1, "5000")
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+
+	w = serveWithDeadline(t, s, 1, "soon")
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	// The server maximum clamps the requested deadline.
+	s.SetMaxDeadline(10 * time.Millisecond)
+	w = serveWithDeadline(t, s, 5000, "60000")
+	if w.Status != http.StatusGatewayTimeout {
+		t.Errorf("Status was %d, should be %d.", w.Status, http.StatusGatewayTimeout)
+	}
+}
+
+type AggregateReply struct {
+	Items []int
+}
+
+func (r *AggregateReply) PartialResult() bool {
+	return len(r.Items) > 0
+}
+
+type AggregateService struct {
+}
+
+// Collect appends an item per millisecond until it has req.Millis items or
+// the request context is done.
+func (t *AggregateService) Collect(r *http.Request, req *SlowRequest, res *AggregateReply) error {
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for i := 0; i < req.Millis; i++ {
+		select {
+		case <-ticker.C:
+			res.Items = append(res.Items, i)
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+	return nil
+}
+
+func TestPartialResult(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(AggregateService), ""); err != nil {
+		t.Fatal(err)
+	}
+	var afterErr error
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		afterErr = i.Error
+	})
+
+	b, err := json.Marshal(map[string]interface{}{"method": "AggregateService.Collect", "params": SlowRequest{100000}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, "POST", "", bytes.NewBuffer(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock/json")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w.Header().Get("Warning") == "" {
+		t.Error("Expected a Warning header for the partial result")
+	}
+	var reply AggregateReply
+	if err := json.Unmarshal([]byte(w.Body), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Items) == 0 || len(reply.Items) >= 100000 {
+		t.Errorf("Expected a partial result, but got %d items", len(reply.Items))
+	}
+	if afterErr != ErrDeadlineExceeded {
+		t.Errorf("After function error was %v, should be %v.", afterErr, ErrDeadlineExceeded)
+	}
+
+	// An empty reply isn't a partial result.
+	w = serveMockJSON(t, s, "AggregateService.Collect", SlowRequest{0})
+	if w.Status != 200 || w.Header().Get("Warning") != "" {
+		t.Errorf("Expected a complete result, but got status %d and warning %q", w.Status, w.Header().Get("Warning"))
+	}
+}
+
+// MockLogger records the messages written to it.
+type MockLogger struct {
+	Messages []string
+}
+
+func (l *MockLogger) Printf(format string, v ...interface{}) {
+	l.Messages = append(l.Messages, fmt.Sprintf(format, v...))
+}
+
+func TestNestedServices(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(Service1), "Math.Calc"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Math.Calc.Multiply") {
+		t.Error("Expected to be registered: Math.Calc.Multiply")
+	}
+	if s.HasMethod("Calc.Multiply") || s.HasMethod("Math.Multiply") {
+		t.Error("Expected nested service methods to require the full path")
+	}
+	for _, name := range []string{".Calc", "Math.", "Math..Calc"} {
+		if err := s.RegisterService(new(Service1), name); err == nil {
+			t.Errorf("Expected error registering service %q", name)
+		}
+	}
+}
+
+func TestNamespaceCollision(t *testing.T) {
+	tests := []struct {
+		name  string
+		first string
+		then  string
+	}{
+		{"method then service", "Calc", "Calc.Multiply"},
+		{"service then method", "Calc.Multiply", "Calc"},
+	}
+	for _, tt := range tests {
+		// Warning by default.
+		logger := new(MockLogger)
+		s := NewServer()
+		s.SetLogger(logger)
+		if err := s.RegisterService(new(Service1), tt.first); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RegisterService(new(Service1), tt.then); err != nil {
+			t.Errorf("%s: expected the collision to be allowed, but got %v", tt.name, err)
+		}
+		if len(logger.Messages) != 1 || !strings.Contains(logger.Messages[0], "collides") {
+			t.Errorf("%s: expected a collision warning, but got %q", tt.name, logger.Messages)
+		}
+
+		// Error in strict mode.
+		s = NewServer()
+		s.SetLogger(logger)
+		s.SetStrictNamespace(true)
+		if err := s.RegisterService(new(Service1), tt.first); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.RegisterService(new(Service1), tt.then); err == nil {
+			t.Errorf("%s: expected a collision error", tt.name)
+		}
+		if s.HasMethod(tt.then + ".Multiply") {
+			t.Errorf("%s: expected the colliding service not to be registered", tt.name)
+		}
+	}
+}
+
+func TestWalkServices(t *testing.T) {
+	s := NewServer()
+	for _, name := range []string{"Math.Calc", "Math.Calc.Fast", "Status", "Math.Stats.Calc"} {
+		if err := s.RegisterService(new(Service1), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	type node struct {
+		path string
+		info ServiceInfo
+	}
+	var visited []node
+	s.WalkServices(func(path string, info ServiceInfo) {
+		visited = append(visited, node{path, info})
+	})
+
+	multiply := []string{"Multiply"}
+	expected := []node{
+		{"Math", ServiceInfo{Name: "Math", Children: 2}},
+		{"Math.Calc", ServiceInfo{Name: "Calc", Methods: multiply, Children: 1}},
+		{"Math.Calc.Fast", ServiceInfo{Name: "Fast", Methods: multiply}},
+		{"Math.Stats", ServiceInfo{Name: "Stats", Children: 1}},
+		{"Math.Stats.Calc", ServiceInfo{Name: "Calc", Methods: multiply}},
+		{"Status", ServiceInfo{Name: "Status", Methods: multiply}},
+	}
+	if !reflect.DeepEqual(visited, expected) {
+		t.Errorf("Visited %+v, should be %+v.", visited, expected)
+	}
+}
+
+func TestDefaultService(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), "Default"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveMockJSON(t, s, "Multiply", Service1Request{2, 3})
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	s.SetDefaultService("Default")
+	if !s.HasMethod("Multiply") {
+		t.Error("Expected Multiply to resolve to Default.Multiply")
+	}
+	w = serveMockJSON(t, s, "Multiply", Service1Request{2, 3})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response body was %q, should be %q.", w.Body, "{\"Result\":6}\n")
+	}
+}
+
+type temporaryError struct {
+}
+
+func (e temporaryError) Error() string   { return "backend unavailable" }
+func (e temporaryError) Temporary() bool { return true }
+
+type FlakyReply struct {
+	Attempts []int
+}
+
+type FlakyService struct {
+	calls    int
+	failures int
+}
+
+// Do fails with a temporary error the first t.failures calls.
+func (t *FlakyService) Do(r *http.Request, req *Service1Request, res *FlakyReply) error {
+	t.calls++
+	res.Attempts = append(res.Attempts, t.calls)
+	if t.calls <= t.failures {
+		return temporaryError{}
+	}
+	return nil
+}
+
+func TestMethodRetry(t *testing.T) {
+	flaky := &FlakyService{failures: 2}
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(flaky, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodRetry("FlakyService.Missing", 3, 0); err == nil {
+		t.Error("Expected error setting a retry on a missing method")
+	}
+	if err := s.SetMethodRetry("FlakyService.Do", 3, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	// The reply is reset between attempts.
+	if w.Body != "{\"Attempts\":[3]}\n" {
+		t.Errorf("Response body was %q, should be %q.", w.Body, "{\"Attempts\":[3]}\n")
+	}
+
+	// Attempts are exhausted.
+	flaky.calls, flaky.failures = 0, 5
+	w = serveMockJSON(t, s, "FlakyService.Do", Service1Request{})
+	if w.Status != 400 || flaky.calls != 3 {
+		t.Errorf("Expected status 400 after 3 calls, but got %d after %d", w.Status, flaky.calls)
+	}
+}
+
+func TestServiceTimeout(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(SlowService), "A.B.C"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetServiceTimeout("A", time.Minute)
+	s.SetServiceTimeout("A.B", 10*time.Millisecond)
+
+	// A.B.C.Wait inherits the timeout of A.B, the nearest one.
+	w := serveMockJSON(t, s, "A.B.C.Wait", SlowRequest{5000})
+	if w.Status != http.StatusGatewayTimeout {
+		t.Errorf("Status was %d, should be %d.", w.Status, http.StatusGatewayTimeout)
+	}
+
+	// The method timeout takes precedence.
+	if err := s.SetMethodTimeout("A.B.C.Wait", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	w = serveMockJSON(t, s, "A.B.C.Wait", SlowRequest{20})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if err := s.SetMethodTimeout("A.B.C.Missing", time.Minute); err == nil {
+		t.Error("Expected error setting a timeout on a missing method")
+	}
+}
+
+type EchoRequest struct {
+	Text string
+}
+
+type EchoService struct {
+}
+
+func (t *EchoService) Echo(r *http.Request, req *EchoRequest, res *EchoRequest) error {
+	res.Text = req.Text
+	return nil
+}
+
+func TestBodyLogging(t *testing.T) {
+	logger := new(MockLogger)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBodyLogging(true, func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte("hunter2"), []byte("***"))
+	})
+
+	w := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"password hunter2"})
+	// The handler receives the original body.
+	if w.Body != "{\"Text\":\"password hunter2\"}\n" {
+		t.Errorf("Response body was %q, should echo the original text.", w.Body)
+	}
+	if len(logger.Messages) != 2 {
+		t.Fatalf("Expected 2 log messages, but got %q", logger.Messages)
+	}
+	if !strings.HasPrefix(logger.Messages[0], "rpc: request body: ") || !strings.Contains(logger.Messages[0], `"password ***"`) {
+		t.Errorf("Wrong request log message: %q", logger.Messages[0])
+	}
+	if logger.Messages[1] != "rpc: response body: {\"Text\":\"password ***\"}\n" {
+		t.Errorf("Wrong response log message: %q", logger.Messages[1])
+	}
+
+	s.SetBodyLogging(false, nil)
+	serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"password hunter2"})
+	if len(logger.Messages) != 2 {
+		t.Errorf("Expected no more log messages, but got %q", logger.Messages[2:])
+	}
+}
+
+func TestBodyLoggingMaxBodyBytes(t *testing.T) {
+	logger := new(MockLogger)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetBodyLogging(true, nil)
+	s.SetMaxBodyBytes(1000)
+
+	w := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{Text: strings.Repeat("x", 5000)})
+	if w.Status != 413 {
+		t.Errorf("Status was %d, should be 413: %s", w.Status, w.Body)
+	}
+	// The body is only read up to the limit to be logged.
+	for _, message := range logger.Messages {
+		if strings.HasPrefix(message, "rpc: request body: ") && len(message) > 1100 {
+			t.Errorf("Logged a request body of %d bytes, should stop at the limit", len(message))
+		}
+	}
+}
+
+func TestResponseTap(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	var methods, bodies []string
+	s.SetResponseTap(func(method string, body []byte) {
+		methods = append(methods, method)
+		bodies = append(bodies, string(body))
+	})
+
+	ok := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"hello"})
+	failed := serveMockJSON(t, s, "EchoService.Missing", EchoRequest{"hello"})
+	if expected := []string{"EchoService.Echo", "EchoService.Missing"}; !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Tapped methods were %q, should be %q.", methods, expected)
+	}
+	if expected := []string{ok.Body, failed.Body}; !reflect.DeepEqual(bodies, expected) {
+		t.Errorf("Tapped bodies were %q, should be the client ones %q.", bodies, expected)
+	}
+}
+
+func TestMethodPrefixStrip(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), "Users"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasMethod("v1.Users.Echo") {
+		t.Error("Expected v1.Users.Echo not to resolve without a prefix strip")
+	}
+
+	s.SetMethodPrefixStrip("v1.")
+	for _, method := range []string{"v1.Users.Echo", "Users.Echo"} {
+		w := serveMockJSON(t, s, method, EchoRequest{"hi"})
+		if w.Status != 200 {
+			t.Errorf("%s: status was %d, should be 200.", method, w.Status)
+		}
+	}
+}
+
+func TestSetMethodEnabled(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodEnabled("EchoService.Missing", false); err == nil {
+		t.Error("Expected error disabling a missing method")
+	}
+
+	if err := s.SetMethodEnabled("EchoService.Echo", false); err != nil {
+		t.Fatal(err)
+	}
+	w := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"hi"})
+	if w.Status != 400 || w.Body != `rpc: can't find method "EchoService.Echo"` {
+		t.Errorf("Expected a not found error, but got %d: %q", w.Status, w.Body)
+	}
+	if s.HasMethod("EchoService.Echo") {
+		t.Error("Expected a disabled method not to be reported")
+	}
+	// Disabled methods can still be configured.
+	if err := s.RequireContentType("EchoService.Echo", "mock/json"); err != nil {
+		t.Errorf("Expected a disabled method to be configurable, got %v", err)
+	}
+
+	if err := s.SetMethodEnabled("EchoService.Echo", true); err != nil {
+		t.Fatal(err)
+	}
+	w = serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"hi"})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+type CaseService struct {
+}
+
+func (t *CaseService) Echo(r *http.Request, req *EchoRequest, res *EchoRequest) error {
+	return nil
+}
+
+func (t *CaseService) ECHO(r *http.Request, req *EchoRequest, res *EchoRequest) error {
+	return nil
+}
+
+func TestMethodNameTransform(t *testing.T) {
+	s := NewServer()
+	s.SetMethodNameTransform(strings.ToLower)
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("EchoService.echo") || s.HasMethod("EchoService.Echo") {
+		t.Error("Expected to be registered only as: EchoService.echo")
+	}
+
+	err := s.RegisterService(new(CaseService), "")
+	if err == nil || !strings.Contains(err.Error(), `same name "echo"`) {
+		t.Errorf("Expected a duplicate method error, but got %v", err)
+	}
+	if s.HasMethod("CaseService.echo") {
+		t.Error("Expected CaseService not to be registered")
+	}
+
+	s.SetMethodNameTransform(func(string) string { return "a.b" })
+	if err := s.RegisterService(new(Service1), ""); err == nil {
+		t.Error("Expected an invalid method name error")
+	}
+}
+
+func TestReset(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetServiceTimeout("EchoService", time.Nanosecond)
+	var afterCalls int
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		afterCalls++
+	})
+
+	s.Reset()
+	if s.HasMethod("EchoService.Echo") {
+		t.Error("Expected no methods after Reset")
+	}
+	var nodes int
+	s.WalkServices(func(string, ServiceInfo) { nodes++ })
+	if nodes != 0 {
+		t.Errorf("Expected no services after Reset, but got %d", nodes)
+	}
+
+	// A fresh registration works, without the previous settings and hooks.
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	w := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"hi"})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if afterCalls != 0 {
+		t.Errorf("Expected the after function to be removed, but it was called %d times", afterCalls)
+	}
+}
+
+func TestOnUnknownMethod(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	var unknown []string
+	s.OnUnknownMethod(func(method string, r *http.Request) {
+		if r == nil {
+			t.Error("Expected the request to be passed")
+		}
+		unknown = append(unknown, method)
+	})
+
+	serveMockJSON(t, s, "EchoService.Echo", EchoRequest{"hi"})
+	serveMockJSON(t, s, "EchoService.Removed", EchoRequest{"hi"})
+	w := serveMockJSON(t, s, "Legacy.Echo", EchoRequest{"hi"})
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	expected := []string{"EchoService.Removed", "Legacy.Echo"}
+	if !reflect.DeepEqual(unknown, expected) {
+		t.Errorf("Unknown methods were %q, should be %q.", unknown, expected)
+	}
+}
+
+func TestRespondToHead(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+
+	r, err := http.NewRequest("HEAD", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != http.StatusMethodNotAllowed {
+		t.Errorf("Status was %d, should be %d.", w.Status, http.StatusMethodNotAllowed)
+	}
+
+	s.SetRespondToHead(true)
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w.Body != "" {
+		t.Errorf("Response body was %q, should be empty.", w.Body)
+	}
+}
+
+func TestSnapshotServices(t *testing.T) {
+	s := NewServer()
+	for _, name := range []string{"Math.Calc", "Status"} {
+		if err := s.RegisterService(new(Service1), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot := s.SnapshotServices()
+	if err := s.UnregisterService("Math.Calc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UnregisterService("Math.Calc"); err == nil {
+		t.Error("Expected error unregistering a missing service")
+	}
+	if s.HasMethod("Math.Calc.Multiply") {
+		t.Error("Expected Math.Calc.Multiply to be unregistered")
+	}
+
+	// The snapshot is unaffected.
+	if snapshot.Len() != 3 {
+		t.Errorf("Snapshot has %d nodes, should have 3.", snapshot.Len())
+	}
+	info, ok := snapshot.Lookup("Math.Calc")
+	if !ok || !reflect.DeepEqual(info.Methods, []string{"Multiply"}) {
+		t.Errorf("Snapshot node Math.Calc was %+v (%v), should have method Multiply.", info, ok)
+	}
+	info.Methods[0] = "Changed"
+	if info, _ := snapshot.Lookup("Math.Calc"); info.Methods[0] != "Multiply" {
+		t.Error("Expected the snapshot to be immutable")
+	}
+	var paths []string
+	snapshot.Walk(func(path string, info ServiceInfo) {
+		paths = append(paths, path)
+	})
+	if expected := []string{"Math", "Math.Calc", "Status"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Snapshot paths were %q, should be %q.", paths, expected)
+	}
+
+	if s.SnapshotServices().Len() != 1 {
+		t.Errorf("New snapshot has %d nodes, should have 1.", s.SnapshotServices().Len())
+	}
+}
+
+type ExportService struct {
+}
+
+type ExportArgs struct {
+	Rows int
+}
+
+func (e *ExportService) CSV(r *http.Request, args *ExportArgs, w http.ResponseWriter) error {
+	if args.Rows < 0 {
+		return errors.New("negative rows")
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	var b strings.Builder
+	b.WriteString("a,b\n")
+	for i := 1; i <= args.Rows; i++ {
+		fmt.Fprintf(&b, "%d,%d\n", i, i*2)
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func TestStreamingMethod(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(ExportService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveMockJSON(t, s, "ExportService.CSV", ExportArgs{Rows: 1})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type was %q, should be text/csv.", ct)
+	}
+	if w.Body != "a,b\n1,2\n" {
+		t.Errorf("Response body was %q, should be the CSV file.", w.Body)
+	}
+
+	w = serveMockJSON(t, s, "ExportService.CSV", ExportArgs{Rows: -1})
+	if w.Status != 400 || w.Body != "negative rows" {
+		t.Errorf("Response was %d %q, should be the error.", w.Status, w.Body)
+	}
+}
+
+type FlushService struct {
+}
+
+func (f *FlushService) Chunks(r *http.Request, args *Service1Request, w http.ResponseWriter) error {
+	io.WriteString(w, "first\n")
+	w.(http.Flusher).Flush()
+	_, err := io.WriteString(w, "second\n")
+	return err
+}
+
+// serveFlush calls FlushService.Chunks, returning the recorded response.
+func serveFlush(t *testing.T, s *Server) *httptest.ResponseRecorder {
+	r, err := http.NewRequest("POST", "", strings.NewReader(`{"method":"FlushService.Chunks","params":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "mock/json")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestStreamingFlush(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(FlushService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetWriteErrorHandler(func(method string, err error) {
+		t.Errorf("Unexpected write error for %s: %v", method, err)
+	})
+	if w := serveFlush(t, s); !w.Flushed || w.Body.String() != "first\nsecond\n" {
+		t.Errorf("With a write error handler, response was %q and flushed %v, should be flushed", w.Body, w.Flushed)
+	}
+
+	var tapped string
+	s.SetResponseTap(func(method string, body []byte) {
+		tapped = string(body)
+	})
+	s.SetBodyLogging(true, nil)
+	if w := serveFlush(t, s); !w.Flushed || w.Body.String() != "first\nsecond\n" {
+		t.Errorf("With body logging and a response tap, response was %q and flushed %v, should be flushed", w.Body, w.Flushed)
+	}
+	if tapped != "first\nsecond\n" {
+		t.Errorf("Tapped %q, should tap the streamed response", tapped)
+	}
+}
+
+type CountService struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (c *CountService) Get(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	atomic.AddInt32(&c.calls, 1)
+	<-c.release
+	reply.Result = args.A * args.B
+	return nil
+}
+
+// AbortOnceService aborts its first call once released.
+type AbortOnceService struct {
+	calls   int32
+	release chan struct{}
+}
+
+func (a *AbortOnceService) Get(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	if atomic.AddInt32(&a.calls, 1) == 1 {
+		<-a.release
+		panic(http.ErrAbortHandler)
+	}
+	reply.Result = args.A * args.B
+	return nil
+}
+
+func TestCoalesce(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := &CountService{release: make(chan struct{})}
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCoalesce("CountService.Get"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCoalesce("CountService.Missing"); err == nil {
+		t.Error("Expected error coalescing a missing method")
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	responses := make([]*MockResponseWriter, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = serveMockJSON(t, s, "CountService.Get", Service1Request{A: 2, B: 3})
+		}(i)
+	}
+	// Wait for the first call to run, and give the others time to join it.
+	for atomic.LoadInt32(&service.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(service.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&service.calls); calls != 1 {
+		t.Errorf("Method was called %d times, should be called once.", calls)
+	}
+	for i, w := range responses {
+		if w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+			t.Errorf("Response %d was %d %q, should be the shared reply.", i, w.Status, w.Body)
+		}
+	}
+}
+
+func TestCoalesceAbort(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := &AbortOnceService{release: make(chan struct{})}
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCoalesce("AbortOnceService.Get"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("Recovered %v, should be http.ErrAbortHandler.", v)
+			}
+		}()
+		serveMockJSON(t, s, "AbortOnceService.Get", Service1Request{A: 2, B: 3})
+	}()
+	for atomic.LoadInt32(&service.calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	var w *MockResponseWriter
+	go func() {
+		defer wg.Done()
+		w = serveMockJSON(t, s, "AbortOnceService.Get", Service1Request{A: 2, B: 3})
+	}()
+	// Give the second call time to join the first.
+	time.Sleep(50 * time.Millisecond)
+	close(service.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&service.calls); calls != 2 {
+		t.Errorf("Method was called %d times, should be called again after the abort.", calls)
+	}
+	if w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %d %q, should be the reply of the second call.", w.Status, w.Body)
+	}
+}
+
+func TestEnableStats(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableStats(); err == nil {
+		t.Error("Expected error enabling stats twice")
+	}
+
+	readStats := func() StatsReply {
+		w := serveMockJSON(t, s, "system.stats", StatsArgs{})
+		var reply StatsReply
+		if err := json.Unmarshal([]byte(w.Body), &reply); err != nil {
+			t.Fatalf("Unexpected system.stats response %d %q: %v", w.Status, w.Body, err)
+		}
+		return reply
+	}
+	for i := 0; i < 3; i++ {
+		serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: i, B: 2})
+	}
+	if calls := readStats().Methods["Service1.Multiply"].Calls; calls != 3 {
+		t.Errorf("Service1.Multiply had %d calls, should have 3.", calls)
+	}
+	serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 1, B: 2})
+	stats := readStats()
+	if calls := stats.Methods["Service1.Multiply"].Calls; calls != 4 {
+		t.Errorf("Service1.Multiply had %d calls, should have 4.", calls)
+	}
+	if calls := stats.Methods["system.stats"].Calls; calls != 1 {
+		t.Errorf("system.stats had %d calls, should have 1.", calls)
+	}
+
+	// Calls are recorded under the canonical method name.
+	s.SetLenientMethodNames(true)
+	serveMockJSON(t, s, " Service1.Multiply. ", Service1Request{A: 1, B: 2})
+	serveMockJSON(t, s, "Service1.Missing", Service1Request{A: 1, B: 2})
+	stats = readStats()
+	if calls := stats.Methods["Service1.Multiply"].Calls; calls != 5 || len(stats.Methods) != 2 {
+		t.Errorf("Stats were %+v, should have 5 calls of Service1.Multiply.", stats.Methods)
+	}
+}
+
+func TestStatsSizes(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	var requestBytes, responseBytes int
+	for _, size := range []int{100, 300} {
+		b, _ := json.Marshal(map[string]interface{}{"method": "EchoService.Echo", "params": EchoRequest{Text: strings.Repeat("x", size)}})
+		r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+		r.Header.Set("Content-Type", "mock/json")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		requestBytes += len(b)
+		responseBytes += len(w.Body)
+	}
+	// Unknown methods aren't recorded.
+	serveMockJSON(t, s, "EchoService.Missing", StatsArgs{})
+
+	w := serveMockJSON(t, s, "system.stats", StatsArgs{})
+	var reply StatsReply
+	if err := json.Unmarshal([]byte(w.Body), &reply); err != nil {
+		t.Fatal(err)
+	}
+	stats := reply.Methods["EchoService.Echo"]
+	if stats.AvgRequestBytes != int64(requestBytes/2) {
+		t.Errorf("Average request size was %d, should be %d.", stats.AvgRequestBytes, requestBytes/2)
+	}
+	if stats.AvgResponseBytes != int64(responseBytes/2) || stats.AvgResponseBytes < 200 {
+		t.Errorf("Average response size was %d, should be %d.", stats.AvgResponseBytes, responseBytes/2)
+	}
+	if _, ok := reply.Methods["EchoService.Missing"]; ok {
+		t.Error("Expected no stats for an unknown method")
+	}
+}
+
+func TestMethodMaxBodyBytes(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(EchoService), "Upload"); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMaxBodyBytes(1000)
+	if err := s.SetMethodMaxBodyBytes("EchoService.Echo", 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodMaxBodyBytes("Upload.Echo", 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodMaxBodyBytes("EchoService.Missing", 100); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+
+	tests := []struct {
+		method string
+		size   int
+		status int
+	}{
+		{"EchoService.Echo", 10, 200},
+		{"EchoService.Echo", 500, 413},
+		{"EchoService.Echo", 3000, 413},
+		{"Upload.Echo", 3000, 200},
+		{"Upload.Echo", 6000, 413},
+	}
+	for _, tt := range tests {
+		w := serveMockJSON(t, s, tt.method, EchoRequest{Text: strings.Repeat("x", tt.size)})
+		if w.Status != tt.status {
+			t.Errorf("%s with %d bytes: status was %d, should be %d: %s", tt.method, tt.size, w.Status, tt.status, w.Body)
+		}
+	}
+}
+
+func TestAlwaysHTTP200(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(ActionService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMaxBodyBytes(200)
+
+	w := serveMockJSON(t, s, "ActionService.Fail", Service1Request{})
+	if w.Status != 400 {
+		t.Errorf("Status was %d, should be 400 by default", w.Status)
+	}
+
+	s.SetAlwaysHTTP200(true)
+	w = serveMockJSON(t, s, "ActionService.Fail", Service1Request{})
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200", w.Status)
+	}
+	if w.Body != "failed" {
+		t.Errorf("Body was %q, should hold the error", w.Body)
+	}
+	w = serveMockJSON(t, s, "ActionService.Missing", Service1Request{})
+	if w.Status != 200 {
+		t.Errorf("Status of an unknown method was %d, should be 200", w.Status)
+	}
+	w = serveMockJSON(t, s, "ActionService.Do", map[string]string{"A": strings.Repeat("x", 300)})
+	if w.Status != 413 {
+		t.Errorf("Status of a body too large was %d, should stay 413", w.Status)
+	}
+
+	// Streaming methods can flush the response.
+	rec := httptest.NewRecorder()
+	ok := &okStatusWriter{ResponseWriter: rec}
+	if err := http.NewResponseController(ok).Flush(); err != nil || !rec.Flushed {
+		t.Errorf("Flushing returned %v, should flush the response", err)
+	}
+	if ok.Unwrap() != rec {
+		t.Error("Unwrap should return the underlying ResponseWriter")
+	}
+}
+
+func TestSetDebug(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.EnableStats(); err != nil {
+		t.Fatal(err)
+	}
+	serve := func() *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", strings.NewReader(`{"method":"system.echo","params":{"A":2,"b":[true]}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock/json")
+		r.Header.Set("X-Client", "mobile/1.2")
+		r.Header.Set("Authorization", "Bearer secret")
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	if w := serve(); w.Status != 400 {
+		t.Errorf("Status was %d, system.echo should be disabled by default", w.Status)
+	}
+
+	if err := s.SetDebug(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetDebug(true); err != nil {
+		t.Errorf("Expected enabling debug twice to succeed, got %v", err)
+	}
+	w := serve()
+	if w.Status != 200 {
+		t.Fatalf("Status was %d, should be 200: %s", w.Status, w.Body)
+	}
+	var res EchoReply
+	if err := json.Unmarshal([]byte(w.Body), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Method != "system.echo" {
+		t.Errorf("Method was %q, should be system.echo", res.Method)
+	}
+	if string(res.Params) != `{"A":2,"b":[true]}` {
+		t.Errorf("Params were %s", res.Params)
+	}
+	if got := res.Headers.Get("X-Client"); got != "mobile/1.2" {
+		t.Errorf("X-Client header was %q", got)
+	}
+	if got := res.Headers.Get("Authorization"); got != "" {
+		t.Errorf("Authorization header was %q, should be hidden", got)
+	}
+	if !s.HasMethod("system.stats") {
+		t.Error("Expected system.stats to be kept")
+	}
+
+	if err := s.SetDebug(false); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(); w.Status != 400 {
+		t.Errorf("Status was %d, system.echo should be disabled", w.Status)
+	}
+}
+
+func TestSetDebugWhileServing(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 50; i++ {
+			if err := s.SetDebug(i%2 == 0); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		serveMockJSON(t, s, "system.echo", struct{}{})
+	}
+	<-done
+	if err := s.SetDebug(false); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.services.services); n != 0 {
+		t.Errorf("%d services are left once debug is disabled, should be none", n)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	durations := make([]time.Duration, 200)
+	for i := range durations {
+		durations[i] = time.Duration(i+1) * time.Millisecond
+	}
+	tests := []struct {
+		p        int
+		expected time.Duration
+	}{
+		{50, 100 * time.Millisecond},
+		{90, 180 * time.Millisecond},
+		{99, 198 * time.Millisecond},
+	}
+	for _, test := range tests {
+		if d := percentile(durations, test.p); d != test.expected {
+			t.Errorf("Percentile %d was %v, should be %v.", test.p, d, test.expected)
+		}
+	}
+	if d := percentile(nil, 50); d != 0 {
+		t.Errorf("Percentile of no durations was %v, should be 0.", d)
+	}
+}
+
+type AccountService struct {
+}
+
+func (a *AccountService) Get(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func (a *AccountService) Delete(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func TestMethodFilter(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	s.SetMethodFilter(func(goName string, m reflect.Method) bool {
+		return goName != "Delete"
+	})
+	if err := s.RegisterService(new(AccountService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("AccountService.Get") || s.HasMethod("AccountService.Delete") {
+		t.Error("Expected to be registered only: AccountService.Get")
+	}
+	if w := serveMockJSON(t, s, "AccountService.Delete", Service1Request{}); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	s.SetMethodFilter(func(string, reflect.Method) bool { return false })
+	if err := s.RegisterService(new(Service1), ""); err == nil {
+		t.Error("Expected error registering a service without methods")
+	}
+}
+
+func TestListMethods(t *testing.T) {
+	s := NewServer()
+	for _, name := range []string{"Users", "Users.Admin", "UsersLegacy", "Billing"} {
+		if err := s.RegisterService(new(AccountService), name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.SetMethodEnabled("Billing.Delete", false); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"", []string{"Billing.Get", "Users.Admin.Delete", "Users.Admin.Get", "Users.Delete", "Users.Get", "UsersLegacy.Delete", "UsersLegacy.Get"}},
+		{"Users.", []string{"Users.Admin.Delete", "Users.Admin.Get", "Users.Delete", "Users.Get"}},
+		{"Users.Admin.", []string{"Users.Admin.Delete", "Users.Admin.Get"}},
+		{"Billing.", []string{"Billing.Get"}},
+		{"Orders.", nil},
+	}
+	for _, test := range tests {
+		if methods := s.ListMethodsByPrefix(test.prefix); !reflect.DeepEqual(methods, test.expected) {
+			t.Errorf("Methods with prefix %q were %q, should be %q.", test.prefix, methods, test.expected)
+		}
+	}
+	if methods := s.ListMethods(); !reflect.DeepEqual(methods, tests[0].expected) {
+		t.Errorf("Methods were %q, should be %q.", methods, tests[0].expected)
+	}
+}
+
+type SessionService struct {
+	user string
+	seen int
+}
+
+func (s *SessionService) Whoami(r *http.Request, args *struct{}, reply *string) error {
+	s.seen++
+	*reply = fmt.Sprintf("%s %d", s.user, s.seen)
+	return nil
+}
+
+func TestRegisterServiceFactory(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	var created int
+	err := s.RegisterServiceFactory("", func(r *http.Request) interface{} {
+		created++
+		return &SessionService{user: r.Header.Get("X-User")}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterServiceFactory("Nil", func(r *http.Request) interface{} { return nil }); err == nil {
+		t.Error("Expected error registering a factory returning nil")
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		b, _ := json.Marshal(map[string]interface{}{"method": "SessionService.Whoami", "params": struct{}{}})
+		r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+		r.Header.Set("Content-Type", "mock/json")
+		r.Header.Set("X-User", user)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		// Each call gets a fresh receiver.
+		if expected := fmt.Sprintf("%q\n", user+" 1"); w.Body != expected {
+			t.Errorf("Response body was %q, should be %q.", w.Body, expected)
+		}
+	}
+	// One sample receiver at registration, then one per call.
+	if created != 3 {
+		t.Errorf("Factory was called %d times, should be called 3 times.", created)
+	}
+}
+
+func TestRequireContentType(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	s.RegisterCodec(MockJSONCodec{}, "application/x-protobuf")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireContentType("Service1.Multiply", "application/x-protobuf"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireContentType("Service1.Missing", "application/x-protobuf"); err == nil {
+		t.Error("Expected error requiring a content type for a missing method")
+	}
+
+	w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3})
+	if w.Status != http.StatusUnsupportedMediaType {
+		t.Errorf("Status was %d, should be 415.", w.Status)
+	}
+	if expected := `rpc: method "Service1.Multiply" requires Content-Type application/x-protobuf`; w.Body != expected {
+		t.Errorf("Response body was %q, should be %q.", w.Body, expected)
+	}
+
+	b, _ := json.Marshal(map[string]interface{}{"method": "Service1.Multiply", "params": Service1Request{A: 2, B: 3}})
+	r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	r.Header.Set("Content-Type", "application/x-protobuf; proto=Service1Request")
+	w = NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+type ContextService struct {
+}
+
+type ContextReply struct {
+	User        string
+	HasDeadline bool
+}
+
+type contextUserKey struct{}
+
+func (c *ContextService) Whoami(ctx context.Context, args *struct{}, reply *ContextReply) error {
+	reply.User, _ = ctx.Value(contextUserKey{}).(string)
+	_, reply.HasDeadline = ctx.Deadline()
+	return nil
+}
+
+func TestContextMethod(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(ContextService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodTimeout("ContextService.Whoami", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterInterceptFunc(func(i *RequestInfo) *http.Request {
+		return i.Request.WithContext(context.WithValue(i.Request.Context(), contextUserKey{}, "alice"))
+	})
+
+	w := serveMockJSON(t, s, "ContextService.Whoami", struct{}{})
+	if expected := "{\"User\":\"alice\",\"HasDeadline\":true}\n"; w.Status != 200 || w.Body != expected {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, expected)
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := &CountService{release: make(chan struct{})}
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetMaxInFlight(2)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveMockJSON(t, s, "CountService.Get", Service1Request{A: 2, B: 3})
+		}()
+	}
+	for atomic.LoadInt32(&service.calls) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	w := serveMockJSON(t, s, "CountService.Get", Service1Request{A: 2, B: 3})
+	if w.Status != http.StatusServiceUnavailable {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+	close(service.release)
+	wg.Wait()
+
+	w = serveMockJSON(t, s, "CountService.Get", Service1Request{A: 2, B: 3})
+	if w.Status != 200 {
+		t.Errorf("Status was %d once the calls returned, should be 200.", w.Status)
+	}
+	if calls := atomic.LoadInt32(&service.calls); calls != 3 {
+		t.Errorf("Method was called %d times, should be called 3 times.", calls)
+	}
+}
+
+func TestCallMiddleware(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := &CountService{release: make(chan struct{})}
+	close(service.release)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	cache := map[Service1Request]Service1Response{{A: 2, B: 3}: {Result: 42}}
+	var order []string
+	s.Use(func(info *RequestInfo) (bool, error) {
+		order = append(order, "flags")
+		if info.Args.(*Service1Request).A < 0 {
+			return false, errors.New("negative operands disabled")
+		}
+		return false, nil
+	}, func(info *RequestInfo) (bool, error) {
+		order = append(order, "cache")
+		cached, ok := cache[*info.Args.(*Service1Request)]
+		if ok {
+			*info.Reply.(*Service1Response) = cached
+		}
+		return ok, nil
+	})
+
+	tests := []struct {
+		args     Service1Request
+		status   int
+		body     string
+		calls    int32
+		upToFlag bool
+	}{
+		{Service1Request{A: 2, B: 3}, 200, "{\"Result\":42}\n", 0, false},
+		{Service1Request{A: 2, B: 4}, 200, "{\"Result\":8}\n", 1, false},
+		{Service1Request{A: -1, B: 4}, 400, "negative operands disabled", 1, true},
+	}
+	for _, test := range tests {
+		order = nil
+		w := serveMockJSON(t, s, "CountService.Get", test.args)
+		if w.Status != test.status || w.Body != test.body {
+			t.Errorf("Response to %v was %d %q, should be %d %q.", test.args, w.Status, w.Body, test.status, test.body)
+		}
+		if calls := atomic.LoadInt32(&service.calls); calls != test.calls {
+			t.Errorf("Method was called %d times after %v, should be called %d times.", calls, test.args, test.calls)
+		}
+		expected := []string{"flags", "cache"}
+		if test.upToFlag {
+			expected = expected[:1]
+		}
+		if !reflect.DeepEqual(order, expected) {
+			t.Errorf("Middleware called for %v were %q, should be %q.", test.args, order, expected)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := &FlakyService{failures: 3}
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetCircuitBreaker("FlakyService.Do", BreakerConfig{FailureRate: 0, MinCalls: 1}); err == nil {
+		t.Error("Expected error setting an invalid circuit breaker")
+	}
+	if err := s.SetCircuitBreaker("FlakyService.Do", BreakerConfig{FailureRate: 0.5, MinCalls: 2, Cooldown: 50 * time.Millisecond}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two failed calls open the breaker.
+	for i := 0; i < 2; i++ {
+		if w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{}); w.Status != 400 {
+			t.Errorf("Status was %d, should be 400.", w.Status)
+		}
+	}
+	w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{})
+	if w.Status != http.StatusServiceUnavailable || w.Body != ErrCircuitOpen.Error() {
+		t.Errorf("Response was %d %q, should fail fast.", w.Status, w.Body)
+	}
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be called twice.", service.calls)
+	}
+
+	// The trial call after the cooldown fails, opening the breaker again.
+	time.Sleep(60 * time.Millisecond)
+	if w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{}); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+	if w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{}); w.Status != http.StatusServiceUnavailable {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+
+	// The next trial call succeeds, closing the breaker.
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if w := serveMockJSON(t, s, "FlakyService.Do", Service1Request{}); w.Status != 200 {
+			t.Errorf("Status was %d, should be 200.", w.Status)
+		}
+	}
+	if service.calls != 5 {
+		t.Errorf("Method was called %d times, should be called 5 times.", service.calls)
+	}
+}
+
+type StubService struct {
+}
+
+func (t *StubService) Parse(r *http.Request, args *string, reply *time.Time) error {
+	return nil
+}
+
+func (t *StubService) Window(r *http.Request, args *struct {
+	Start time.Time `json:"start"`
+	Steps []int
+}, reply *map[string]time.Duration) error {
+	return nil
+}
+
+type stubArgs struct {
+}
+
+type HiddenService struct {
+}
+
+func (t *HiddenService) Get(r *http.Request, args *[]stubArgs, reply *string) error {
+	return nil
+}
+
+func TestGenerateClientStub(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(StubService), "Stub.V1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(ExportService), ""); err != nil {
+		t.Fatal(err)
+	}
+	src, err := s.GenerateClientStub("client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"func (c *Client) StubV1Parse(ctx context.Context, args *string) (*time.Time, error) {",
+		"func (c *Client) StubV1Window(ctx context.Context, args *struct {\n\tStart time.Time `json:\"start\"`\n\tSteps []int\n}) (*map[string]time.Duration, error) {",
+	} {
+		if !bytes.Contains(src, []byte(expected)) {
+			t.Errorf("Expected the client stub to contain %q:\n%s", expected, src)
+		}
+	}
+	if bytes.Contains(src, []byte("ExportService")) {
+		t.Errorf("Expected streaming methods to be skipped:\n%s", src)
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "client.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := types.Config{Importer: importer.ForCompiler(fset, "source", nil)}
+	if _, err := conf.Check("client", fset, []*ast.File{f}, nil); err != nil {
+		t.Errorf("Client stub doesn't compile: %v\n%s", err, src)
+	}
+
+	if err := s.RegisterService(new(HiddenService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GenerateClientStub("client"); err == nil || !strings.Contains(err.Error(), "not exported") {
+		t.Errorf("Expected an unexported type error, but got %v", err)
+	}
+}
+
+func TestRegisterSchema(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	argsType := reflect.TypeOf(Service1Request{})
+	replyType := reflect.TypeOf(Service1Response{})
+	if err := s.RegisterSchema("Remote.Math.Multiply", argsType, replyType); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterSchema("Remote.Math.Add", reflect.PtrTo(argsType), reflect.PtrTo(replyType)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterSchema("Remote.Math.Add", argsType, replyType); err == nil {
+		t.Error("Expected error registering a method twice")
+	}
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterSchema("Service1.Divide", argsType, replyType); err == nil {
+		t.Error("Expected error adding a schema-only method to a service with a receiver")
+	}
+	if !s.HasMethod("Remote.Math.Multiply") || !s.HasMethod("Remote.Math.Add") {
+		t.Error("Expected to be registered: Remote.Math.Multiply and Remote.Math.Add")
+	}
+
+	w := serveMockJSON(t, s, "Remote.Math.Multiply", Service1Request{A: 2, B: 3})
+	if expected := `rpc: no forwarder for "Remote.Math.Multiply"`; w.Status != 400 || w.Body != expected {
+		t.Errorf("Response was %d %q, should be 400 %q.", w.Status, w.Body, expected)
+	}
+
+	var forwarded []string
+	s.SetForwarder(func(r *http.Request, method string, args, reply interface{}) error {
+		forwarded = append(forwarded, method)
+		req := args.(*Service1Request)
+		reply.(*Service1Response).Result = req.A * req.B
+		return nil
+	})
+	w = serveMockJSON(t, s, "Remote.Math.Multiply", Service1Request{A: 2, B: 3})
+	if expected := "{\"Result\":6}\n"; w.Status != 200 || w.Body != expected {
+		t.Errorf("Response was %d %q, should be 200 %q.", w.Status, w.Body, expected)
+	}
+	serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3})
+	if !reflect.DeepEqual(forwarded, []string{"Remote.Math.Multiply"}) {
+		t.Errorf("Forwarded methods were %q, should be only Remote.Math.Multiply.", forwarded)
+	}
+}
+
+func TestRegisterSchemaWhileServing(t *testing.T) {
+	s := NewServer()
+	argsType := reflect.TypeOf(Service1Request{})
+	replyType := reflect.TypeOf(Service1Response{})
+	if err := s.RegisterSchema("Remote.Method0", argsType, replyType); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i < 100; i++ {
+			if err := s.RegisterSchema(fmt.Sprintf("Remote.Method%d", i), argsType, replyType); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if !s.HasMethod("Remote.Method0") {
+			t.Fatal("Expected Remote.Method0 to stay registered")
+		}
+		s.SnapshotServices()
+	}
+	<-done
+	if methods := s.ListMethods(); len(methods) != 100 {
+		t.Errorf("%d methods were registered, should be 100", len(methods))
+	}
+}
+
+type TreeNode struct {
+	Value    int
+	Left     *TreeNode
+	Right    *TreeNode
+	Meta     *TreeMeta
+	Children []*TreeNode
+}
+
+type TreeMeta struct {
+	Label string
+	Owner *TreeNode
+}
+
+type TreeService struct {
+}
+
+// Sum returns the sum of the values of the tree, checking that the metadata
+// of the root was allocated.
+func (t *TreeService) Sum(r *http.Request, args *TreeNode, reply *int) error {
+	if args.Meta == nil {
+		return errors.New("meta not allocated")
+	}
+	var sum func(n *TreeNode) int
+	sum = func(n *TreeNode) int {
+		if n == nil {
+			return 0
+		}
+		total := n.Value + sum(n.Left) + sum(n.Right)
+		for _, child := range n.Children {
+			total += sum(child)
+		}
+		return total
+	}
+	*reply = sum(args)
+	return nil
+}
+
+func TestAllocateNestedPointers(t *testing.T) {
+	var root TreeNode
+	allocateNestedPointers(reflect.ValueOf(&root).Elem(), make(map[reflect.Type]bool))
+	if root.Meta == nil || root.Left != nil || root.Right != nil || root.Meta.Owner != nil {
+		t.Errorf("Only the metadata should be allocated: %+v", root)
+	}
+
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(TreeService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetAllocateNestedPointers(true)
+	tree := map[string]interface{}{
+		"Value": 1,
+		"Left": map[string]interface{}{
+			"Value": 2,
+			"Left":  map[string]interface{}{"Value": 3},
+		},
+		"Children": []interface{}{map[string]interface{}{"Value": 4}},
+	}
+	w := serveMockJSON(t, s, "TreeService.Sum", tree)
+	if w.Status != 200 || w.Body != "10\n" {
+		t.Errorf("Response was %d %q, should be 200 \"10\\n\".", w.Status, w.Body)
+	}
+}
+
+func TestCallMiddlewareReceiver(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	err := s.RegisterServiceFactory("", func(r *http.Request) interface{} {
+		return &SessionService{user: "alice"}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var users []string
+	s.Use(func(info *RequestInfo) (bool, error) {
+		rcvr := info.Receiver.(*SessionService)
+		users = append(users, rcvr.user)
+		rcvr.seen = 10
+		return false, nil
+	})
+
+	w := serveMockJSON(t, s, "SessionService.Whoami", struct{}{})
+	// The method sees the change made by the middleware.
+	if expected := "\"alice 11\"\n"; w.Body != expected {
+		t.Errorf("Response body was %q, should be %q.", w.Body, expected)
+	}
+	if !reflect.DeepEqual(users, []string{"alice"}) {
+		t.Errorf("Middleware read the users %q, should read alice.", users)
+	}
+}
+
+type PanicService struct{}
+
+func (s *PanicService) Risky(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic("risky")
+}
+
+func (s *PanicService) Safe(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic("safe")
+}
+
+func (s *PanicService) Abort(r *http.Request, req *Service1Request, res *Service1Response) error {
+	panic(http.ErrAbortHandler)
+}
+
+func TestPanicStatus(t *testing.T) {
+	logger := new(MockLogger)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(PanicService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPanicStatus("PanicService.Risky", 0); err == nil {
+		t.Error("Expected error setting an invalid status")
+	}
+	if err := s.SetPanicStatus("PanicService.Missing", 503); err == nil {
+		t.Error("Expected error setting the status of an unknown method")
+	}
+	if err := s.SetPanicStatus("PanicService.Risky", http.StatusServiceUnavailable); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveMockJSON(t, s, "PanicService.Risky", Service1Request{})
+	if w.Status != http.StatusServiceUnavailable {
+		t.Errorf("Status was %d, should be 503.", w.Status)
+	}
+	if w.Body != "rpc: method panicked" {
+		t.Errorf("Response body was %q, should report the panic without its value.", w.Body)
+	}
+	if w := serveMockJSON(t, s, "PanicService.Safe", Service1Request{}); w.Status != http.StatusInternalServerError {
+		t.Errorf("Status was %d, should be 500.", w.Status)
+	}
+	if len(logger.Messages) != 2 || !strings.Contains(logger.Messages[0], `panic serving "PanicService.Risky": risky`) {
+		t.Errorf("Logged %q, should log the panic values.", logger.Messages)
+	}
+
+	// Aborting the handler isn't recovered.
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("Recovered %v, should be http.ErrAbortHandler.", v)
+		}
+	}()
+	serveMockJSON(t, s, "PanicService.Abort", Service1Request{})
+	t.Error("Expected the handler to be aborted")
+}
+
+func TestRegisterServiceIf(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterServiceIf(false, new(AccountService), "Users.Admin"); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(s.services.services); n != 0 {
+		t.Errorf("%d services were created, should be none.", n)
+	}
+	if methods := s.ListMethods(); len(methods) != 0 {
+		t.Errorf("Methods were %q, should be none.", methods)
+	}
+
+	if err := s.RegisterServiceIf(true, new(AccountService), "Users"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Users.Get") {
+		t.Error("Expected the service to be registered")
+	}
+}
+
+func TestRegisterAll(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterAll(map[string]interface{}{
+		"Math":    new(Service1),
+		"Empty":   new(EmptyReply),
+		"Numbers": 42,
+	})
+	if err == nil {
+		t.Fatal("Expected an error for the invalid services")
+	}
+	message := err.Error()
+	for _, name := range []string{`"Empty"`, `"Numbers"`} {
+		if !strings.Contains(message, name) {
+			t.Errorf("Error %q should report the service %s", message, name)
+		}
+	}
+	if strings.Contains(message, `"Math"`) {
+		t.Errorf("Error %q should not report the valid service", message)
+	}
+	if !s.HasMethod("Math.Multiply") {
+		t.Error("Expected the valid service to be registered")
+	}
+
+	if err := s.RegisterAll(map[string]interface{}{"Other": new(Service1)}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+}
+
+type PoolService struct {
+	initErr error
+	inits   int
+	closes  int
+}
+
+func (s *PoolService) Init() error {
+	s.inits++
+	return s.initErr
+}
+
+func (s *PoolService) Close() error {
+	s.closes++
+	return nil
+}
+
+func (s *PoolService) Get(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func TestServiceLifecycle(t *testing.T) {
+	s := NewServer()
+	pool := new(PoolService)
+	if err := s.RegisterService(pool, "Pool"); err != nil {
+		t.Fatal(err)
+	}
+	if pool.inits != 1 || pool.closes != 0 {
+		t.Errorf("Init and Close were called %d and %d times, should be 1 and 0", pool.inits, pool.closes)
+	}
+	if methods := s.ListMethods(); !reflect.DeepEqual(methods, []string{"Pool.Get"}) {
+		t.Errorf("Methods were %q, the lifecycle methods should be left out", methods)
+	}
+	if err := AssertRegisterable(pool); err != nil {
+		t.Errorf("Expected the lifecycle methods to be accepted, got %v", err)
+	}
+
+	// A service rejected after Init is closed.
+	other := new(PoolService)
+	if err := s.RegisterService(other, "Pool"); err == nil {
+		t.Error("Expected an error for a duplicate service")
+	}
+	if other.inits != 1 || other.closes != 1 {
+		t.Errorf("Rejected service: Init and Close were called %d and %d times, should be 1 and 1", other.inits, other.closes)
+	}
+
+	if err := s.UnregisterService("Pool"); err != nil {
+		t.Fatal(err)
+	}
+	if pool.closes != 1 {
+		t.Errorf("Close was called %d times on unregister, should be 1", pool.closes)
+	}
+
+	failing := &PoolService{initErr: errors.New("no connection")}
+	if err := s.RegisterService(failing, "Failing"); err == nil || !errors.Is(err, failing.initErr) {
+		t.Errorf("Expected the Init error, got %v", err)
+	}
+	if s.HasMethod("Failing.Get") {
+		t.Error("Expected the service failing to init not to be registered")
+	}
+
+	first, second := new(PoolService), new(PoolService)
+	if err := s.RegisterService(first, "First"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(second, "Second"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if first.closes != 1 || second.closes != 1 {
+		t.Errorf("Close was called %d and %d times on shutdown, should be 1", first.closes, second.closes)
+	}
+	if methods := s.ListMethods(); len(methods) != 0 {
+		t.Errorf("Methods were %q after shutdown, should be none", methods)
+	}
+
+	// Swapped receivers are initialized and closed.
+	old, swapped := new(PoolService), new(PoolService)
+	if err := s.RegisterService(old, "Pool"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SwapReceiver("Pool", &PoolService{initErr: errors.New("no connection")}); err == nil {
+		t.Error("Expected the Init error of the new receiver")
+	}
+	if err := s.SwapReceiver("Pool", swapped); err != nil {
+		t.Fatal(err)
+	}
+	if old.closes != 1 || swapped.inits != 1 || swapped.closes != 0 {
+		t.Errorf("Swapping: Close of the old receiver was called %d times, Init and Close of the new one %d and %d times, should be 1, 1 and 0", old.closes, swapped.inits, swapped.closes)
+	}
+	if err := s.UnregisterService("Pool"); err != nil || swapped.closes != 1 {
+		t.Errorf("Unregister returned %v and closed the swapped receiver %d times, should close it once", err, swapped.closes)
+	}
+}
+
+type ShardService struct {
+	calls int
+}
+
+func (s *ShardService) Work(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	s.calls++
+	return nil
+}
+
+func TestRegisterReplicas(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	shards := []*ShardService{new(ShardService), new(ShardService), new(ShardService)}
+	if err := s.RegisterReplicas("Shards", []interface{}{shards[0], shards[1], shards[2]}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if w := serveMockJSON(t, s, "Shards.Work", Service1Request{}); w.Status != 200 {
+			t.Fatalf("Status was %d, should be 200: %s", w.Status, w.Body)
+		}
+	}
+	for i, shard := range shards {
+		expected := 2
+		if i == 0 {
+			expected = 3
+		}
+		if shard.calls != expected {
+			t.Errorf("Replica %d got %d calls, should get %d", i, shard.calls, expected)
+		}
+	}
+	if err := s.SwapReceiver("Shards", new(ShardService)); err == nil {
+		t.Error("Expected an error swapping the receiver of replicas")
+	}
+
+	if err := s.RegisterReplicas("Empty", nil); err == nil {
+		t.Error("Expected an error for no receivers")
+	}
+	if err := s.RegisterReplicas("Mixed", []interface{}{new(ShardService), new(Service1)}); err == nil {
+		t.Error("Expected an error for receivers of different types")
+	}
+	if s.HasMethod("Mixed.Work") {
+		t.Error("Expected the invalid replicas not to be registered")
+	}
+
+	// Weighted replicas get calls in proportion to their weights.
+	weighted := []*ShardService{new(ShardService), new(ShardService)}
+	if err := s.RegisterWeightedReplicas("Weighted", []interface{}{weighted[0], weighted[1]}, []int{6, 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		serveMockJSON(t, s, "Weighted.Work", Service1Request{})
+		if i == 3 && weighted[1].calls != 1 {
+			t.Errorf("The light replica got %d of the first 4 calls, should get 1", weighted[1].calls)
+		}
+	}
+	if weighted[0].calls != 6 || weighted[1].calls != 2 {
+		t.Errorf("Weighted replicas got %d and %d calls, should get 6 and 2", weighted[0].calls, weighted[1].calls)
+	}
+	if err := s.RegisterWeightedReplicas("Unweighted", []interface{}{new(ShardService)}, nil); err == nil {
+		t.Error("Expected an error for missing weights")
+	}
+	if err := s.RegisterWeightedReplicas("Unweighted", []interface{}{new(ShardService)}, []int{0}); err == nil {
+		t.Error("Expected an error for a zero weight")
+	}
+
+	pools := []*PoolService{new(PoolService), new(PoolService)}
+	if err := s.RegisterReplicas("Pools", []interface{}{pools[0], pools[1]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UnregisterService("Pools"); err != nil {
+		t.Fatal(err)
+	}
+	for i, pool := range pools {
+		if pool.inits != 1 || pool.closes != 1 {
+			t.Errorf("Replica %d: Init and Close were called %d and %d times, should be 1", i, pool.inits, pool.closes)
+		}
+	}
+}
+
+type UnorderedService struct{}
+
+func (s *UnorderedService) Zeta(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func (s *UnorderedService) Mid(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func (s *UnorderedService) Alpha(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	return nil
+}
+
+func TestMethodRegistrationOrder(t *testing.T) {
+	s := NewServer()
+	var order []string
+	s.SetMethodFilter(func(goName string, m reflect.Method) bool {
+		order = append(order, goName)
+		return true
+	})
+	if err := s.RegisterService(new(UnorderedService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"Alpha", "Mid", "Zeta"}; !reflect.DeepEqual(order, expected) {
+		t.Errorf("Methods were registered in order %q, should be %q.", order, expected)
+	}
+
+	// Name collisions are reported for the first methods by name.
+	s = NewServer()
+	s.SetMethodNameTransform(func(string) string { return "Same" })
+	err := s.RegisterService(new(UnorderedService), "")
+	if expected := `rpc: methods "Alpha" and "Mid" of "UnorderedService" have the same name "Same"`; err == nil || err.Error() != expected {
+		t.Errorf("Error was %v, should be %q.", err, expected)
+	}
+}
+
+type ActionService struct{}
+
+type EmptyReply struct{}
+
+func (s *ActionService) Do(r *http.Request, args *Service1Request, reply *EmptyReply) error {
+	return nil
+}
+
+func (s *ActionService) Fail(r *http.Request, args *Service1Request, reply *EmptyReply) error {
+	return errors.New("failed")
+}
+
+func TestEmptyReplyStatus(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(ActionService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serveMockJSON(t, s, "ActionService.Do", Service1Request{}); w.Status != 200 || w.Body != "{}\n" {
+		t.Errorf("Response was %d %q, should be the empty reply.", w.Status, w.Body)
+	}
+
+	s.SetEmptyReplyStatus(http.StatusNoContent)
+	if w := serveMockJSON(t, s, "ActionService.Do", Service1Request{}); w.Status != http.StatusNoContent || w.Body != "" {
+		t.Errorf("Response was %d %q, should be 204 without body.", w.Status, w.Body)
+	}
+	if w := serveMockJSON(t, s, "ActionService.Fail", Service1Request{}); w.Status != 400 || w.Body != "failed" {
+		t.Errorf("Response was %d %q, should be the error.", w.Status, w.Body)
+	}
+	if w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3}); w.Status != 200 || w.Body == "" {
+		t.Errorf("Response was %d %q, should be the reply.", w.Status, w.Body)
+	}
+}
+
+func TestTenantBudget(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(SlowService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetTenantHeader("X-Customer")
+	s.SetTenantBudget("acme", TenantBudget{Time: 30 * time.Millisecond, Window: 200 * time.Millisecond})
+	serve := func(tenant string) *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", strings.NewReader(`{"method": "SlowService.Wait", "params": {"Millis": 20}}`))
+		r.Header.Set("Content-Type", "mock/json")
+		r.Header.Set("X-Customer", tenant)
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	// Two calls use up the budget.
+	for i := 0; i < 2; i++ {
+		if w := serve("acme"); w.Status != 200 {
+			t.Errorf("Status was %d, should be 200.", w.Status)
+		}
+	}
+	w := serve("acme")
+	if w.Status != http.StatusTooManyRequests || w.Body != ErrBudgetExceeded.Error() {
+		t.Errorf("Response was %d %q, should be throttled.", w.Status, w.Body)
+	}
+
+	// Other tenants aren't throttled.
+	if w := serve("globex"); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+
+	// The budget is available again once the window elapsed.
+	time.Sleep(200 * time.Millisecond)
+	if w := serve("acme"); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+
+	s.SetTenantBudget("acme", TenantBudget{})
+	for i := 0; i < 3; i++ {
+		if w := serve("acme"); w.Status != 200 {
+			t.Errorf("Status was %d, should be 200 without budget.", w.Status)
+		}
+	}
+}
+
+type VersionService struct {
+	version int
+}
+
+func (v *VersionService) Get(r *http.Request, args *Service1Request, reply *Service1Response) error {
+	reply.Result = v.version
+	return nil
+}
+
+func TestSwapReceiver(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(&VersionService{version: 1}, "Version"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodTimeout("Version.Get", time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveMockJSON(t, s, "Version.Get", Service1Request{}); w.Body != "{\"Result\":1}\n" {
+		t.Errorf("Response body was %q, should come from the first receiver.", w.Body)
+	}
+
+	if err := s.SwapReceiver("Version", &VersionService{version: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serveMockJSON(t, s, "Version.Get", Service1Request{}); w.Body != "{\"Result\":2}\n" {
+		t.Errorf("Response body was %q, should come from the new receiver.", w.Body)
+	}
+	if _, methodSpec, _ := s.services.lookup("Version.Get"); methodSpec.timeout != time.Second {
+		t.Error("Expected the method settings to be kept")
+	}
+
+	if err := s.SwapReceiver("Version", new(Service1)); err == nil {
+		t.Error("Expected error swapping a receiver of another type")
+	}
+	if err := s.SwapReceiver("Missing", &VersionService{}); err == nil {
+		t.Error("Expected error swapping the receiver of an unknown service")
+	}
+}
+
+func TestRequireVersion(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(Service1), "Service1.V2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireVersion("Service1", 3, 1); err == nil {
+		t.Error("Expected error setting an invalid range")
+	}
+	if err := s.RequireVersion("Missing", 1, 3); err == nil {
+		t.Error("Expected error setting the range of an unknown service")
+	}
+	if err := s.RequireVersion("Service1", 2, 3); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(method, version string) *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", strings.NewReader(`{"method": "`+method+`", "params": {"A": 2, "B": 3}}`))
+		r.Header.Set("Content-Type", "mock/json")
+		if version != "" {
+			r.Header.Set(VersionHeader, version)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	tests := []struct {
+		method  string
+		version string
+		status  int
+	}{
+		{"Service1.Multiply", "2", 200},
+		{"Service1.Multiply", "3", 200},
+		{"Service1.Multiply", "1", 400},
+		{"Service1.Multiply", "4", 400},
+		{"Service1.Multiply", "two", 400},
+		{"Service1.Multiply", "", 400},
+		{"Service1.V2.Multiply", "", 200},
+	}
+	for _, test := range tests {
+		if w := serve(test.method, test.version); w.Status != test.status {
+			t.Errorf("Status of %s with version %q was %d, should be %d.", test.method, test.version, w.Status, test.status)
+		}
+	}
+}
+
+func TestServiceMethods(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(AccountService), "Accounts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(ExportService), "Accounts.Export"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodEnabled("Accounts.Delete", false); err != nil {
+		t.Fatal(err)
+	}
+
+	methods, err := s.ServiceMethods("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]MethodInfo{
+		"Get": {Name: "Accounts.Get", ArgsType: "rpc.Service1Request", ReplyType: "rpc.Service1Response"},
+	}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Methods were %v, should be %v.", methods, expected)
+	}
+
+	methods, err = s.ServiceMethods("Accounts.Export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = map[string]MethodInfo{
+		"CSV": {Name: "Accounts.Export.CSV", ArgsType: "rpc.ExportArgs", ReplyType: "http.ResponseWriter"},
+	}
+	if !reflect.DeepEqual(methods, expected) {
+		t.Errorf("Methods were %v, should be %v.", methods, expected)
+	}
+
+	if _, err := s.ServiceMethods("Missing"); err == nil {
+		t.Error("Expected error for an unknown service")
+	}
+}
+
+func TestMethodDelimiter(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	s.SetMethodDelimiter("/")
+	if err := s.RegisterService(new(Service1), "A/B"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(Service1), "A/B.C"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(Service1), "A//B"); err == nil {
+		t.Error("Expected error registering a service with an empty name part")
+	}
+
+	if w := serveMockJSON(t, s, "A/B/Multiply", Service1Request{A: 2, B: 3}); w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %d %q, should be the reply.", w.Status, w.Body)
+	}
+	if w := serveMockJSON(t, s, "A/B.C/Multiply", Service1Request{A: 2, B: 3}); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+	if w := serveMockJSON(t, s, "A/B.Multiply", Service1Request{A: 2, B: 3}); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	var paths []string
+	s.WalkServices(func(path string, info ServiceInfo) {
+		paths = append(paths, path)
+	})
+	if expected := []string{"A", "A/B", "A/B.C"}; !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Paths were %q, should be %q.", paths, expected)
+	}
+	if methods := s.ListMethods(); !reflect.DeepEqual(methods[:1], []string{"A/B.C/Multiply"}) {
+		t.Errorf("Methods were %q, should use the delimiter.", methods)
+	}
+}
+
+type IntrospectService struct{}
+
+func (s *IntrospectService) Self(ctx context.Context, args *Service1Request, reply *MethodInfo) error {
+	info, ok := MethodInfoFromContext(ctx)
+	if !ok {
+		return errors.New("no method info")
+	}
+	*reply = info
+	return nil
+}
+
+func TestMethodInfoFromContext(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(IntrospectService), "Meta"); err != nil {
+		t.Fatal(err)
+	}
+	w := serveMockJSON(t, s, "Meta.Self", Service1Request{})
+	if w.Status != 200 {
+		t.Fatalf("Status was %d, should be 200: %s", w.Status, w.Body)
+	}
+	var info MethodInfo
+	if err := json.Unmarshal([]byte(w.Body), &info); err != nil {
+		t.Fatal(err)
+	}
+	expected := MethodInfo{Name: "Meta.Self", ArgsType: "rpc.Service1Request", ReplyType: "rpc.MethodInfo"}
+	if info != expected {
+		t.Errorf("Method info was %+v, should be %+v.", info, expected)
+	}
+
+	if _, ok := MethodInfoFromContext(context.Background()); ok {
+		t.Error("Expected no method info outside a call")
+	}
+}
+
+type TenantService struct{}
+
+type TenantArgs struct {
+	Name   string
+	Tenant string `header:"X-Tenant"`
+	Limit  int    `cookie:"limit"`
+}
+
+type TenantReply struct {
+	Name   string
+	Tenant string
+	Limit  int
+}
+
+func (s *TenantService) Get(r *http.Request, args *TenantArgs, reply *TenantReply) error {
+	*reply = TenantReply(*args)
+	return nil
+}
+
+type upperBinder struct{}
+
+func (upperBinder) Bind(r *http.Request, args reflect.Value) error {
+	a := args.Interface().(*TenantArgs)
+	a.Name = strings.ToUpper(a.Name)
+	return nil
+}
+
+func TestArgBinder(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(TenantService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetArgBinder(TagBinder{})
+	serve := func(tenant, limit string) *MockResponseWriter {
+		r, _ := http.NewRequest("POST", "", strings.NewReader(`{"method": "TenantService.Get", "params": {"Name": "gopher", "Tenant": "body"}}`))
+		r.Header.Set("Content-Type", "mock/json")
+		if tenant != "" {
+			r.Header.Set("X-Tenant", tenant)
+		}
+		if limit != "" {
+			r.AddCookie(&http.Cookie{Name: "limit", Value: limit})
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("acme", "10"); w.Body != "{\"Name\":\"gopher\",\"Tenant\":\"acme\",\"Limit\":10}\n" {
+		t.Errorf("Response body was %q, should have the bound values.", w.Body)
+	}
+	if w := serve("", ""); w.Body != "{\"Name\":\"gopher\",\"Tenant\":\"body\",\"Limit\":0}\n" {
+		t.Errorf("Response body was %q, should keep the decoded values.", w.Body)
+	}
+	if w := serve("acme", "ten"); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+
+	if err := s.SetMethodArgBinder("TenantService.Get", upperBinder{}); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve("acme", "10"); w.Body != "{\"Name\":\"GOPHER\",\"Tenant\":\"body\",\"Limit\":0}\n" {
+		t.Errorf("Response body was %q, should use the method binder.", w.Body)
+	}
+}
+
+func TestServeWithoutCodecs(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasCodecs() {
+		t.Error("Expected no codecs")
+	}
+	r, _ := http.NewRequest("POST", "", strings.NewReader(`{"method": "Service1.Multiply", "params": {"A": 2, "B": 3}}`))
+	r.Header.Set("Content-Type", "mock/json")
+	w := NewMockResponseWriter()
+	s.ServeHTTP(w, r)
+	if w.Status != http.StatusInternalServerError || w.Body != "rpc: no codec registered, see Server.RegisterCodec" {
+		t.Errorf("Response was %d %q, should report the missing codec.", w.Status, w.Body)
+	}
+
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if !s.HasCodecs() {
+		t.Error("Expected a registered codec")
+	}
+}
+
+type WarmupMockCodec struct {
+	MockJSONCodec
+	warmed map[reflect.Type]bool
+}
+
+func (c WarmupMockCodec) Warmup(argsType, replyType reflect.Type) {
+	c.warmed[argsType] = true
+	c.warmed[replyType] = true
+}
+
+func TestWarmup(t *testing.T) {
+	s := NewServer()
+	codec := WarmupMockCodec{warmed: make(map[reflect.Type]bool)}
+	s.RegisterCodec(codec, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(ExportService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.Warmup()
+
+	for _, v := range []interface{}{Service1Request{}, Service1Response{}, ExportArgs{}} {
+		if typ := reflect.TypeOf(v); !codec.warmed[typ] {
+			t.Errorf("Expected %v to be warmed up", typ)
+		}
+	}
+	if !codec.warmed[nil] {
+		t.Error("Expected a nil reply type for streaming methods")
+	}
+	if w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3}); w.Status != 200 {
+		t.Errorf("Status was %d, should be 200.", w.Status)
+	}
+}
+
+func TestDeprecateMethod(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(new(AccountService), "Accounts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodEnabled("Accounts.Delete", false); err != nil {
+		t.Fatal(err)
+	}
+	deprecation := Deprecation{Since: "v2", Removal: "v3", Replacement: "Accounts.Fetch", Message: "Use Fetch."}
+	if err := s.DeprecateMethod("Accounts.Get", deprecation); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeprecateMethod("Accounts.Missing", deprecation); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+
+	r, _ := http.NewRequest("GET", "/docs", nil)
+	w := NewMockResponseWriter()
+	s.DocsHandler().ServeHTTP(w, r)
+	var docs Docs
+	if err := json.Unmarshal([]byte(w.Body), &docs); err != nil {
+		t.Fatal(err)
+	}
+	expected := Docs{Methods: []MethodInfo{
+		{Name: "Accounts.Get", ArgsType: "rpc.Service1Request", ReplyType: "rpc.Service1Response", Deprecation: &deprecation},
+	}}
+	if !reflect.DeepEqual(docs, expected) {
+		t.Errorf("Docs were %+v, should be %+v.", docs, expected)
+	}
+	if !strings.Contains(w.Body, `"deprecation":{"since":"v2","removal":"v3","replacement":"Accounts.Fetch","message":"Use Fetch."}`) {
+		t.Errorf("Docs should include the deprecation: %s", w.Body)
+	}
+
+	methods, err := s.ServiceMethods("Accounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := methods["Get"].Deprecation; got == nil || *got != deprecation {
+		t.Errorf("Deprecation was %v, should be %v.", got, deprecation)
+	}
+}
+
+func TestLenientMethodNames(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	methods := []string{"Service1.Multiply ", " Service1.Multiply", "Service1.Multiply.", "\tService1.Multiply. \n"}
+	for _, method := range methods {
+		if w := serveMockJSON(t, s, method, Service1Request{A: 2, B: 3}); w.Status != 400 {
+			t.Errorf("%q: status was %d, should be 400 without lenient mode.", method, w.Status)
+		}
+	}
+
+	s.SetLenientMethodNames(true)
+	for _, method := range methods {
+		if w := serveMockJSON(t, s, method, Service1Request{A: 2, B: 3}); w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+			t.Errorf("%q: response was %d %q, should be the reply.", method, w.Status, w.Body)
+		}
+	}
+	// Only a single trailing delimiter is trimmed.
+	if w := serveMockJSON(t, s, "Service1.Multiply..", Service1Request{A: 2, B: 3}); w.Status != 400 {
+		t.Errorf("Status was %d, should be 400.", w.Status)
+	}
+}
+
+func TestDispatchErrors(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(ActionService), ""); err != nil {
+		t.Fatal(err)
+	}
+	var afterErr error
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		afterErr = i.Error
+	})
+
+	w := serveMockJSON(t, s, "ActionService.Fail", Service1Request{})
+	if _, ok := afterErr.(*DispatchError); ok {
+		t.Errorf("Expected the error of the method by default, got %#v", afterErr)
+	}
+	afterErr = nil
+	serveMockJSON(t, s, "ActionService.Fail", map[string]string{"A": "x"})
+	if afterErr != nil {
+		t.Errorf("Expected no After function call for a decode failure by default, got %v", afterErr)
+	}
+
+	s.SetDispatchErrors(true)
+	tests := []struct {
+		method string
+		params interface{}
+		phase  Phase
+		body   string
+	}{
+		{"ActionService.Fail", Service1Request{}, PhaseHandler, w.Body},
+		{"ActionService.Fail", map[string]string{"A": "x"}, PhaseDecode, ""},
+		{"ActionService.Missing", Service1Request{}, PhaseResolve, `rpc: can't find method "ActionService.Missing"`},
+	}
+	for _, tt := range tests {
+		afterErr = nil
+		w := serveMockJSON(t, s, tt.method, tt.params)
+		var dispatchErr *DispatchError
+		if !errors.As(afterErr, &dispatchErr) {
+			t.Errorf("%s: After function error was %#v, should be a *DispatchError", tt.method, afterErr)
+			continue
+		}
+		if dispatchErr.Phase != tt.phase || dispatchErr.Method != tt.method {
+			t.Errorf("%s: error was in phase %v of %q, should be in phase %v", tt.method, dispatchErr.Phase, dispatchErr.Method, tt.phase)
+		}
+		if w.Status != 400 || tt.body != "" && w.Body != tt.body {
+			t.Errorf("%s: response was %d %q, should be the unwrapped error", tt.method, w.Status, w.Body)
+		}
+	}
+	if PhaseDecode.String() != "decode" || Phase(42).String() != "unknown" {
+		t.Errorf("Wrong phase names %q and %q", PhaseDecode, Phase(42))
+	}
+}
+
+func TestRequireCapability(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireCapability("Service1.Multiply", "multiply-v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RequireCapability("Service1.Missing", "multiply-v2"); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+	var unknown []string
+	s.OnUnknownMethod(func(method string, r *http.Request) {
+		unknown = append(unknown, method)
+	})
+	serve := func(capabilities ...string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", strings.NewReader(`{"method":"Service1.Multiply","params":{"A":2,"B":3}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock/json")
+		for _, capability := range capabilities {
+			r.Header.Add(CapabilitiesHeader, capability)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve()
+	if w.Status != 400 || w.Body != `rpc: can't find method "Service1.Multiply"` {
+		t.Errorf("Without the capability, response was %d %q, should be an unknown method", w.Status, w.Body)
+	}
+	w = serve("streaming, other")
+	if w.Status != 400 {
+		t.Errorf("With other capabilities, status was %d, should be 400", w.Status)
+	}
+	if len(unknown) != 2 {
+		t.Errorf("Unknown method calls were %q, should be the two hidden calls", unknown)
+	}
+	listed := func(capability string) bool {
+		r, _ := http.NewRequest("GET", "/docs", nil)
+		if capability != "" {
+			r.Header.Set(CapabilitiesHeader, capability)
+		}
+		w := NewMockResponseWriter()
+		s.DocsHandler().ServeHTTP(w, r)
+		var docs Docs
+		if err := json.Unmarshal([]byte(w.Body), &docs); err != nil {
+			t.Fatal(err)
+		}
+		for _, info := range docs.Methods {
+			if info.Name == "Service1.Multiply" {
+				return true
+			}
+		}
+		return false
+	}
+	if listed("") || !listed("multiply-v2") {
+		t.Error("The docs should only describe the method to the clients with the capability")
+	}
+	if _, ok := s.Snapshot()["Service1.Multiply"]; ok {
+		t.Error("Expected the snapshot to leave out the hidden method")
+	}
+	for _, method := range s.ListMethods() {
+		if method == "Service1.Multiply" {
+			t.Error("Expected ListMethods to leave out the hidden method")
+		}
+	}
+	for _, capabilities := range [][]string{{"multiply-v2"}, {"other, Multiply-V2"}, {"other", "multiply-v2"}} {
+		if w := serve(capabilities...); w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+			t.Errorf("With capabilities %q, response was %d %q, should be the reply", capabilities, w.Status, w.Body)
+		}
+	}
+
+	if err := s.RequireCapability("Service1.Multiply", ""); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(); w.Status != 200 {
+		t.Errorf("Without a required capability, status was %d, should be 200", w.Status)
+	}
+	if !listed("") {
+		t.Error("Expected the docs to describe the method again")
+	}
+}
+
+func TestRequireClientCert(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	var checked []string
+	s.RequireClientCert(func(cert *x509.Certificate, method string) error {
+		checked = append(checked, method)
+		if cert.Subject.CommonName != "billing" {
+			return fmt.Errorf("client %q can't call %s", cert.Subject.CommonName, method)
+		}
+		return nil
+	})
+
+	serve := func(cert *x509.Certificate) *MockResponseWriter {
+		b, _ := json.Marshal(map[string]interface{}{"method": "Service1.Multiply", "params": Service1Request{A: 2, B: 3}})
+		r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+		r.Header.Set("Content-Type", "mock/json")
+		if cert != nil {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve(&x509.Certificate{Subject: pkix.Name{CommonName: "billing"}}); w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %d %q, should be the reply.", w.Status, w.Body)
+	}
+	if w := serve(&x509.Certificate{Subject: pkix.Name{CommonName: "reports"}}); w.Status != 403 || !strings.Contains(w.Body, `client "reports" can't call Service1.Multiply`) {
+		t.Errorf("Response was %d %q, should be the check error.", w.Status, w.Body)
+	}
+	if w := serve(nil); w.Status != 403 || w.Body != ErrClientCertRequired.Error() {
+		t.Errorf("Response was %d %q, should be ErrClientCertRequired.", w.Status, w.Body)
+	}
+
+	// The check is given the canonical method name, not the requested one.
+	s.SetLenientMethodNames(true)
+	b, _ := json.Marshal(map[string]interface{}{"method": " Service1.Multiply. ", "params": Service1Request{A: 2, B: 3}})
+	r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+	r.Header.Set("Content-Type", "mock/json")
+	r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "billing"}}}}
+	s.ServeHTTP(NewMockResponseWriter(), r)
+	if expected := []string{"Service1.Multiply", "Service1.Multiply", "Service1.Multiply"}; !reflect.DeepEqual(checked, expected) {
+		t.Errorf("Checked methods were %q, should be %q.", checked, expected)
+	}
+}
+
+func TestTraceTimings(t *testing.T) {
+	logger := new(MockLogger)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3})
+	if len(logger.Messages) != 0 {
+		t.Fatalf("Expected no trace by default, got %q", logger.Messages)
+	}
+
+	s.SetTraceTimings(true)
+	if w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3}); w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %q, should be the reply.", w.Body)
+	}
+	if len(logger.Messages) != 1 {
+		t.Fatalf("Expected a single trace, got %q", logger.Messages)
+	}
+	message := logger.Messages[0]
+	if !strings.HasPrefix(message, `rpc: trace "Service1.Multiply": `) {
+		t.Errorf("Wrong trace: %q", message)
+	}
+	timings := make(map[string]time.Duration)
+	for _, field := range strings.Fields(message)[3:] {
+		phase, value, ok := strings.Cut(field, "=")
+		if !ok {
+			t.Fatalf("Wrong trace field %q in %q", field, message)
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			t.Fatalf("Wrong duration %q in %q", value, message)
+		}
+		if _, ok := timings[phase]; ok {
+			t.Errorf("Phase %q appears twice in %q", phase, message)
+		}
+		timings[phase] = d
+	}
+	phases := []string{"resolve", "before-hooks", "schema", "decode", "bind", "validate", "handler", "encode", "after-hooks", "total"}
+	if len(timings) != len(phases) {
+		t.Errorf("Trace %q should have the phases %q", message, phases)
+	}
+	for _, phase := range phases {
+		d, ok := timings[phase]
+		if !ok {
+			t.Errorf("Missing phase %q in %q", phase, message)
+		} else if d < 0 {
+			t.Errorf("Negative duration of phase %q in %q", phase, message)
+		}
+	}
+}
+
+func TestRequestLogLevel(t *testing.T) {
+	logger := new(MockLogger)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	serve := func(level string) []string {
+		logger.Messages = nil
+		r, err := http.NewRequest("POST", "", strings.NewReader(`{"method":"Service1.Multiply","params":{"A":2,"B":3}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock/json")
+		if level != "" {
+			r.Header.Set(LogLevelHeader, level)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if w.Status != 200 {
+			t.Fatalf("Status was %d, should be 200", w.Status)
+		}
+		return logger.Messages
+	}
+	isTrace := func(message string) bool {
+		return strings.HasPrefix(message, `rpc: trace "Service1.Multiply": `)
+	}
+
+	if messages := serve("trace"); len(messages) != 0 {
+		t.Errorf("Expected the header to be ignored by default, got %q", messages)
+	}
+
+	s.SetMaxRequestLogLevel(LogLevelTrace)
+	if messages := serve(""); len(messages) != 0 {
+		t.Errorf("Expected no logs without the header, got %q", messages)
+	}
+	messages := serve("TRACE")
+	if len(messages) != 3 || !isTrace(messages[1]) {
+		t.Errorf("Expected the bodies and a trace, got %q", messages)
+	}
+	if messages := serve("verbose"); len(messages) != 0 {
+		t.Errorf("Expected an unknown level to be ignored, got %q", messages)
+	}
+
+	// The level is clamped to the maximum.
+	s.SetMaxRequestLogLevel(LogLevelDebug)
+	messages = serve("trace")
+	if len(messages) != 2 {
+		t.Fatalf("Expected the bodies only, got %q", messages)
+	}
+	for _, message := range messages {
+		if isTrace(message) {
+			t.Errorf("Expected no trace above the maximum level, got %q", message)
+		}
+	}
+}
+
+func TestResponseTransform(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	mask := func(reply interface{}) (interface{}, error) {
+		res := *reply.(*Service1Response)
+		res.Result = -res.Result
+		return &res, nil
+	}
+	enrich := func(reply interface{}) (interface{}, error) {
+		return map[string]interface{}{"Result": reply.(*Service1Response).Result, "Source": "transform"}, nil
+	}
+	if err := s.AddResponseTransform("Service1.Multiply", mask); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddResponseTransform("Service1.Multiply", enrich); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddResponseTransform("Service1.Missing", mask); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+	if err := s.AddResponseTransform("EchoService.Echo", func(reply interface{}) (interface{}, error) {
+		return nil, errors.New("masking failed")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3}); w.Status != 200 || w.Body != "{\"Result\":-6,\"Source\":\"transform\"}\n" {
+		t.Errorf("Response was %d %q, should be the transformed reply.", w.Status, w.Body)
+	}
+	w := serveMockJSON(t, s, "EchoService.Echo", EchoRequest{Text: "secret"})
+	if w.Status != 500 || !strings.Contains(w.Body, "masking failed") || strings.Contains(w.Body, "secret") {
+		t.Errorf("Response was %d %q, should be the transform error.", w.Status, w.Body)
+	}
+}
+
+type CalcService struct {
+}
+
+func (t *CalcService) Multiply(r *http.Request, req *Service1Request, res *EchoRequest) error {
+	res.Text = strconv.Itoa(req.A * req.B)
+	return nil
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	before := NewServer()
+	if err := before.RegisterService(new(Service1), "Calc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := before.RegisterService(new(AccountService), "Accounts"); err != nil {
+		t.Fatal(err)
+	}
+	after := NewServer()
+	if err := after.RegisterService(new(CalcService), "Calc"); err != nil {
+		t.Fatal(err)
+	}
+	if err := after.RegisterService(new(AccountService), "Accounts"); err != nil {
+		t.Fatal(err)
+	}
+	if err := after.SetMethodEnabled("Accounts.Delete", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := after.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := DiffSnapshots(before.Snapshot(), before.Snapshot()); !diff.Empty() {
+		t.Errorf("Expected no changes, got %+v", diff)
+	}
+
+	// Diff against a snapshot saved as JSON.
+	b, err := json.Marshal(before.Snapshot())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved RegistrySnapshot
+	if err := json.Unmarshal(b, &saved); err != nil {
+		t.Fatal(err)
+	}
+	diff := DiffSnapshots(saved, after.Snapshot())
+	expected := RegistryDiff{
+		Added:   []string{"EchoService.Echo"},
+		Removed: []string{"Accounts.Delete"},
+		Changed: []string{"Calc.Multiply"},
+	}
+	if !reflect.DeepEqual(diff, expected) {
+		t.Errorf("Diff was %+v, should be %+v.", diff, expected)
+	}
+}
+
+type CanaryService struct {
+}
+
+func (t *CanaryService) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = -req.A * req.B
+	return nil
+}
+
+func TestRegisterCanary(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterCanary("Service1.Multiply", new(CanaryService), 30); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterCanary("Service1.Multiply", new(CalcService), 30); err == nil {
+		t.Error("Expected an error for a canary with other types")
+	}
+	if err := s.RegisterCanary("Service1.Multiply", new(CanaryService), 101); err == nil {
+		t.Error("Expected an error for an invalid percentage")
+	}
+
+	// Call middleware sees the receiver the method is called on.
+	var receiver interface{}
+	s.Use(func(info *RequestInfo) (bool, error) {
+		receiver = info.Receiver
+		return false, nil
+	})
+	serve := func(key string) string {
+		b, _ := json.Marshal(map[string]interface{}{"method": "Service1.Multiply", "params": Service1Request{A: 2, B: 3}})
+		r, _ := http.NewRequest("POST", "", bytes.NewBuffer(b))
+		r.Header.Set("Content-Type", "mock/json")
+		if key != "" {
+			r.Header.Set(CanaryHeader, key)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		if _, ok := receiver.(*CanaryService); ok != (w.Body == "{\"Result\":-6}\n") {
+			t.Fatalf("Middleware saw receiver %T for response %q", receiver, w.Body)
+		}
+		return w.Body
+	}
+
+	const calls = 2000
+	canary := 0
+	for i := 0; i < calls; i++ {
+		switch body := serve(""); body {
+		case "{\"Result\":-6}\n":
+			canary++
+		case "{\"Result\":6}\n":
+		default:
+			t.Fatalf("Unexpected response %q", body)
+		}
+	}
+	if canary < calls*20/100 || canary > calls*40/100 {
+		t.Errorf("%d of %d calls reached the canary, expected about 30%%.", canary, calls)
+	}
+
+	// Calls with the same key reach the same implementation.
+	canary = 0
+	for i := 0; i < 100; i++ {
+		first := serve("user-" + strconv.Itoa(i))
+		for j := 0; j < 5; j++ {
+			if body := serve("user-" + strconv.Itoa(i)); body != first {
+				t.Fatalf("Key %d routed to %q then %q", i, first, body)
+			}
+		}
+		if first == "{\"Result\":-6}\n" {
+			canary++
+		}
+	}
+	if canary == 0 || canary == 100 {
+		t.Errorf("%d of 100 keys routed to the canary, expected about 30.", canary)
+	}
+
+	if err := s.RegisterCanary("Service1.Multiply", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if body := serve(""); body != "{\"Result\":6}\n" {
+			t.Fatalf("Response was %q after removing the canary", body)
+		}
+	}
+}
+
+type partialReply struct {
+}
+
+type PartialService struct {
+}
+
+func (t *PartialService) Good(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *PartialService) Stream(ctx context.Context, body io.Reader, w http.ResponseWriter) error {
+	return nil
+}
+
+func (t *PartialService) TwoArgs(r *http.Request, req *Service1Request) error {
+	return nil
+}
+
+func (t *PartialService) WrongRequest(r http.Request, req *Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *PartialService) ValueArgs(r *http.Request, req Service1Request, res *Service1Response) error {
+	return nil
+}
+
+func (t *PartialService) HiddenReply(r *http.Request, req *Service1Request, res *partialReply) error {
+	return nil
+}
+
+func (t *PartialService) NoError(r *http.Request, req *Service1Request, res *Service1Response) {
+}
+
+func TestAssertRegisterable(t *testing.T) {
+	if err := AssertRegisterable(new(Service1)); err != nil {
+		t.Errorf("Expected Service1 to be registerable, got %v", err)
+	}
+
+	err := AssertRegisterable(new(PartialService))
+	e, ok := err.(*RegisterableError)
+	if !ok {
+		t.Fatalf("Expected a *RegisterableError, got %T: %v", err, err)
+	}
+	if e.Type != "*rpc.PartialService" {
+		t.Errorf("Type was %q, should be *rpc.PartialService.", e.Type)
+	}
+	expected := map[string]string{
+		"TwoArgs":      "takes 2 arguments instead of 3: the request, the args and the reply",
+		"WrongRequest": "first argument is http.Request instead of *http.Request or context.Context",
+		"ValueArgs":    "args rpc.Service1Request are not a pointer to an exported type nor an io.Reader",
+		"HiddenReply":  "reply *rpc.partialReply is not a pointer to an exported type nor an http.ResponseWriter",
+		"NoError":      "doesn't return a single error",
+	}
+	if !reflect.DeepEqual(e.Methods, expected) {
+		t.Errorf("Methods were %q, should be %q.", e.Methods, expected)
+	}
+	if !strings.HasPrefix(err.Error(), "rpc: methods of *rpc.PartialService won't be registered: HiddenReply reply") {
+		t.Errorf("Wrong error message: %q", err)
+	}
+
+	// The registration skips the same methods.
+	s := NewServer()
+	if err := s.RegisterService(new(PartialService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if methods := s.ListMethods(); !reflect.DeepEqual(methods, []string{"PartialService.Good", "PartialService.Stream"}) {
+		t.Errorf("Registered methods were %q.", methods)
+	}
+}
+
+func TestCaptureExamples(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(EchoService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.SetCaptureExamples(func(b []byte) []byte {
+		return bytes.ReplaceAll(b, []byte("secret"), []byte("*****"))
+	})
+
+	// Failed calls aren't captured.
+	serveMockJSON(t, s, "Service1.Multiply", "bad params")
+	serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3})
+	serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 4, B: 5})
+	serveMockJSON(t, s, "EchoService.Echo", EchoRequest{Text: "my secret"})
+
+	r, _ := http.NewRequest("GET", "/docs", nil)
+	w := NewMockResponseWriter()
+	s.DocsHandler().ServeHTTP(w, r)
+	var docs Docs
+	if err := json.Unmarshal([]byte(w.Body), &docs); err != nil {
+		t.Fatal(err)
+	}
+	examples := make(map[string]string)
+	for _, info := range docs.Methods {
+		if info.Example != nil {
+			examples[info.Name] = string(info.Example.Args) + " " + string(info.Example.Reply)
+		}
+	}
+	expected := map[string]string{
+		"Service1.Multiply": `{"A":2,"B":3} {"Result":6}`,
+		"EchoService.Echo":  `{"Text":"my *****"} {"Text":"my *****"}`,
+	}
+	if !reflect.DeepEqual(examples, expected) {
+		t.Errorf("Examples were %q, should be %q.", examples, expected)
+	}
+}
+
+func TestHookPriorities(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	var calls []string
+	hook := func(name string) func(i *RequestInfo) {
+		return func(i *RequestInfo) {
+			calls = append(calls, name)
+		}
+	}
+	s.RegisterBeforeFuncWithPriority(hook("log"), -10)
+	s.RegisterBeforeFuncWithPriority(hook("metrics"), 0)
+	s.RegisterBeforeFunc(hook("before"))
+	s.RegisterBeforeFuncWithPriority(hook("auth"), 100)
+	s.RegisterBeforeFuncWithPriority(hook("tenant"), 100)
+	s.RegisterBeforeFuncWithPriority(hook("trace"), 50)
+	s.RegisterAfterFuncWithPriority(hook("after-log"), -1)
+	s.RegisterAfterFunc(hook("after"))
+	s.RegisterAfterFuncWithPriority(hook("after-audit"), 1)
+
+	if w := serveMockJSON(t, s, "Service1.Multiply", Service1Request{A: 2, B: 3}); w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %q, should be the reply.", w.Body)
+	}
+	expected := []string{"auth", "tenant", "trace", "metrics", "before", "log", "after-audit", "after", "after-log"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("Calls were %q, should be %q.", calls, expected)
+	}
+}
+
+type DownloadArgs struct {
+	Name string
+}
+
+type DownloadService struct {
+}
+
+func (t *DownloadService) Signed(r *http.Request, args *DownloadArgs, reply *struct{}) error {
+	return &Redirect{URL: "https://files.example.com/" + args.Name + "?sig=abc", Code: http.StatusTemporaryRedirect}
+}
+
+func (t *DownloadService) Moved(r *http.Request, args *DownloadArgs, reply *struct{}) error {
+	return fmt.Errorf("moving %s: %w", args.Name, &Redirect{URL: "/v2/" + args.Name})
+}
+
+func TestRedirect(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(DownloadService), ""); err != nil {
+		t.Fatal(err)
+	}
+	var status int
+	s.RegisterAfterFunc(func(i *RequestInfo) {
+		status = i.StatusCode
+	})
+
+	w := serveMockJSON(t, s, "DownloadService.Signed", DownloadArgs{Name: "report.pdf"})
+	if w.Status != http.StatusTemporaryRedirect || w.Body != "" {
+		t.Errorf("Response was %d %q, should be an empty 307.", w.Status, w.Body)
+	}
+	if location := w.Header().Get("Location"); location != "https://files.example.com/report.pdf?sig=abc" {
+		t.Errorf("Location was %q.", location)
+	}
+	if status != http.StatusTemporaryRedirect {
+		t.Errorf("The after function got status %d, should be 307.", status)
+	}
+
+	w = serveMockJSON(t, s, "DownloadService.Moved", DownloadArgs{Name: "report.pdf"})
+	if w.Status != http.StatusFound || w.Header().Get("Location") != "/v2/report.pdf" {
+		t.Errorf("Response was %d to %q, should be a 302 to /v2/report.pdf.", w.Status, w.Header().Get("Location"))
+	}
+}
+
+type LookupArgs struct {
+	ID        int
+	RequestID string
+}
+
+type LookupService struct {
+	calls int
+}
+
+func (t *LookupService) Lookup(r *http.Request, args *LookupArgs, reply *EchoRequest) error {
+	t.calls++
+	reply.Text = "user " + strconv.Itoa(args.ID) + " for " + args.RequestID
+	return nil
+}
+
+func TestMethodCacheKeyFields(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	service := new(LookupService)
+	if err := s.RegisterService(service, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodCacheKeyFields("LookupService.Lookup", "ID"); err == nil {
+		t.Error("Expected an error for a method without cache")
+	}
+	if err := s.SetMethodCache("LookupService.Lookup", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodCacheKeyFields("LookupService.Lookup", "Missing"); err == nil {
+		t.Error("Expected an error for an unknown field")
+	}
+
+	// Without key fields, all the args make the key.
+	serveMockJSON(t, s, "LookupService.Lookup", LookupArgs{ID: 1, RequestID: "a"})
+	serveMockJSON(t, s, "LookupService.Lookup", LookupArgs{ID: 1, RequestID: "b"})
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be 2.", service.calls)
+	}
+
+	if err := s.SetMethodCacheKeyFields("LookupService.Lookup", "ID"); err != nil {
+		t.Fatal(err)
+	}
+	service.calls = 0
+	first := serveMockJSON(t, s, "LookupService.Lookup", LookupArgs{ID: 1, RequestID: "a"})
+	for _, requestID := range []string{"b", "c"} {
+		w := serveMockJSON(t, s, "LookupService.Lookup", LookupArgs{ID: 1, RequestID: requestID})
+		if w.Body != first.Body {
+			t.Errorf("Response was %q, should be the cached %q.", w.Body, first.Body)
+		}
+	}
+	if service.calls != 1 {
+		t.Errorf("Method was called %d times, should be 1.", service.calls)
+	}
+	if w := serveMockJSON(t, s, "LookupService.Lookup", LookupArgs{ID: 2, RequestID: "a"}); w.Body != "{\"Text\":\"user 2 for a\"}\n" {
+		t.Errorf("Response was %q, should be the reply for ID 2.", w.Body)
+	}
+	if service.calls != 2 {
+		t.Errorf("Method was called %d times, should be 2.", service.calls)
+	}
+}
+
+func TestOnRegistrationComplete(t *testing.T) {
+	s := NewServer()
+	var got [][]string
+	s.OnRegistrationComplete(func(methods []string) {
+		got = append(got, methods)
+	})
+	if err := s.RegisterService(new(Service1), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(AccountService), "Accounts"); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("Expected no call before FinalizeRegistration, got %q", got)
+	}
+	s.FinalizeRegistration()
+	expected := [][]string{{"Accounts.Delete", "Accounts.Get", "Service1.Multiply"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Methods were %q, should be %q.", got, expected)
+	}
+}
+
+type userKey struct{}
+
+type UserService struct {
+}
+
+func (t *UserService) Whoami(ctx context.Context, args *struct{}, reply *string) error {
+	user, ok := Value(ctx, userKey{}).(string)
+	if !ok {
+		return errors.New("no user")
+	}
+	*reply = user
+	return nil
+}
+
+func (t *UserService) Greet(r *http.Request, args *struct{}, reply *string) error {
+	user, _ := Value(r.Context(), userKey{}).(string)
+	*reply = "Hello, " + user
+	return nil
+}
+
+func TestRequestInfoSetValue(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(UserService), ""); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterBeforeFunc(func(i *RequestInfo) {
+		if user := i.Request.Header.Get("X-User"); user != "" {
+			i.SetValue(userKey{}, user)
+		}
+	})
+	serve := func(method, user string) *MockResponseWriter {
+		r, err := http.NewRequest("POST", "", strings.NewReader(`{"method":"`+method+`","params":{}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "mock/json")
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		w := NewMockResponseWriter()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := serve("UserService.Whoami", "alice"); w.Status != 200 || w.Body != "\"alice\"\n" {
+		t.Errorf("Response was %d %q, should be the user", w.Status, w.Body)
+	}
+	if w := serve("UserService.Greet", "bob"); w.Body != "\"Hello, bob\"\n" {
+		t.Errorf("Response was %q, should greet the user", w.Body)
+	}
+	// Values don't leak into other calls.
+	if w := serve("UserService.Whoami", ""); w.Status != 400 || w.Body != "no user" {
+		t.Errorf("Response was %d %q, should be an error without a user", w.Status, w.Body)
+	}
+	if v := Value(context.Background(), userKey{}); v != nil {
+		t.Errorf("Value outside a call was %v, should be nil", v)
+	}
+}
+
+type HeaderService struct {
+}
+
+func (t *HeaderService) Quote(ctx context.Context, args *Service1Request, reply *Service1Response) error {
+	SetResponseHeader(ctx, "X-Quote-Currency", "EUR")
+	SetResponseHeader(ctx, "Cache-Control", "max-age=60")
+	reply.Result = args.A * args.B
+	return nil
+}
+
+func (t *HeaderService) Throttled(ctx context.Context, args *Service1Request, reply *Service1Response) error {
+	SetResponseHeader(ctx, "Retry-After", "30")
+	return errors.New("slow down")
+}
+
+func TestSetResponseHeader(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(HeaderService), ""); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveMockJSON(t, s, "HeaderService.Quote", Service1Request{A: 2, B: 3})
+	if w.Status != 200 || w.Body != "{\"Result\":6}\n" {
+		t.Errorf("Response was %d %q, should be the reply.", w.Status, w.Body)
+	}
+	if h := w.Header(); h.Get("X-Quote-Currency") != "EUR" || h.Get("Cache-Control") != "max-age=60" {
+		t.Errorf("Headers were %v.", h)
+	}
+
+	w = serveMockJSON(t, s, "HeaderService.Throttled", Service1Request{A: 2, B: 3})
+	if w.Status != 400 || w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Response was %d with headers %v.", w.Status, w.Header())
+	}
+
+	// Outside a call, it does nothing.
+	SetResponseHeader(context.Background(), "X-Ignored", "1")
+}
+
+type BulkArgs struct {
+	Name    string
+	Count   int
+	Weights [256]int64
+}
+
+type BulkService struct {
+}
+
+func (t *BulkService) Describe(r *http.Request, args *BulkArgs, reply *EchoRequest) error {
+	reply.Text = fmt.Sprintf("%s:%d:%d", args.Name, args.Count, args.Weights[0])
+	return nil
+}
+
+func TestMethodArgsPool(t *testing.T) {
+	s := NewServer()
+	s.RegisterCodec(MockJSONCodec{}, "mock/json")
+	if err := s.RegisterService(new(BulkService), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodArgsPool("BulkService.Describe"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetMethodArgsPool("BulkService.Missing"); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+
+	full := map[string]interface{}{"Name": "full", "Count": 3, "Weights": []int{7}}
+	if w := serveMockJSON(t, s, "BulkService.Describe", full); w.Body != "{\"Text\":\"full:3:7\"}\n" {
+		t.Errorf("Response was %q.", w.Body)
+	}
+	// Reused args don't leak the fields of previous calls.
+	for i := 0; i < 10; i++ {
+		if w := serveMockJSON(t, s, "BulkService.Describe", map[string]interface{}{"Name": "partial"}); w.Body != "{\"Text\":\"partial:0:0\"}\n" {
+			t.Fatalf("Response was %q, should not hold the args of the previous call.", w.Body)
+		}
+	}
+}
+
+func BenchmarkMethodArgsPool(b *testing.B) {
+	body, _ := json.Marshal(map[string]interface{}{"method": "BulkService.Describe", "params": map[string]interface{}{"Name": "bench"}})
+	for _, pooled := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pooled=%v", pooled), func(b *testing.B) {
+			s := NewServer()
+			s.RegisterCodec(MockJSONCodec{}, "mock/json")
+			if err := s.RegisterService(new(BulkService), ""); err != nil {
+				b.Fatal(err)
+			}
+			if pooled {
+				if err := s.SetMethodArgsPool("BulkService.Describe"); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r, _ := http.NewRequest("POST", "", bytes.NewReader(body))
+				r.Header.Set("Content-Type", "mock/json")
+				s.ServeHTTP(NewMockResponseWriter(), r)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"sort"
+)
+
+// RegistrySnapshot describes the methods registered in a server, keyed by
+// their full name. It can be saved as JSON and compared later with the
+// snapshot of another server with DiffSnapshots.
+type RegistrySnapshot map[string]MethodInfo
+
+// RegistryDiff lists the full names of the methods that differ between two
+// snapshots, sorted by name.
+type RegistryDiff struct {
+	Added   []string `json:"added,omitempty"`   // only in the newer snapshot
+	Removed []string `json:"removed,omitempty"` // only in the older snapshot
+	Changed []string `json:"changed,omitempty"` // with other args or reply types
+}
+
+// Empty returns true if the snapshots have the same methods.
+func (d RegistryDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// Snapshot returns a snapshot of the enabled methods of the server, leaving
+// out the methods requiring a capability, see RequireCapability.
+func (s *Server) Snapshot() RegistrySnapshot {
+	snapshot := make(RegistrySnapshot)
+	for _, info := range s.services.methodInfos(nil) {
+		snapshot[info.Name] = info
+	}
+	return snapshot
+}
+
+// DiffSnapshots returns the methods added, removed and changed from the
+// older snapshot to the newer one, e.g. to catch accidental API removals
+// before deploying a server. Methods are compared by the names of their
+// args and reply types.
+func DiffSnapshots(older, newer RegistrySnapshot) RegistryDiff {
+	var diff RegistryDiff
+	for name, info := range newer {
+		old, ok := older[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+		} else if old.ArgsType != info.ArgsType || old.ReplyType != info.ReplyType {
+			diff.Changed = append(diff.Changed, name)
+		}
+	}
+	for name := range older {
+		if _, ok := newer[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
@@ -0,0 +1,172 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// statsSamples is the number of latest call durations kept per method to
+// compute the latency percentiles.
+const statsSamples = 1024
+
+// StatsArgs are the arguments of the system.stats method.
+type StatsArgs struct {
+}
+
+// StatsReply is the reply of the system.stats method, holding the stats of
+// each called method.
+type StatsReply struct {
+	Methods map[string]MethodStats `json:"methods"`
+}
+
+// MethodStats holds the number of calls of a method, the percentiles of the
+// duration of its latest calls and the average sizes of the bodies of its
+// requests and responses.
+type MethodStats struct {
+	Calls            int64         `json:"calls"`
+	P50              time.Duration `json:"p50"`
+	P90              time.Duration `json:"p90"`
+	P99              time.Duration `json:"p99"`
+	AvgRequestBytes  int64         `json:"avgRequestBytes"`
+	AvgResponseBytes int64         `json:"avgResponseBytes"`
+}
+
+// EnableStats sets the server to record the number of calls and the
+// duration of each method, and registers the "system.stats" method replying
+// with them in a StatsReply. Percentiles are computed over the latest 1024
+// calls of each method. Methods are identified by their canonical name, as
+// in "Service.Method", whatever the name they were called with.
+//
+// The sizes of the request and response bodies are measured as read and
+// written by the codec, after any compression. They aren't measured for the
+// calls of batch requests.
+func (s *Server) EnableStats() error {
+	if err := s.addSystemMethod("stats", "Stats"); err != nil {
+		return err
+	}
+	s.stats = &callStats{methods: make(map[string]*methodCalls)}
+	return nil
+}
+
+// callStats records the calls of each method.
+type callStats struct {
+	mutex   sync.Mutex
+	methods map[string]*methodCalls
+}
+
+// methodCalls holds the number of calls of a method and a ring buffer of the
+// durations of the latest ones.
+type methodCalls struct {
+	calls     int64
+	durations [statsSamples]time.Duration
+
+	// sized is the number of calls whose sizes were recorded.
+	sized         int64
+	requestBytes  int64
+	responseBytes int64
+}
+
+// record adds a call of method lasting d.
+func (c *callStats) record(method string, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	calls := c.methods[method]
+	if calls == nil {
+		calls = new(methodCalls)
+		c.methods[method] = calls
+	}
+	calls.durations[calls.calls%statsSamples] = d
+	calls.calls++
+}
+
+// recordSizes adds the body sizes of a call of method, if its call was
+// recorded.
+func (c *callStats) recordSizes(method string, request, response int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if calls := c.methods[method]; calls != nil {
+		calls.sized++
+		calls.requestBytes += request
+		calls.responseBytes += response
+	}
+}
+
+// snapshot returns the stats of each method.
+func (c *callStats) snapshot() map[string]MethodStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := make(map[string]MethodStats, len(c.methods))
+	for method, calls := range c.methods {
+		n := calls.calls
+		if n > statsSamples {
+			n = statsSamples
+		}
+		durations := make([]time.Duration, n)
+		copy(durations, calls.durations[:n])
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		methodStats := MethodStats{
+			Calls: calls.calls,
+			P50:   percentile(durations, 50),
+			P90:   percentile(durations, 90),
+			P99:   percentile(durations, 99),
+		}
+		if calls.sized > 0 {
+			methodStats.AvgRequestBytes = calls.requestBytes / calls.sized
+			methodStats.AvgResponseBytes = calls.responseBytes / calls.sized
+		}
+		stats[method] = methodStats
+	}
+	return stats
+}
+
+// percentile returns the p-th percentile of the sorted durations, using the
+// nearest-rank method.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// countingReader is a request body counting the bytes read from it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter is an http.ResponseWriter counting the bytes written to it.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter, if it supports it, for
+// streaming methods.
+func (w *countingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
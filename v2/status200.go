@@ -0,0 +1,55 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+)
+
+// SetAlwaysHTTP200 sets the server to write the error responses of codecs
+// with a 200 status, the error being reported in the body only, for clients
+// failing on other statuses. Transport-level errors keep their status:
+// request bodies too large (413), rejected by a tenant budget (429) or
+// refused while overloaded (503), as well as the errors written before a
+// codec is selected. The status reported to the After functions is left
+// unchanged.
+func (s *Server) SetAlwaysHTTP200(always bool) {
+	s.alwaysHTTP200 = always
+}
+
+// okStatusWriter is an http.ResponseWriter writing the error statuses other
+// than the transport-level ones as 200.
+type okStatusWriter struct {
+	http.ResponseWriter
+}
+
+func (w *okStatusWriter) WriteHeader(status int) {
+	if status >= 400 && !isTransportStatus(status) {
+		status = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush flushes the underlying ResponseWriter, if it supports it, for
+// streaming methods.
+func (w *okStatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *okStatusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// isTransportStatus returns true if status reports a transport-level error.
+func isTransportStatus(status int) bool {
+	switch status {
+	case http.StatusRequestEntityTooLarge, http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
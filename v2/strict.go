@@ -0,0 +1,21 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// StrictCodecRequest is implemented by codec requests able to reject args
+// with fields the args type doesn't have, e.g. JSON ones.
+type StrictCodecRequest interface {
+	CodecRequest
+	// DisallowUnknownFields makes ReadRequest fail with an
+	// *InvalidParamsError naming the first unknown field of the args.
+	DisallowUnknownFields()
+}
+
+// SetRejectUnknownFields sets the server to reject, as invalid params, the
+// requests whose args have fields unknown to the method, for codecs
+// implementing StrictCodecRequest.
+func (s *Server) SetRejectUnknownFields(reject bool) {
+	s.rejectUnknown = reject
+}
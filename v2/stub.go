@@ -0,0 +1,191 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// GenerateClientStub returns the Go source of a package with the given name
+// defining a Client type with a typed method for each registered method,
+// e.g. UsersGet for "Users.Get", calling it through the Client.Call
+// function. Streaming methods and methods reading the request body are
+// skipped.
+//
+// All the args and reply types must be nameable from another package: an
+// error is returned for unexported types and types of the main package.
+func (s *Server) GenerateClientStub(pkgName string) ([]byte, error) {
+	return s.services.generateClientStub(pkgName)
+}
+
+func (m *serviceMap) generateClientStub(pkgName string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	g := &stubGenerator{imports: map[string]string{"context": "context"}}
+	var body bytes.Buffer
+	funcs := make(map[string]string)
+	for _, serviceName := range sortedKeys(m.services) {
+		service := m.services[serviceName]
+		for _, methodName := range sortedKeys(service.methods) {
+			methodSpec := service.methods[methodName]
+			if methodSpec.streaming || methodSpec.readsBody {
+				continue
+			}
+			method := serviceName + m.sep() + methodName
+			funcName := stubFuncName(method, m.sep())
+			if other, ok := funcs[funcName]; ok {
+				return nil, fmt.Errorf("rpc: methods %q and %q have the same client method name %q", other, method, funcName)
+			}
+			funcs[funcName] = method
+			args, err := g.typeExpr(methodSpec.argsType)
+			if err != nil {
+				return nil, fmt.Errorf("rpc: args of %q: %v", method, err)
+			}
+			reply, err := g.typeExpr(methodSpec.replyType)
+			if err != nil {
+				return nil, fmt.Errorf("rpc: reply of %q: %v", method, err)
+			}
+			fmt.Fprintf(&body, "\n// %s calls %q.\n", funcName, method)
+			fmt.Fprintf(&body, "func (c *Client) %s(ctx context.Context, args *%s) (*%s, error) {\n", funcName, args, reply)
+			fmt.Fprintf(&body, "\treply := new(%s)\n", reply)
+			fmt.Fprintf(&body, "\tif err := c.Call(ctx, %q, args, reply); err != nil {\n\t\treturn nil, err\n\t}\n", method)
+			fmt.Fprintf(&body, "\treturn reply, nil\n}\n")
+		}
+	}
+
+	var b bytes.Buffer
+	b.WriteString("// Code generated by rpc.GenerateClientStub. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\nimport (\n", pkgName)
+	paths := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fmt.Fprintf(&b, "\t%s %q\n", g.imports[path], path)
+	}
+	b.WriteString(")\n\n")
+	b.WriteString("// Client calls the methods of a server through Call, which sends a call\n")
+	b.WriteString("// of the given method with args and decodes its reply, e.g. using a codec\n")
+	b.WriteString("// client.\n")
+	b.WriteString("type Client struct {\n\tCall func(ctx context.Context, method string, args, reply interface{}) error\n}\n")
+	b.Write(body.Bytes())
+	return format.Source(b.Bytes())
+}
+
+// stubFuncName returns the name of the client method calling method, its
+// parts separated by sep being joined with their first letter upper cased.
+func stubFuncName(method, sep string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(method, sep) {
+		r, n := utf8.DecodeRuneInString(part)
+		b.WriteRune(unicode.ToUpper(r))
+		b.WriteString(part[n:])
+	}
+	return b.String()
+}
+
+// stubGenerator renders types as Go expressions, collecting the packages
+// they import.
+type stubGenerator struct {
+	imports map[string]string // package names by import path
+}
+
+// typeExpr returns the Go expression of t.
+func (g *stubGenerator) typeExpr(t reflect.Type) (string, error) {
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			return t.Name(), nil
+		}
+		if !isExported(t.Name()) {
+			return "", fmt.Errorf("type %v is not exported", t)
+		}
+		if t.PkgPath() == "main" {
+			return "", fmt.Errorf("type %v can't be imported", t)
+		}
+		return g.importName(t) + "." + t.Name(), nil
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		elem, err := g.typeExpr(t.Elem())
+		return "*" + elem, err
+	case reflect.Slice:
+		elem, err := g.typeExpr(t.Elem())
+		return "[]" + elem, err
+	case reflect.Array:
+		elem, err := g.typeExpr(t.Elem())
+		return "[" + strconv.Itoa(t.Len()) + "]" + elem, err
+	case reflect.Map:
+		key, err := g.typeExpr(t.Key())
+		if err != nil {
+			return "", err
+		}
+		elem, err := g.typeExpr(t.Elem())
+		return "map[" + key + "]" + elem, err
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				return "", fmt.Errorf("field %s of %v is not exported", f.Name, t)
+			}
+			ft, err := g.typeExpr(f.Type)
+			if err != nil {
+				return "", err
+			}
+			field := f.Name + " " + ft
+			if f.Anonymous {
+				field = ft
+			}
+			if f.Tag != "" {
+				if strings.Contains(string(f.Tag), "`") {
+					field += " " + strconv.Quote(string(f.Tag))
+				} else {
+					field += " `" + string(f.Tag) + "`"
+				}
+			}
+			fields = append(fields, field)
+		}
+		return "struct{ " + strings.Join(fields, "; ") + " }", nil
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}", nil
+		}
+	}
+	return "", fmt.Errorf("unsupported type %v", t)
+}
+
+// importName returns the name the package of the named type t is imported
+// with, adding it to the imports.
+func (g *stubGenerator) importName(t reflect.Type) string {
+	if name, ok := g.imports[t.PkgPath()]; ok {
+		return name
+	}
+	// The type string is qualified with the package name.
+	base := strings.TrimSuffix(t.String(), "."+t.Name())
+	name := base
+	for i := 2; g.hasImportName(name); i++ {
+		name = base + strconv.Itoa(i)
+	}
+	g.imports[t.PkgPath()] = name
+	return name
+}
+
+func (g *stubGenerator) hasImportName(name string) bool {
+	for _, other := range g.imports {
+		if other == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// systemServiceName is the name of the service of the built-in methods.
+const systemServiceName = "system"
+
+// systemService is the receiver of the built-in methods, e.g. system.stats,
+// each registered when the server feature it belongs to is enabled.
+type systemService struct {
+	server *Server
+}
+
+// addSystemMethod registers the method of systemService with the given name
+// as the system method name, creating the service if needed. Like the other
+// system methods, it is exposed with its lower case name whatever the
+// method name transform.
+func (s *Server) addSystemMethod(name, methodName string) error {
+	rcvr := &systemService{server: s}
+	method, _ := reflect.TypeOf(rcvr).MethodByName(methodName)
+	methodSpec, _ := newServiceMethod(method)
+	m := s.services
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	system := m.services[systemServiceName]
+	if system == nil {
+		system = &service{
+			name:     systemServiceName,
+			rcvr:     reflect.ValueOf(rcvr),
+			rcvrType: reflect.TypeOf(rcvr),
+			methods:  make(map[string]*serviceMethod),
+		}
+		if m.services == nil {
+			m.services = make(map[string]*service)
+		}
+		m.services[systemServiceName] = system
+	} else if system.rcvrType != reflect.TypeOf(rcvr) {
+		return fmt.Errorf("rpc: service already defined: %q", systemServiceName)
+	}
+	if _, ok := system.methods[name]; ok {
+		return fmt.Errorf("rpc: method already defined: %q", systemServiceName+m.sep()+name)
+	}
+	methodSpec.info = newMethodInfo(systemServiceName+m.sep()+name, methodSpec)
+	m.updateMethods(system, func(methods map[string]*serviceMethod) {
+		methods[name] = methodSpec
+	})
+	return nil
+}
+
+// removeSystemMethod unregisters the system method with the given name,
+// and the system service with its last method.
+func (s *Server) removeSystemMethod(name string) {
+	m := s.services
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	system := m.services[systemServiceName]
+	if system == nil || system.rcvrType != reflect.TypeOf((*systemService)(nil)) {
+		return
+	}
+	if _, ok := system.methods[name]; !ok {
+		return
+	}
+	if len(system.methods) == 1 {
+		delete(m.services, systemServiceName)
+		return
+	}
+	m.updateMethods(system, func(methods map[string]*serviceMethod) {
+		delete(methods, name)
+	})
+}
+
+// Stats replies with the stats recorded for each method.
+func (t *systemService) Stats(r *http.Request, args *StatsArgs, reply *StatsReply) error {
+	if stats := t.server.stats; stats != nil {
+		reply.Methods = stats.snapshot()
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"strings"
+	"time"
+)
+
+// SetTraceTimings sets the server to log, through the logger set with
+// SetLogger, the time spent serving each call in each phase of the
+// dispatch: "resolve", "before-hooks" for the Intercept and Before
+// functions, "schema" for the params schema, "decode", "bind" for the arg
+// binder and the args preprocessor, "validate", "handler", "encode" and
+// "after-hooks" for the After functions. It is meant for latency debugging
+// and disabled by default.
+func (s *Server) SetTraceTimings(enabled bool) {
+	s.traceTimings = enabled
+}
+
+// phaseTiming is the time spent in a dispatch phase.
+type phaseTiming struct {
+	phase    string
+	duration time.Duration
+}
+
+// phaseTimer measures the time spent in the phases of a call. A nil
+// phaseTimer measures nothing.
+type phaseTimer struct {
+	start  time.Time
+	last   time.Time
+	phases []phaseTiming
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+	return &phaseTimer{start: now, last: now}
+}
+
+// mark ends the current phase, adding the time elapsed since the previous
+// mark to the given phase.
+func (t *phaseTimer) mark(phase string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	elapsed := now.Sub(t.last)
+	t.last = now
+	for i := range t.phases {
+		if t.phases[i].phase == phase {
+			t.phases[i].duration += elapsed
+			return
+		}
+	}
+	t.phases = append(t.phases, phaseTiming{phase: phase, duration: elapsed})
+}
+
+// logTrace logs the phase timings of a call to method.
+func (s *Server) logTrace(method string, t *phaseTimer) {
+	var b strings.Builder
+	for _, p := range t.phases {
+		b.WriteString(" " + p.phase + "=" + p.duration.String())
+	}
+	s.logf("rpc: trace %q:%s total=%s", method, b.String(), time.Since(t.start))
+}
@@ -0,0 +1,51 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+)
+
+// AddResponseTransform adds a transform of the replies of method, e.g. to
+// mask or enrich fields. Transforms run in the order they were added, each
+// receiving the value returned by the previous one, after the method
+// returned and before the reply is encoded. They don't run for errors,
+// except partial results and replies written along with errors, see
+// SetIncludeReplyOnError, nor for streaming methods. A transform error is
+// written instead of the reply, with a 500 status.
+//
+// Transforms must not modify the reply in place, besides its top-level
+// fields: the values it references are shared with the reply cached for the
+// method, see SetMethodCache, and with the replies of coalesced calls, see
+// SetCoalesce. They return a modified copy instead.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) AddResponseTransform(method string, f func(reply interface{}) (interface{}, error)) error {
+	_, methodSpec, err := s.services.lookup(method)
+	if err != nil {
+		return err
+	}
+	if methodSpec.streaming {
+		return fmt.Errorf("rpc: method %q writes its own response, its reply can't be transformed", method)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	methodSpec.transforms = append(methodSpec.transforms, f)
+	return nil
+}
+
+// transformChain holds the reply transforms of a method, in order.
+type transformChain []func(reply interface{}) (interface{}, error)
+
+// apply returns reply as transformed by the transforms of method.
+func (c transformChain) apply(method string, reply interface{}) (interface{}, error) {
+	for _, transform := range c {
+		var err error
+		if reply, err = transform(reply); err != nil {
+			return nil, fmt.Errorf("rpc: transforming the reply of %q: %v", method, err)
+		}
+	}
+	return reply, nil
+}
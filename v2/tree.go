@@ -0,0 +1,153 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"strings"
+)
+
+// ServiceInfo describes a node of the tree formed by the dotted service names.
+type ServiceInfo struct {
+	Name     string   // last part of the service path
+	Methods  []string // sorted method names, empty for namespace-only nodes
+	Children int      // number of direct child nodes
+}
+
+// MethodInfo describes a registered method.
+type MethodInfo struct {
+	Name        string       `json:"name"`                  // full name of the method, e.g. "Service.Method"
+	ArgsType    string       `json:"argsType"`              // type of the args, e.g. "pkg.Args"
+	ReplyType   string       `json:"replyType"`             // type of the reply, "http.ResponseWriter" for streaming methods
+	Deprecation *Deprecation `json:"deprecation,omitempty"` // set by DeprecateMethod, nil if not deprecated
+	Example     *Example     `json:"example,omitempty"`     // captured if SetCaptureExamples is set
+}
+
+// newMethodInfo returns the description of the method registered with the
+// given full name.
+func newMethodInfo(name string, m *serviceMethod) MethodInfo {
+	info := MethodInfo{
+		Name:      name,
+		ArgsType:  m.argsType.String(),
+		ReplyType: typeOfResponseWriter.String(),
+	}
+	if m.replyType != nil {
+		info.ReplyType = m.replyType.String()
+	}
+	return info
+}
+
+// serviceNode is a node of the service tree. Nodes of paths that are only
+// a prefix of service names, like "A" for the service "A.B", have no service.
+type serviceNode struct {
+	name     string
+	service  *service
+	children map[string]*serviceNode
+}
+
+// buildTree returns the root of the tree of the given services, their
+// names being split at sep, which has no name.
+func buildTree(services map[string]*service, sep string) *serviceNode {
+	root := &serviceNode{children: make(map[string]*serviceNode)}
+	for name, s := range services {
+		node := root
+		for _, part := range strings.Split(name, sep) {
+			child := node.children[part]
+			if child == nil {
+				child = &serviceNode{name: part, children: make(map[string]*serviceNode)}
+				node.children[part] = child
+			}
+			node = child
+		}
+		node.service = s
+	}
+	return root
+}
+
+// walk calls fn for each node of the service tree, depth-first with parents
+// before their children and siblings sorted by name. fn is called with the
+// mutex held.
+func (m *serviceMap) walk(fn func(path string, info ServiceInfo)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	buildTree(m.services, m.sep()).walk("", m.sep(), fn)
+}
+
+func (n *serviceNode) walk(path, sep string, fn func(path string, info ServiceInfo)) {
+	for _, name := range sortedKeys(n.children) {
+		child := n.children[name]
+		childPath := name
+		if path != "" {
+			childPath = path + sep + name
+		}
+		fn(childPath, child.info())
+		child.walk(childPath, sep, fn)
+	}
+}
+
+// info returns the description of the node.
+func (n *serviceNode) info() ServiceInfo {
+	info := ServiceInfo{
+		Name:     n.name,
+		Children: len(n.children),
+	}
+	if n.service != nil {
+		info.Methods = sortedKeys(n.service.methods)
+	}
+	return info
+}
+
+// ----------------------------------------------------------------------------
+// ServiceSnapshot
+// ----------------------------------------------------------------------------
+
+// ServiceSnapshot is an immutable copy of the service tree, which can be
+// inspected without locking the registrations of the server.
+type ServiceSnapshot struct {
+	paths []string
+	infos map[string]ServiceInfo
+}
+
+// snapshot returns a copy of the service tree. The mutex is only held while
+// copying the set of services.
+func (m *serviceMap) snapshot() *ServiceSnapshot {
+	m.mutex.Lock()
+	services := make(map[string]*service, len(m.services))
+	for name, s := range m.services {
+		services[name] = s
+	}
+	m.mutex.Unlock()
+
+	snapshot := &ServiceSnapshot{infos: make(map[string]ServiceInfo)}
+	buildTree(services, m.sep()).walk("", m.sep(), func(path string, info ServiceInfo) {
+		snapshot.paths = append(snapshot.paths, path)
+		snapshot.infos[path] = info
+	})
+	return snapshot
+}
+
+// Walk calls fn for each node of the snapshot, in the same order as
+// Server.WalkServices.
+func (s *ServiceSnapshot) Walk(fn func(path string, info ServiceInfo)) {
+	for _, path := range s.paths {
+		info, _ := s.Lookup(path)
+		fn(path, info)
+	}
+}
+
+// Lookup returns the node of the snapshot with the given path.
+func (s *ServiceSnapshot) Lookup(path string) (ServiceInfo, bool) {
+	info, ok := s.infos[path]
+	if !ok {
+		return ServiceInfo{}, false
+	}
+	// Callers get their own copy of the methods.
+	info.Methods = append([]string(nil), info.Methods...)
+	return info, true
+}
+
+// Len returns the number of nodes of the snapshot.
+func (s *ServiceSnapshot) Len() int {
+	return len(s.paths)
+}
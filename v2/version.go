@@ -0,0 +1,48 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// VersionHeader is the header carrying the API version of a request,
+// checked for the services set with RequireVersion.
+const VersionHeader = "X-Api-Version"
+
+// versionRange is the range of API versions accepted by a service.
+type versionRange struct {
+	min, max int
+}
+
+// RequireVersion sets the server to reject, with a 400 status, the calls to
+// the methods of the given service without a VersionHeader holding a version
+// between min and max inclusive. Services nested in it, like "A.B" for "A",
+// aren't affected.
+func (s *Server) RequireVersion(service string, min, max int) error {
+	if min > max {
+		return fmt.Errorf("rpc: invalid version range for %q: %d-%d", service, min, max)
+	}
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	serviceSpec, ok := s.services.services[service]
+	if !ok {
+		return fmt.Errorf("rpc: can't find service %q", service)
+	}
+	serviceSpec.versions = &versionRange{min: min, max: max}
+	return nil
+}
+
+// check returns an error if the API version of r isn't in the range.
+func (v *versionRange) check(r *http.Request) error {
+	header := r.Header.Get(VersionHeader)
+	version, err := strconv.Atoi(header)
+	if err != nil || version < v.min || version > v.max {
+		return fmt.Errorf("rpc: %s must be between %d and %d, got %q", VersionHeader, v.min, v.max, header)
+	}
+	return nil
+}
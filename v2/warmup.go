@@ -0,0 +1,64 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+// WarmupCodec is implemented by codecs that can prepare the encoding of the
+// args and reply types of a method ahead of its first call, e.g. to fill
+// the type caches of their serialization package.
+type WarmupCodec interface {
+	Codec
+	// Warmup prepares the decoding of argsType and the encoding of
+	// replyType. Either may be nil, e.g. for the reply of streaming
+	// methods.
+	Warmup(argsType, replyType reflect.Type)
+}
+
+// Warmup prepares the registered methods for their first call, to avoid the
+// latency of any setup done on first use. The service registrations are
+// already complete, so it passes the args and reply types of every method
+// to the registered codecs implementing WarmupCodec. It should be called
+// once all the services and codecs are registered.
+func (s *Server) Warmup() {
+	var codecs []WarmupCodec
+	for _, codec := range s.codecs {
+		if c, ok := codec.(WarmupCodec); ok {
+			codecs = append(codecs, c)
+		}
+	}
+	if c, ok := s.fallbackCodec.(WarmupCodec); ok {
+		codecs = append(codecs, c)
+	}
+	if len(codecs) == 0 {
+		return
+	}
+	for _, types := range s.services.methodTypes() {
+		for _, c := range codecs {
+			c.Warmup(types[0], types[1])
+		}
+	}
+}
+
+// methodTypes returns the args and reply types of every registered method,
+// nil for the args of methods reading the request body and the reply of
+// streaming methods.
+func (m *serviceMap) methodTypes() [][2]reflect.Type {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var types [][2]reflect.Type
+	for _, s := range m.services {
+		for _, method := range s.methods {
+			argsType := method.argsType
+			if method.readsBody {
+				argsType = nil
+			}
+			types = append(types, [2]reflect.Type{argsType, method.replyType})
+		}
+	}
+	return types
+}